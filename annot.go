@@ -10,12 +10,18 @@ import "unsafe"
 
 // Annot represents a PDF annotation.
 type Annot struct {
-	ctx   *context
+	ctx   *fzContext
 	annot *C.pdf_annot
 	page  *Page
 }
 
-func (a *Annot) Type() int { return int(C.gomupdf_annot_type(a.ctx.ctx, a.annot)) }
+// Type returns the annotation type, or -1 if its page was closed.
+func (a *Annot) Type() int {
+	if a.page.closed() {
+		return -1
+	}
+	return int(C.gomupdf_annot_type(a.ctx.ctx, a.annot))
+}
 
 func (a *Annot) TypeString() string {
 	names := map[int]string{
@@ -34,11 +40,17 @@ func (a *Annot) TypeString() string {
 }
 
 func (a *Annot) Rect() Rect {
+	if a.page.closed() {
+		return Rect{}
+	}
 	r := C.gomupdf_annot_rect(a.ctx.ctx, a.annot)
 	return Rect{X0: float64(r.x0), Y0: float64(r.y0), X1: float64(r.x1), Y1: float64(r.y1)}
 }
 
 func (a *Annot) Contents() string {
+	if a.page.closed() {
+		return ""
+	}
 	s := C.gomupdf_annot_contents(a.ctx.ctx, a.annot)
 	if s == nil {
 		return ""
@@ -47,15 +59,23 @@ func (a *Annot) Contents() string {
 }
 
 func (a *Annot) SetContents(text string) {
+	if a.page.closed() {
+		return
+	}
 	cText := C.CString(text)
 	defer C.free(unsafe.Pointer(cText))
 	C.gomupdf_set_annot_contents(a.ctx.ctx, a.annot, cText)
 }
 
-func (a *Annot) Xref() int { return int(C.gomupdf_annot_xref(a.ctx.ctx, a.annot)) }
+func (a *Annot) Xref() int {
+	if a.page.closed() {
+		return 0
+	}
+	return int(C.gomupdf_annot_xref(a.ctx.ctx, a.annot))
+}
 
 func (p *Page) GetAnnots() []*Annot {
-	if !p.doc.IsPDF() {
+	if p.closed() || !p.doc.IsPDF() {
 		return nil
 	}
 	pdfPage := C.pdf_page_from_fz_page(p.ctx.ctx, p.page)
@@ -70,6 +90,9 @@ func (p *Page) GetAnnots() []*Annot {
 }
 
 func (p *Page) AddTextAnnot(pos Point, text string) (*Annot, error) {
+	if p.closed() {
+		return nil, ErrClosed
+	}
 	if !p.doc.IsPDF() {
 		return nil, ErrNotPDF
 	}
@@ -87,6 +110,9 @@ func (p *Page) AddTextAnnot(pos Point, text string) (*Annot, error) {
 }
 
 func (p *Page) AddHighlightAnnot(quads []Quad) (*Annot, error) {
+	if p.closed() {
+		return nil, ErrClosed
+	}
 	if !p.doc.IsPDF() {
 		return nil, ErrNotPDF
 	}
@@ -114,6 +140,9 @@ func (p *Page) AddHighlightAnnot(quads []Quad) (*Annot, error) {
 }
 
 func (p *Page) AddFreetextAnnot(rect Rect, text string, fontsize float64) (*Annot, error) {
+	if p.closed() {
+		return nil, ErrClosed
+	}
 	if !p.doc.IsPDF() {
 		return nil, ErrNotPDF
 	}
@@ -133,6 +162,9 @@ func (p *Page) AddFreetextAnnot(rect Rect, text string, fontsize float64) (*Anno
 }
 
 func (p *Page) DeleteAnnot(annot *Annot) error {
+	if p.closed() || annot.page.closed() {
+		return ErrClosed
+	}
 	if !p.doc.IsPDF() {
 		return ErrNotPDF
 	}
@@ -0,0 +1,211 @@
+package gomupdf
+
+import (
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// chunkLine is a line of text and where it is.
+type chunkLine struct {
+	text string
+	page int
+	rect Rect
+}
+
+// chunkPara is a paragraph or heading of a document, with the path of the
+// table of contents entries it belongs to.
+type chunkPara struct {
+	lines   []chunkLine
+	heading bool
+	toc     []string
+}
+
+func (p *chunkPara) text() string {
+	var text string
+	for i, l := range p.lines {
+		if i == 0 {
+			text = l.text
+		} else {
+			text = joinLines(text, l.text)
+		}
+	}
+	return text
+}
+
+// ended reports whether the paragraph ends a sentence, so that it does
+// not continue on the next page.
+func (p *chunkPara) ended() bool {
+	r, _ := utf8.DecodeLastRuneInString(p.lines[len(p.lines)-1].text)
+	return strings.ContainsRune(".!?:;\"”»", r)
+}
+
+// lastPage returns the page of the paragraph's last line.
+func (p *chunkPara) lastPage() int {
+	return p.lines[len(p.lines)-1].page
+}
+
+// tocMark is the table of contents path that starts at an entry.
+type tocMark struct {
+	page  int // 0-based
+	title string
+	path  []string
+}
+
+// tocMarks returns the marks of the entries of toc that have a page,
+// ordered by page. Entries of the same page keep their order.
+func tocMarks(toc []TOCItem) []tocMark {
+	var marks []tocMark
+	var path []string
+	for _, item := range toc {
+		path = append(path[:min(len(path), max(item.Level-1, 0))], item.Title)
+		if item.Page < 1 {
+			continue
+		}
+		marks = append(marks, tocMark{item.Page - 1, normalizeTitle(item.Title), slices.Clone(path)})
+	}
+	slices.SortStableFunc(marks, func(a, b tocMark) int { return a.page - b.page })
+	return marks
+}
+
+func normalizeTitle(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// chunkParas splits the text blocks of pages, given by page number in
+// ascending order, into paragraphs. Blocks in a heading font size become
+// headings, and the last paragraph of a page is continued on the next
+// page unless it ends a sentence or a heading follows. A table of contents
+// entry starts at a heading with its title on its page, or else at the top
+// of its page; entries of pages left out take effect at the next page.
+func chunkParas(pnos []int, pages []mdPage, toc []TOCItem) []chunkPara {
+	levels := headingLevels(pages)
+	marks := tocMarks(toc)
+	var path []string
+
+	var paras []chunkPara
+	for i, m := range pages {
+		for len(marks) > 0 && marks[0].page < pnos[i] {
+			path, marks = marks[0].path, marks[1:]
+		}
+		var blocks []STextBlock
+		for _, b := range m.blocks {
+			if b.Type == STextBlockText && strings.TrimSpace(b.Text()) != "" {
+				blocks = append(blocks, b)
+			}
+		}
+		// Position the marks of the page: before the block with the
+		// title, or with the preceding mark.
+		var at []int
+		pos := -1
+		for _, mark := range marks {
+			if mark.page != pnos[i] {
+				break
+			}
+			for j := max(pos, 0); j < len(blocks); j++ {
+				if normalizeTitle(blocks[j].Text()) == mark.title {
+					pos = j
+					break
+				}
+			}
+			at = append(at, pos)
+		}
+		for len(at) > 0 && at[0] < 0 {
+			path, marks, at = marks[0].path, marks[1:], at[1:]
+		}
+
+		for j, b := range blocks {
+			for len(at) > 0 && at[0] == j {
+				path, marks, at = marks[0].path, marks[1:], at[1:]
+			}
+			para := chunkPara{heading: levels[textSize(b.Lines)] > 0, toc: path}
+			for _, l := range b.Lines {
+				if text := strings.TrimSpace(l.Text()); text != "" {
+					para.lines = append(para.lines, chunkLine{text, pnos[i], l.Rect})
+				}
+			}
+			if n := len(paras); j == 0 && n > 0 && !para.heading && !paras[n-1].heading &&
+				!paras[n-1].ended() && paras[n-1].lastPage() == pnos[i]-1 && slices.Equal(paras[n-1].toc, path) {
+				paras[n-1].lines = append(paras[n-1].lines, para.lines...)
+				continue
+			}
+			paras = append(paras, para)
+		}
+	}
+	return paras
+}
+
+// chunkText packs paragraphs into chunks no larger than opt.MaxSize.
+// Headings and table of contents entries start new chunks; paragraphs
+// too large for a chunk are split between lines, and lines between
+// words.
+func chunkText(paras []chunkPara, opt ChunkOptions) []Chunk {
+	size := opt.Size
+	if size == nil {
+		size = utf8.RuneCountInString
+	}
+	fits := func(text string) bool {
+		return opt.MaxSize <= 0 || size(text) <= opt.MaxSize
+	}
+
+	var chunks []Chunk
+	var cur *Chunk
+	add := func(p chunkPara, text string) {
+		if cur != nil && !fits(cur.Text+"\n\n"+text) {
+			cur = nil
+		}
+		if cur == nil {
+			chunks = append(chunks, Chunk{TOCPath: p.toc})
+			cur = &chunks[len(chunks)-1]
+		} else {
+			cur.Text += "\n\n"
+		}
+		cur.Text += text
+		// One span per paragraph and page.
+		for i, l := range p.lines {
+			if n := len(cur.Spans); i > 0 && l.page == p.lines[i-1].page {
+				cur.Spans[n-1].Rect = cur.Spans[n-1].Rect.Union(l.rect)
+				continue
+			}
+			cur.Spans = append(cur.Spans, ChunkSpan{l.page, l.rect})
+		}
+	}
+
+	for _, p := range paras {
+		if p.heading || cur != nil && !slices.Equal(cur.TOCPath, p.toc) {
+			cur = nil
+		}
+		if text := p.text(); fits(text) {
+			add(p, text)
+			continue
+		}
+		// Pack the lines, and the words of lines that are too long, into
+		// pieces that fit.
+		piece := chunkPara{toc: p.toc}
+		var text string
+		for _, l := range p.lines {
+			words := []string{l.text}
+			if !fits(l.text) {
+				words = strings.Fields(l.text)
+			}
+			for _, w := range words {
+				next := w
+				if len(piece.lines) > 0 {
+					next = joinLines(text, w)
+				}
+				if len(piece.lines) > 0 && !fits(next) {
+					add(piece, text)
+					piece.lines, next = nil, w
+				}
+				text = next
+				if n := len(piece.lines); n == 0 || piece.lines[n-1] != l {
+					piece.lines = append(piece.lines, l)
+				}
+			}
+		}
+		if len(piece.lines) > 0 {
+			add(piece, text)
+		}
+	}
+	return chunks
+}
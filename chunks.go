@@ -0,0 +1,54 @@
+//go:build cgo && !nomupdf
+
+package gomupdf
+
+import "slices"
+
+// Chunks splits the text of the pages of opt into chunks for retrieval.
+// Chunks hold whole paragraphs up to opt.MaxSize and start at headings,
+// which are told by their font size as in ToMarkdown, and at the entries
+// of the table of contents. A paragraph that continues on
+// the next page stays in one chunk with a span on each page; a paragraph
+// too large for a chunk is split between lines or words.
+func (d *Document) Chunks(opt ChunkOptions) ([]Chunk, error) {
+	if d.IsClosed() {
+		return nil, ErrClosed
+	}
+	toc, err := d.GetTOC(true)
+	if err != nil {
+		return nil, err
+	}
+	var pnos []int
+	if opt.Pages == nil {
+		for pno := range d.PageCount() {
+			pnos = append(pnos, pno)
+		}
+	} else {
+		pnos = slices.Compact(slices.Sorted(slices.Values(opt.Pages)))
+	}
+	var pages []mdPage
+	for _, pno := range pnos {
+		blocks, err := d.pageBlocks(pno)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, mdPage{blocks: blocks})
+	}
+	return chunkText(chunkParas(pnos, pages, toc), opt), nil
+}
+
+func (d *Document) pageBlocks(pno int) ([]STextBlock, error) {
+	page, err := d.LoadPage(pno)
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+	opt := DefaultTextOptions()
+	opt.Sort = true
+	tp, err := page.GetTextPageWithOptions(opt)
+	if err != nil {
+		return nil, err
+	}
+	defer tp.Close()
+	return tp.Blocks(), nil
+}
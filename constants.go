@@ -22,6 +22,29 @@ const (
 	TextCIDForUnknownUnicode = 1 << 7
 )
 
+// Font flags of structured text spans — corresponds to PyMuPDF TEXT_FONT_* flags.
+const (
+	TextFontSuperscript = 1 << 0
+	TextFontItalic      = 1 << 1
+	TextFontSerifed     = 1 << 2
+	TextFontMonospaced  = 1 << 3
+	TextFontBold        = 1 << 4
+)
+
+// Selection modes for TextPage.Selection.
+const (
+	SelectChars = iota
+	SelectWords
+	SelectLines
+)
+
+// Table detection strategies for TableOptions.
+const (
+	TableStrategyAuto  = iota // ruling lines, then text alignment
+	TableStrategyLines        // ruling lines only
+	TableStrategyText         // text alignment only
+)
+
 // Default text flags (matches PyMuPDF default flags=3).
 const TextFlagsDefault = TextPreserveLigatures | TextPreserveWhitespace
 
@@ -99,6 +122,20 @@ const (
 	CsCMYK
 )
 
+// Line cap styles for FinishOptions.
+const (
+	LineCapButt = iota
+	LineCapRound
+	LineCapSquare
+)
+
+// Line join styles for FinishOptions.
+const (
+	LineJoinMiter = iota
+	LineJoinRound
+	LineJoinBevel
+)
+
 // Standard page sizes in points (1 point = 1/72 inch).
 var (
 	PaperA4     = Rect{X0: 0, Y0: 0, X1: 595, Y1: 842}
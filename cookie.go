@@ -0,0 +1,92 @@
+//go:build cgo && !nomupdf
+
+package gomupdf
+
+/*
+#include "gomupdf.h"
+*/
+import "C"
+import (
+	"context"
+	"time"
+)
+
+// progressInterval is how often the progress callback is invoked while an
+// operation runs.
+const progressInterval = 100 * time.Millisecond
+
+// cookie connects a context.Context to an fz_cookie. MuPDF polls the
+// cookie's abort flag, which is raised when the context is done, and
+// updates its counters, which are forwarded to the WithProgress callback.
+type cookie struct {
+	c    *C.fz_cookie
+	fn   func(Progress)
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newCookie returns nil if ctx can never be cancelled and carries no
+// progress callback, so the plain methods pay nothing for cancellation.
+func newCookie(ctx context.Context) *cookie {
+	fn := progressFunc(ctx)
+	if ctx.Done() == nil && fn == nil {
+		return nil
+	}
+	c := C.gomupdf_new_cookie()
+	if c == nil {
+		return nil
+	}
+	ck := &cookie{c: c, fn: fn, stop: make(chan struct{}), done: make(chan struct{})}
+	go ck.watch(ctx.Done())
+	return ck
+}
+
+func (ck *cookie) watch(cancel <-chan struct{}) {
+	defer close(ck.done)
+	var tick <-chan time.Time
+	if ck.fn != nil {
+		t := time.NewTicker(progressInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-cancel:
+			C.gomupdf_cookie_abort(ck.c)
+			cancel = nil
+		case <-tick:
+			ck.report()
+		case <-ck.stop:
+			return
+		}
+	}
+}
+
+func (ck *cookie) report() {
+	var progress, errors C.int
+	var max C.int64_t
+	C.gomupdf_cookie_progress(ck.c, &progress, &max, &errors)
+	ck.fn(Progress{Current: int(progress), Max: int(max), Errors: int(errors)})
+}
+
+// ptr returns the fz_cookie to pass to MuPDF, or nil for a nil cookie.
+func (ck *cookie) ptr() *C.fz_cookie {
+	if ck == nil {
+		return nil
+	}
+	return ck.c
+}
+
+// close stops the watcher, delivers the final progress report and frees
+// the fz_cookie. It must be called after MuPDF has stopped using it.
+func (ck *cookie) close() {
+	if ck == nil {
+		return
+	}
+	close(ck.stop)
+	<-ck.done
+	if ck.fn != nil {
+		ck.report()
+	}
+	C.gomupdf_drop_cookie(ck.c)
+}
@@ -0,0 +1,195 @@
+//go:build cgo && !nomupdf
+
+package gomupdf
+
+/*
+#include "gomupdf.h"
+*/
+import "C"
+import (
+	"context"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// Run replays the page, including annotations, through dev with the
+// transformation m applied. The page is recorded while the document is
+// locked and replayed without the lock, so dev may use the document. A
+// panic in dev stops the run and is re-raised by Run.
+func (p *Page) Run(dev Device, m Matrix) error {
+	return p.RunCtx(context.Background(), dev, m)
+}
+
+// RunCtx is like Run but stops when ctx is cancelled or its deadline
+// passes, in which case it returns ctx.Err().
+func (p *Page) RunCtx(ctx context.Context, dev Device, m Matrix) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if dev == nil {
+		return ErrInvalidArg
+	}
+	ck := newCookie(ctx)
+	defer ck.close()
+	list, fc, err := p.displayList("Page.Run", true, ck, ErrDevice)
+	if err != nil {
+		return err
+	}
+	defer fc.close()
+
+	run := &deviceRun{dev: dev}
+	h := cgo.NewHandle(run)
+	errcode := C.gomupdf_run_go_device(fc.ctx, list, C.uintptr_t(h),
+		C.float(m.A), C.float(m.B), C.float(m.C), C.float(m.D), C.float(m.E), C.float(m.F), ck.ptr())
+	C.gomupdf_drop_display_list(fc.ctx, list)
+	h.Delete()
+	if run.panic != nil {
+		panic(run.panic)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if errcode != 0 {
+		return fc.failed("Page.Run", errcode, ErrDevice)
+	}
+	return nil
+}
+
+// deviceRun is the state behind the handle of a Go device.
+type deviceRun struct {
+	dev   Device
+	panic any // value of a panic in dev, re-raised by Run
+}
+
+//export gomupdfDeviceCall
+func gomupdfDeviceCall(handle C.uintptr_t, call *C.gomupdf_device_call) (ret C.int) {
+	run := cgo.Handle(handle).Value().(*deviceRun)
+	defer func() {
+		if v := recover(); v != nil {
+			run.panic = v
+			ret = 1
+		}
+	}()
+	dev, ctx := run.dev, call.ctx
+	ctm := matrixFromC(call.ctm)
+	rect := rectFromC(call.rect)
+	switch call.op {
+	case C.GOMUPDF_DEV_FILL_PATH:
+		dev.FillPath(devicePath(call), call.even_odd != 0, ctm, deviceColor(call))
+	case C.GOMUPDF_DEV_STROKE_PATH:
+		dev.StrokePath(devicePath(call), strokeState(call.stroke), ctm, deviceColor(call))
+	case C.GOMUPDF_DEV_CLIP_PATH:
+		dev.ClipPath(devicePath(call), call.even_odd != 0, ctm, rect)
+	case C.GOMUPDF_DEV_CLIP_STROKE_PATH:
+		dev.ClipStrokePath(devicePath(call), strokeState(call.stroke), ctm, rect)
+	case C.GOMUPDF_DEV_FILL_TEXT:
+		dev.FillText(textSpans(ctx, call.text), ctm, deviceColor(call))
+	case C.GOMUPDF_DEV_STROKE_TEXT:
+		dev.StrokeText(textSpans(ctx, call.text), strokeState(call.stroke), ctm, deviceColor(call))
+	case C.GOMUPDF_DEV_CLIP_TEXT:
+		dev.ClipText(textSpans(ctx, call.text), ctm, rect)
+	case C.GOMUPDF_DEV_CLIP_STROKE_TEXT:
+		dev.ClipStrokeText(textSpans(ctx, call.text), strokeState(call.stroke), ctm, rect)
+	case C.GOMUPDF_DEV_IGNORE_TEXT:
+		dev.IgnoreText(textSpans(ctx, call.text), ctm)
+	case C.GOMUPDF_DEV_FILL_SHADE:
+		dev.FillShade(rect, ctm, float64(call.alpha))
+	case C.GOMUPDF_DEV_FILL_IMAGE:
+		dev.FillImage(deviceImage(ctx, call.image), ctm, float64(call.alpha))
+	case C.GOMUPDF_DEV_FILL_IMAGE_MASK:
+		dev.FillImageMask(deviceImage(ctx, call.image), ctm, deviceColor(call))
+	case C.GOMUPDF_DEV_CLIP_IMAGE_MASK:
+		dev.ClipImageMask(deviceImage(ctx, call.image), ctm, rect)
+	case C.GOMUPDF_DEV_POP_CLIP:
+		dev.PopClip()
+	case C.GOMUPDF_DEV_BEGIN_MASK:
+		dev.BeginMask(rect, call.luminosity != 0, deviceColor(call))
+	case C.GOMUPDF_DEV_END_MASK:
+		dev.EndMask()
+	case C.GOMUPDF_DEV_BEGIN_GROUP:
+		dev.BeginGroup(rect, call.isolated != 0, call.knockout != 0, C.GoString(call.blendmode), float64(call.alpha))
+	case C.GOMUPDF_DEV_END_GROUP:
+		dev.EndGroup()
+	}
+	return 0
+}
+
+func devicePath(call *C.gomupdf_device_call) []PathItem {
+	items := make([]PathItem, 0, int(call.nitems))
+	for _, it := range unsafe.Slice(call.items, int(call.nitems)) {
+		items = append(items, pathItem(it))
+	}
+	return items
+}
+
+func deviceColor(call *C.gomupdf_device_call) DeviceColor {
+	c := DeviceColor{Alpha: float64(call.alpha)}
+	if call.has_color == 0 {
+		return c
+	}
+	c.Colorspace = C.GoString(call.colorspace)
+	c.Components = make([]float64, int(call.n))
+	for i := range c.Components {
+		c.Components[i] = float64(call.color[i])
+	}
+	c.RGB = Color{float64(call.rgb[0]), float64(call.rgb[1]), float64(call.rgb[2])}
+	return c
+}
+
+func strokeState(s *C.fz_stroke_state) *StrokeState {
+	st := &StrokeState{
+		Width:      float64(s.linewidth),
+		LineCap:    int(s.start_cap),
+		LineJoin:   int(s.linejoin),
+		MiterLimit: float64(s.miterlimit),
+		DashPhase:  float64(s.dash_phase),
+	}
+	if st.LineJoin == C.FZ_LINEJOIN_MITER_XPS {
+		st.LineJoin = LineJoinMiter
+	}
+	for i := 0; i < int(s.dash_len) && i < len(s.dash_list); i++ {
+		st.Dashes = append(st.Dashes, float64(s.dash_list[i]))
+	}
+	return st
+}
+
+func textSpans(ctx *C.fz_context, text *C.fz_text) []TextSpan {
+	var spans []TextSpan
+	for span := text.head; span != nil; span = span.next {
+		name := C.GoString(C.fz_font_name(ctx, span.font))
+		if isSubsetFontName(name) {
+			name = name[7:]
+		}
+		ts := TextSpan{
+			Font:      name,
+			Trm:       matrixFromC(span.trm),
+			WMode:     int(C.gomupdf_text_span_wmode(span)),
+			BidiLevel: int(C.gomupdf_text_span_bidi_level(span)),
+			Glyphs:    make([]Glyph, 0, int(span.len)),
+		}
+		for _, it := range unsafe.Slice(span.items, int(span.len)) {
+			ts.Glyphs = append(ts.Glyphs, Glyph{
+				Origin: NewPoint(float64(it.x), float64(it.y)),
+				GID:    int(it.gid),
+				Rune:   rune(it.ucs),
+			})
+		}
+		spans = append(spans, ts)
+	}
+	return spans
+}
+
+func deviceImage(ctx *C.fz_context, image *C.fz_image) DeviceImage {
+	var info C.gomupdf_device_image
+	C.gomupdf_device_image_info(ctx, image, &info)
+	return DeviceImage{
+		Width:      int(info.width),
+		Height:     int(info.height),
+		BPC:        int(info.bpc),
+		N:          int(info.n),
+		Colorspace: C.GoString(info.colorspace),
+		XRes:       int(info.xres),
+		YRes:       int(info.yres),
+		ImageMask:  info.imagemask != 0,
+	}
+}
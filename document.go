@@ -7,48 +7,76 @@ package gomupdf
 */
 import "C"
 import (
+	"context"
 	"fmt"
+	"runtime"
+	"runtime/cgo"
+	"sync"
 	"unsafe"
 )
 
 // Document represents a document (PDF, XPS, EPUB, etc.).
+//
+// A Document may be shared by multiple goroutines for PageCount, LoadPage
+// and the read-only Page methods GetPixmap, GetText, GetTextWords,
+// GetTextBlocks, GetTextPage and SearchFor. Only the step that reads the
+// page from the document is serialized; rendering and text analysis run on
+// a cloned MuPDF context per call. Methods that modify the document require
+// external synchronization.
+//
+// Close releases the document together with every Page loaded from it;
+// later calls on them return ErrClosed or zero values. Pixmaps and text
+// pages stay valid until they are closed themselves. Objects that become
+// unreachable without being closed are released by a finalizer, see
+// SetLeakHandler.
 type Document struct {
-	ctx      *context
+	mu       sync.Mutex // serializes access to doc through ctx
+	ctx      *fzContext
 	doc      *C.fz_document
 	pdf      *C.pdf_document
 	name     string
 	isClosed bool
+	reader   cgo.Handle // io.ReaderAt backing the document, if opened via OpenReader
+	warnings []string   // messages MuPDF reported while opening
+	// pages counts the live references to each loaded page; MuPDF hands
+	// out the same fz_page when a page is loaded again while open.
+	pages  map[*C.fz_page]int
+	origin origin
 }
 
 // Open opens a document from a file path.
-func Open(filename string) (*Document, error) {
-	ctx, err := newContext()
+func Open(filename string, opts ...OpenOptions) (*Document, error) {
+	ctx, err := newContext(opts...)
 	if err != nil {
 		return nil, err
 	}
+	ctx.logSink().configure(filename, opts)
 	cFilename := C.CString(filename)
 	defer C.free(unsafe.Pointer(cFilename))
 
 	var errcode C.int
 	doc := C.gomupdf_open_document(ctx.ctx, cFilename, &errcode)
 	if errcode != 0 || doc == nil {
+		err := ctx.failed("Open", errcode, fmt.Errorf("%w: %s", ErrOpenFailed, filename))
 		ctx.close()
-		return nil, fmt.Errorf("%w: %s", ErrOpenFailed, filename)
+		return nil, err
 	}
 	d := &Document{ctx: ctx, doc: doc, name: filename}
 	d.pdf = C.gomupdf_pdf_document(ctx.ctx, doc)
+	d.finishOpen()
 	return d, nil
 }
 
 // OpenFromMemory opens a document from a byte slice.
-func OpenFromMemory(data []byte, magic string) (*Document, error) {
+func OpenFromMemory(data []byte, magic string, opts ...OpenOptions) (*Document, error) {
 	if len(data) == 0 {
 		return nil, fmt.Errorf("%w: empty data", ErrOpenFailed)
 	}
-	ctx, err := newContext()
+	ctx, err := newContext(opts...)
 	if err != nil {
 		return nil, err
 	}
+	ctx.logSink().configure(magic, opts)
 	cMagic := C.CString(magic)
 	defer C.free(unsafe.Pointer(cMagic))
 
@@ -56,20 +84,23 @@ func OpenFromMemory(data []byte, magic string) (*Document, error) {
 	doc := C.gomupdf_open_document_from_memory(ctx.ctx, cMagic,
 		(*C.uchar)(unsafe.Pointer(&data[0])), C.int(len(data)), &errcode)
 	if errcode != 0 || doc == nil {
+		err := ctx.failed("OpenFromMemory", errcode, ErrOpenFailed)
 		ctx.close()
-		return nil, ErrOpenFailed
+		return nil, err
 	}
 	d := &Document{ctx: ctx, doc: doc, name: magic}
 	d.pdf = C.gomupdf_pdf_document(ctx.ctx, doc)
+	d.finishOpen()
 	return d, nil
 }
 
 // NewPDF creates a new empty PDF document.
-func NewPDF() (*Document, error) {
-	ctx, err := newContext()
+func NewPDF(opts ...OpenOptions) (*Document, error) {
+	ctx, err := newContext(opts...)
 	if err != nil {
 		return nil, err
 	}
+	ctx.logSink().configure("application/pdf", opts)
 	pdfDoc := C.pdf_create_document(ctx.ctx)
 	if pdfDoc == nil {
 		ctx.close()
@@ -77,14 +108,79 @@ func NewPDF() (*Document, error) {
 	}
 	doc := C.gomupdf_pdf_to_fz_document(pdfDoc)
 	d := &Document{ctx: ctx, doc: doc, pdf: pdfDoc, name: "application/pdf"}
+	d.finishOpen()
 	return d, nil
 }
 
+// finishOpen flushes the warnings MuPDF buffered while opening the
+// document and keeps them for Warnings.
+func (d *Document) finishOpen() {
+	C.gomupdf_flush_warnings(d.ctx.ctx)
+	d.warnings = d.ctx.logSink().stopCollecting()
+	d.pages = make(map[*C.fz_page]int)
+	d.origin = captureOrigin()
+	runtime.SetFinalizer(d, (*Document).finalize)
+}
+
+// ShrinkStore evicts cached resources until the resource store is at most
+// percent of its current size. It reports whether that was achieved.
+func (d *Document) ShrinkStore(percent int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.isClosed {
+		return false
+	}
+	if percent < 0 {
+		percent = 0
+	}
+	return C.gomupdf_shrink_store(d.ctx.ctx, C.uint(percent)) != 0
+}
+
+// MemoryStats returns the memory MuPDF currently uses for the document,
+// including pages, pixmaps and text pages created from it.
+func (d *Document) MemoryStats() MemoryStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.isClosed {
+		return MemoryStats{}
+	}
+	return d.ctx.memoryStats()
+}
+
+// Warnings returns the warnings and errors MuPDF reported while opening
+// the document, such as "repairing PDF document". A non-empty result
+// usually means the input is damaged.
+func (d *Document) Warnings() []string {
+	return append([]string(nil), d.warnings...)
+}
+
+// Close releases the document and all pages loaded from it.
 func (d *Document) Close() {
+	d.release()
+	runtime.SetFinalizer(d, nil)
+}
+
+func (d *Document) finalize() {
+	if d.release() {
+		d.origin.reportLeak("Document")
+	}
+}
+
+// release frees the MuPDF resources of the document and its live pages.
+// It reports whether the document was still open.
+func (d *Document) release() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
-		return
+		return false
 	}
 	d.isClosed = true
+	for page, n := range d.pages {
+		for ; n > 0; n-- {
+			C.gomupdf_drop_page(d.ctx.ctx, page)
+		}
+	}
+	d.pages = nil
 	if d.doc != nil {
 		C.gomupdf_drop_document(d.ctx.ctx, d.doc)
 		d.doc = nil
@@ -94,13 +190,34 @@ func (d *Document) Close() {
 		d.ctx.close()
 		d.ctx = nil
 	}
+	if d.reader != 0 {
+		d.reader.Delete()
+		d.reader = 0
+	}
+	return true
+}
+
+func (d *Document) IsClosed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.isClosed
 }
 
-func (d *Document) IsClosed() bool { return d.isClosed }
-func (d *Document) Name() string   { return d.name }
-func (d *Document) IsPDF() bool    { return d.pdf != nil }
+func (d *Document) Name() string { return d.name }
+
+func (d *Document) IsPDF() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pdf != nil
+}
 
 func (d *Document) PageCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pageCount()
+}
+
+func (d *Document) pageCount() int {
 	if d.isClosed {
 		return 0
 	}
@@ -108,6 +225,8 @@ func (d *Document) PageCount() int {
 }
 
 func (d *Document) NeedsPass() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
 		return false
 	}
@@ -115,6 +234,8 @@ func (d *Document) NeedsPass() bool {
 }
 
 func (d *Document) Authenticate(password string) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
 		return 0, ErrClosed
 	}
@@ -128,6 +249,12 @@ func (d *Document) Authenticate(password string) (int, error) {
 }
 
 func (d *Document) IsReflowable() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.isReflowable()
+}
+
+func (d *Document) isReflowable() bool {
 	if d.isClosed {
 		return false
 	}
@@ -135,17 +262,21 @@ func (d *Document) IsReflowable() bool {
 }
 
 func (d *Document) Layout(width, height, fontsize float64) {
-	if d.isClosed || !d.IsReflowable() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.isReflowable() {
 		return
 	}
 	C.gomupdf_layout_document(d.ctx.ctx, d.doc, C.float(width), C.float(height), C.float(fontsize))
 }
 
 func (d *Document) LoadPage(pageNum int) (*Page, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
 		return nil, ErrClosed
 	}
-	count := d.PageCount()
+	count := d.pageCount()
 	if pageNum < 0 {
 		pageNum += count
 	}
@@ -155,13 +286,16 @@ func (d *Document) LoadPage(pageNum int) (*Page, error) {
 	var errcode C.int
 	page := C.gomupdf_load_page(d.ctx.ctx, d.doc, C.int(pageNum), &errcode)
 	if errcode != 0 || page == nil {
-		return nil, fmt.Errorf("%w: page %d", ErrPageNotFound, pageNum)
+		return nil, d.ctx.failed("Document.LoadPage", errcode, fmt.Errorf("%w: page %d", ErrPageNotFound, pageNum))
 	}
-	return &Page{ctx: d.ctx, page: page, doc: d, number: pageNum}, nil
+	d.pages[page]++
+	p := &Page{ctx: d.ctx, page: page, doc: d, number: pageNum, origin: captureOrigin()}
+	runtime.SetFinalizer(p, (*Page).finalize)
+	return p, nil
 }
 
 func (d *Document) Pages(args ...int) ([]*Page, error) {
-	if d.isClosed {
+	if d.IsClosed() {
 		return nil, ErrClosed
 	}
 	count := d.PageCount()
@@ -199,6 +333,8 @@ func (d *Document) Pages(args ...int) ([]*Page, error) {
 }
 
 func (d *Document) Metadata() map[string]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
 		return nil
 	}
@@ -237,13 +373,15 @@ func (d *Document) lookupMetadata(key string) string {
 }
 
 func (d *Document) GetTOC(simple bool) ([]TOCItem, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
 		return nil, ErrClosed
 	}
 	var errcode C.int
 	outline := C.gomupdf_load_outline(d.ctx.ctx, d.doc, &errcode)
 	if errcode != 0 {
-		return nil, ErrOutline
+		return nil, d.ctx.failed("Document.GetTOC", errcode, ErrOutline)
 	}
 	if outline == nil {
 		return nil, nil
@@ -277,13 +415,25 @@ func (d *Document) walkOutline(outline *C.fz_outline, level int, items *[]TOCIte
 
 // Convenience methods that delegate to Page.
 
-func (d *Document) GetPageText(pno int, output string) (string, error) {
+// GetPageText returns the text of page pno in any output format accepted
+// by Page.GetText.
+func (d *Document) GetPageText(pno int, output string, flags ...int) (string, error) {
+	page, err := d.LoadPage(pno)
+	if err != nil {
+		return "", err
+	}
+	defer page.Close()
+	return page.GetText(output, flags...)
+}
+
+// GetPageTextWithOptions is like GetPageText but takes TextOptions.
+func (d *Document) GetPageTextWithOptions(pno int, output string, opt TextOptions) (string, error) {
 	page, err := d.LoadPage(pno)
 	if err != nil {
 		return "", err
 	}
 	defer page.Close()
-	return page.GetText(output)
+	return page.GetTextWithOptions(output, opt)
 }
 
 func (d *Document) GetPagePixmap(pno int, opts ...PixmapOption) (*Pixmap, error) {
@@ -329,14 +479,31 @@ func (d *Document) GetPageImages(pno int) ([]ImageInfo, error) {
 }
 
 func (d *Document) ConvertToPDF(fromPage, toPage, rotate int) ([]byte, error) {
+	return d.ConvertToPDFCtx(context.Background(), fromPage, toPage, rotate)
+}
+
+// ConvertToPDFCtx is like ConvertToPDF but stops converting when ctx is
+// cancelled or its deadline passes, in which case it returns ctx.Err().
+func (d *Document) ConvertToPDFCtx(ctx context.Context, fromPage, toPage, rotate int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
 		return nil, ErrClosed
 	}
+	ck := newCookie(ctx)
+	defer ck.close()
 	var outlen, errcode C.int
 	data := C.gomupdf_convert_to_pdf(d.ctx.ctx, d.doc,
-		C.int(fromPage), C.int(toPage), C.int(rotate), &outlen, &errcode)
+		C.int(fromPage), C.int(toPage), C.int(rotate), ck.ptr(), &outlen, &errcode)
+	if err := ctx.Err(); err != nil {
+		d.ctx.freeBytes(data)
+		return nil, err
+	}
 	if errcode != 0 || data == nil {
-		return nil, ErrConvert
+		return nil, d.ctx.failed("Document.ConvertToPDF", errcode, ErrConvert)
 	}
 	defer d.ctx.freeBytes(data)
 	return C.GoBytes(unsafe.Pointer(data), outlen), nil
@@ -12,10 +12,12 @@ import (
 )
 
 func (d *Document) Save(filename string, opts ...SaveOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
 		return ErrClosed
 	}
-	if !d.IsPDF() {
+	if d.pdf == nil {
 		return ErrNotPDF
 	}
 	opt := DefaultSaveOptions()
@@ -43,7 +45,7 @@ func (d *Document) Save(filename string, opts ...SaveOptions) error {
 		C.int(boolToInt(opt.Incremental)), C.int(boolToInt(opt.Pretty)),
 		C.int(opt.Encryption), cOwnerPW, cUserPW, C.int(opt.Permissions))
 	if errcode != 0 {
-		return fmt.Errorf("%w: %s", ErrSave, filename)
+		return d.ctx.failed("Document.Save", errcode, fmt.Errorf("%w: %s", ErrSave, filename))
 	}
 	return nil
 }
@@ -53,10 +55,12 @@ func (d *Document) EzSave(filename string) error {
 }
 
 func (d *Document) ToBytes(opts ...SaveOptions) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
 		return nil, ErrClosed
 	}
-	if !d.IsPDF() {
+	if d.pdf == nil {
 		return nil, ErrNotPDF
 	}
 	opt := DefaultSaveOptions()
@@ -71,18 +75,30 @@ func (d *Document) ToBytes(opts ...SaveOptions) ([]byte, error) {
 		C.int(boolToInt(opt.Clean)), C.int(boolToInt(opt.ASCII)),
 		C.int(boolToInt(opt.Pretty)), &outlen, &errcode)
 	if errcode != 0 || data == nil {
-		return nil, ErrSave
+		return nil, d.ctx.failed("Document.ToBytes", errcode, ErrSave)
 	}
 	defer d.ctx.freeBytes(data)
 	return C.GoBytes(unsafe.Pointer(data), outlen), nil
 }
 
 func (d *Document) NewPage(pno int, width, height float64) (*Page, error) {
+	pno, err := d.insertPage(pno, width, height)
+	if err != nil {
+		return nil, err
+	}
+	return d.LoadPage(pno)
+}
+
+// insertPage inserts an empty page before pno, or at the end if pno is
+// negative, and returns its number.
+func (d *Document) insertPage(pno int, width, height float64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
-		return nil, ErrClosed
+		return 0, ErrClosed
 	}
-	if !d.IsPDF() {
-		return nil, ErrNotPDF
+	if d.pdf == nil {
+		return 0, ErrNotPDF
 	}
 	if width <= 0 {
 		width = 595
@@ -91,23 +107,25 @@ func (d *Document) NewPage(pno int, width, height float64) (*Page, error) {
 		height = 842
 	}
 	if pno < 0 {
-		pno = d.PageCount()
+		pno = d.pageCount()
 	}
 	errcode := C.gomupdf_insert_page(d.ctx.ctx, d.pdf, C.int(pno), C.float(width), C.float(height))
 	if errcode != 0 {
-		return nil, fmt.Errorf("%w: insert page at %d", ErrSave, pno)
+		return 0, d.ctx.failed("Document.NewPage", errcode, fmt.Errorf("%w: insert page at %d", ErrSave, pno))
 	}
-	return d.LoadPage(pno)
+	return pno, nil
 }
 
 func (d *Document) DeletePage(pno int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
 		return ErrClosed
 	}
-	if !d.IsPDF() {
+	if d.pdf == nil {
 		return ErrNotPDF
 	}
-	count := d.PageCount()
+	count := d.pageCount()
 	if pno < 0 {
 		pno += count
 	}
@@ -116,13 +134,13 @@ func (d *Document) DeletePage(pno int) error {
 	}
 	errcode := C.gomupdf_delete_page(d.ctx.ctx, d.pdf, C.int(pno))
 	if errcode != 0 {
-		return fmt.Errorf("%w: delete page %d", ErrSave, pno)
+		return d.ctx.failed("Document.DeletePage", errcode, fmt.Errorf("%w: delete page %d", ErrSave, pno))
 	}
 	return nil
 }
 
 func (d *Document) DeletePages(pages ...int) error {
-	if d.isClosed {
+	if d.IsClosed() {
 		return ErrClosed
 	}
 	if !d.IsPDF() {
@@ -146,16 +164,18 @@ func (d *Document) DeletePages(pages ...int) error {
 }
 
 func (d *Document) Select(pages []int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
 		return ErrClosed
 	}
-	if !d.IsPDF() {
+	if d.pdf == nil {
 		return ErrNotPDF
 	}
 	if len(pages) == 0 {
 		return ErrInvalidArg
 	}
-	count := d.PageCount()
+	count := d.pageCount()
 	for _, p := range pages {
 		if p < 0 || p >= count {
 			return fmt.Errorf("%w: page %d out of range", ErrInvalidArg, p)
@@ -170,17 +190,21 @@ func (d *Document) Select(pages []int) error {
 }
 
 func (d *Document) XrefLength() int {
-	if d.isClosed || !d.IsPDF() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.isClosed || d.pdf == nil {
 		return 0
 	}
 	return int(C.gomupdf_xref_len(d.ctx.ctx, d.pdf))
 }
 
 func (d *Document) XrefObject(xref int, compressed bool) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
 		return "", ErrClosed
 	}
-	if !d.IsPDF() {
+	if d.pdf == nil {
 		return "", ErrNotPDF
 	}
 	comp := 0
@@ -190,24 +214,28 @@ func (d *Document) XrefObject(xref int, compressed bool) (string, error) {
 	var errcode C.int
 	result := C.gomupdf_xref_object_str(d.ctx.ctx, d.pdf, C.int(xref), C.int(comp), &errcode)
 	if errcode != 0 || result == nil {
-		return "", fmt.Errorf("%w: xref %d", ErrXref, xref)
+		return "", d.ctx.failed("Document.XrefObject", errcode, fmt.Errorf("%w: xref %d", ErrXref, xref))
 	}
 	defer d.ctx.freeString(result)
 	return C.GoString(result), nil
 }
 
 func (d *Document) PDFCatalog() int {
-	if d.isClosed || !d.IsPDF() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.isClosed || d.pdf == nil {
 		return 0
 	}
 	return int(C.gomupdf_pdf_catalog_xref(d.ctx.ctx, d.pdf))
 }
 
 func (d *Document) SetMetadata(meta map[string]string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.isClosed {
 		return ErrClosed
 	}
-	if !d.IsPDF() {
+	if d.pdf == nil {
 		return ErrNotPDF
 	}
 	keyMap := map[string]string{
@@ -235,17 +263,29 @@ func (d *Document) SetMetadata(meta map[string]string) error {
 }
 
 func (d *Document) InsertPDF(src *Document, opts ...InsertPDFOptions) error {
+	// Lock both documents, in a fixed order so that two insertions in
+	// opposite directions cannot deadlock.
+	first, second := d, src
+	if uintptr(unsafe.Pointer(second)) < uintptr(unsafe.Pointer(first)) {
+		first, second = second, first
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	if second != first {
+		second.mu.Lock()
+		defer second.mu.Unlock()
+	}
 	if d.isClosed || src.isClosed {
 		return ErrClosed
 	}
-	if !d.IsPDF() || !src.IsPDF() {
+	if d.pdf == nil || src.pdf == nil {
 		return ErrNotPDF
 	}
 	opt := InsertPDFOptions{FromPage: -1, ToPage: -1, StartAt: -1, Rotate: -1, Links: true, Annots: true}
 	if len(opts) > 0 {
 		opt = opts[0]
 	}
-	srcCount := src.PageCount()
+	srcCount := src.pageCount()
 	if opt.FromPage < 0 {
 		opt.FromPage = 0
 	}
@@ -253,7 +293,7 @@ func (d *Document) InsertPDF(src *Document, opts ...InsertPDFOptions) error {
 		opt.ToPage = srcCount - 1
 	}
 	if opt.StartAt < 0 {
-		opt.StartAt = d.PageCount()
+		opt.StartAt = d.pageCount()
 	}
 
 	graftMap := C.pdf_new_graft_map(d.ctx.ctx, d.pdf)
@@ -263,14 +303,16 @@ func (d *Document) InsertPDF(src *Document, opts ...InsertPDFOptions) error {
 		pageTo := opt.StartAt + i - opt.FromPage
 		errcode := C.gomupdf_graft_page(d.ctx.ctx, d.pdf, src.pdf, graftMap, C.int(pageTo), C.int(i))
 		if errcode != 0 {
-			return fmt.Errorf("%w: graft page %d", ErrSave, i)
+			return d.ctx.failed("Document.InsertPDF", errcode, fmt.Errorf("%w: graft page %d", ErrSave, i))
 		}
 	}
 	return nil
 }
 
 func (d *Document) CanSaveIncrementally() bool {
-	if d.isClosed || !d.IsPDF() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.isClosed || d.pdf == nil {
 		return false
 	}
 	return C.gomupdf_can_save_incrementally(d.ctx.ctx, d.pdf) != 0
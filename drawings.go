@@ -0,0 +1,78 @@
+//go:build cgo && !nomupdf
+
+package gomupdf
+
+/*
+#include "gomupdf.h"
+*/
+import "C"
+import "unsafe"
+
+// GetDrawings returns the vector paths filled or stroked on the page, in
+// drawing order, including those inside Form XObjects and annotation
+// appearances. A path that is filled and then stroked by one operator,
+// such as B in PDF, is reported once with both colors set. Text, images,
+// shadings and clipping paths are not reported.
+func (p *Page) GetDrawings() ([]Drawing, error) {
+	p.doc.mu.Lock()
+	defer p.doc.mu.Unlock()
+	if p.closed() {
+		return nil, ErrClosed
+	}
+	var count, nitems, errcode C.int
+	var cItems *C.gomupdf_path_item
+	cDrawings := C.gomupdf_page_drawings(p.ctx.ctx, p.page, &count, &cItems, &nitems, &errcode)
+	if errcode != 0 {
+		return nil, p.ctx.failed("Page.GetDrawings", errcode, ErrDevice)
+	}
+	defer C.gomupdf_free(p.ctx.ctx, unsafe.Pointer(cDrawings))
+	defer C.gomupdf_free(p.ctx.ctx, unsafe.Pointer(cItems))
+	items := unsafe.Slice(cItems, int(nitems))
+	drawings := make([]Drawing, 0, int(count))
+	for _, d := range unsafe.Slice(cDrawings, int(count)) {
+		dr := Drawing{
+			Items:     make([]PathItem, 0, int(d.item_count)),
+			Rect:      rectFromC(d.rect),
+			Width:     float64(d.width),
+			DashPhase: float64(d.dash_phase),
+			LineCap:   int(d.cap),
+			LineJoin:  int(d.join),
+			EvenOdd:   d.even_odd != 0,
+			ClosePath: d.close_path != 0,
+		}
+		if d.stroke != 0 {
+			dr.Color = &Color{float64(d.color[0]), float64(d.color[1]), float64(d.color[2])}
+			dr.StrokeOpacity = float64(d.stroke_alpha)
+		}
+		if d.fill != 0 {
+			dr.Fill = &Color{float64(d.fill_color[0]), float64(d.fill_color[1]), float64(d.fill_color[2])}
+			dr.FillOpacity = float64(d.fill_alpha)
+		}
+		for i := 0; i < int(d.dash_count); i++ {
+			dr.Dashes = append(dr.Dashes, float64(d.dashes[i]))
+		}
+		for _, it := range items[d.item_start : d.item_start+d.item_count] {
+			dr.Items = append(dr.Items, pathItem(it))
+		}
+		drawings = append(drawings, dr)
+	}
+	return drawings, nil
+}
+
+func pathItem(it C.gomupdf_path_item) PathItem {
+	pt := func(i int) Point { return NewPoint(float64(it.p[2*i]), float64(it.p[2*i+1])) }
+	item := PathItem{Kind: PathItemKind(it.kind)}
+	switch item.Kind {
+	case PathMove:
+		item.Points = []Point{pt(0)}
+	case PathLine:
+		item.Points = []Point{pt(0), pt(1)}
+	case PathCurve:
+		item.Points = []Point{pt(0), pt(1), pt(2), pt(3)}
+	case PathRect:
+		item.Rect = Quad{UL: pt(0), UR: pt(1), LL: pt(2), LR: pt(3)}.Rect()
+	case PathQuad:
+		item.Quad = NewQuad(pt(0), pt(1), pt(2), pt(3))
+	}
+	return item
+}
@@ -55,7 +55,7 @@ static unsigned char* gomupdf_embfile_get(fz_context *ctx, pdf_document *pdf,
         fz_drop_buffer(ctx, buf);
         *errcode = 0;
     }
-    fz_catch(ctx) { *errcode = 1; data = NULL; *outlen = 0; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); data = NULL; *outlen = 0; }
     return data;
 }
 */
@@ -63,17 +63,21 @@ import "C"
 import "unsafe"
 
 func (d *Document) EmbFileCount() int {
-	if d.isClosed || !d.IsPDF() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.isClosed || d.pdf == nil {
 		return 0
 	}
 	return int(C.gomupdf_embfile_count(d.ctx.ctx, d.pdf))
 }
 
 func (d *Document) EmbFileNames() []string {
-	if d.isClosed || !d.IsPDF() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.isClosed || d.pdf == nil {
 		return nil
 	}
-	count := d.EmbFileCount()
+	count := int(C.gomupdf_embfile_count(d.ctx.ctx, d.pdf))
 	names := make([]string, 0, count)
 	for i := 0; i < count; i++ {
 		name := C.gomupdf_embfile_name(d.ctx.ctx, d.pdf, C.int(i))
@@ -85,13 +89,15 @@ func (d *Document) EmbFileNames() []string {
 }
 
 func (d *Document) EmbFileGet(index int) ([]byte, error) {
-	if d.isClosed || !d.IsPDF() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.isClosed || d.pdf == nil {
 		return nil, ErrNotPDF
 	}
 	var outlen, errcode C.int
 	data := C.gomupdf_embfile_get(d.ctx.ctx, d.pdf, C.int(index), &outlen, &errcode)
 	if errcode != 0 || data == nil {
-		return nil, ErrEmbeddedFile
+		return nil, d.ctx.failed("Document.EmbFileGet", errcode, ErrEmbeddedFile)
 	}
 	defer d.ctx.freeBytes(data)
 	return C.GoBytes(unsafe.Pointer(data), outlen), nil
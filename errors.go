@@ -21,8 +21,9 @@ var (
 	// ErrAuthFailed is returned when password authentication fails.
 	ErrAuthFailed = errors.New("gomupdf: authentication failed")
 
-	// ErrClosed is returned when operating on a closed document.
-	ErrClosed = errors.New("gomupdf: document is closed")
+	// ErrClosed is returned when operating on a closed document, page,
+	// pixmap or text page, or on a page whose document was closed.
+	ErrClosed = errors.New("gomupdf: use of closed object")
 
 	// ErrTextExtract is returned when text extraction fails.
 	ErrTextExtract = errors.New("gomupdf: text extraction failed")
@@ -53,4 +54,71 @@ var (
 
 	// ErrOverflow is returned when content does not fit in the target rectangle.
 	ErrOverflow = errors.New("gomupdf: content overflow, does not fit in rectangle")
+
+	// ErrFont is returned when font operations fail.
+	ErrFont = errors.New("gomupdf: font operation failed")
+
+	// ErrDevice is returned when running a page through a device fails.
+	ErrDevice = errors.New("gomupdf: device operation failed")
+
+	// ErrMemoryLimit is returned when an operation fails because
+	// OpenOptions.MemoryLimit was reached.
+	ErrMemoryLimit = errors.New("gomupdf: memory limit exceeded")
 )
+
+// MuPDF error codes reported in MuPDFError.Code.
+// They correspond to MuPDF's FZ_ERROR_* values.
+const (
+	ErrorCodeNone        = 0
+	ErrorCodeGeneric     = 1
+	ErrorCodeSystem      = 2  // out of memory or failed system call
+	ErrorCodeLibrary     = 3  // error from a third-party library
+	ErrorCodeArgument    = 4  // invalid or out-of-range argument
+	ErrorCodeLimit       = 5  // resource or other hard limit reached
+	ErrorCodeUnsupported = 6  // unsupported feature
+	ErrorCodeFormat      = 7  // unrecoverable syntax or format error
+	ErrorCodeSyntax      = 8  // recoverable syntax error
+	ErrorCodeTryLater    = 9  // progressive loading needs more data
+	ErrorCodeAbort       = 10 // operation aborted
+	ErrorCodeRepaired    = 11 // document was repaired
+)
+
+var errorCodeNames = [...]string{
+	ErrorCodeNone:        "none",
+	ErrorCodeGeneric:     "generic error",
+	ErrorCodeSystem:      "system error",
+	ErrorCodeLibrary:     "library error",
+	ErrorCodeArgument:    "invalid argument",
+	ErrorCodeLimit:       "limit exceeded",
+	ErrorCodeUnsupported: "unsupported feature",
+	ErrorCodeFormat:      "format error",
+	ErrorCodeSyntax:      "syntax error",
+	ErrorCodeTryLater:    "try later",
+	ErrorCodeAbort:       "aborted",
+	ErrorCodeRepaired:    "repaired",
+}
+
+// MuPDFError describes an exception raised by MuPDF.
+// It unwraps to one of the sentinel errors above, so
+// errors.Is(err, ErrPixmap) keeps working, while errors.As gives access
+// to MuPDF's error code and message.
+type MuPDFError struct {
+	Op      string // Go operation that failed, e.g. "Page.GetPixmap"
+	Code    int    // MuPDF error code (ErrorCode*)
+	Message string // message caught from MuPDF
+	Err     error  // sentinel error for the operation
+}
+
+func (e *MuPDFError) Error() string {
+	code := "unknown error"
+	if e.Code >= 0 && e.Code < len(errorCodeNames) {
+		code = errorCodeNames[e.Code]
+	}
+	msg := e.Err.Error() + ": " + e.Op + ": " + code
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *MuPDFError) Unwrap() error { return e.Err }
@@ -0,0 +1,32 @@
+//go:build cgo && !nomupdf
+
+package gomupdf
+
+// FindTables detects the tables on the page. Tables with ruling lines
+// are found from the vector drawings; the remaining text is then checked
+// for words aligned in columns, as in tables drawn without lines. Tables
+// are returned top to bottom.
+func (p *Page) FindTables(opts ...TableOptions) ([]*Table, error) {
+	opt := DefaultTableOptions()
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	words, err := p.GetTextWords()
+	if err != nil {
+		return nil, err
+	}
+	return p.wordTables(words, opt)
+}
+
+// wordTables finds the tables of the page made of words, which were
+// extracted from its text already.
+func (p *Page) wordTables(words []TextWord, opt TableOptions) ([]*Table, error) {
+	var drawings []Drawing
+	if opt.Strategy != TableStrategyText {
+		var err error
+		if drawings, err = p.GetDrawings(); err != nil {
+			return nil, err
+		}
+	}
+	return findTables(drawings, words, opt), nil
+}
@@ -0,0 +1,101 @@
+//go:build cgo && !nomupdf
+
+package gomupdf
+
+/*
+#include "gomupdf.h"
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// GetFonts lists the fonts the page uses, including those of Form
+// XObjects drawn on it. Each font dictionary is reported once. PDF only.
+func (p *Page) GetFonts() ([]FontInfo, error) {
+	p.doc.mu.Lock()
+	defer p.doc.mu.Unlock()
+	if p.closed() {
+		return nil, ErrClosed
+	}
+	if p.doc.pdf == nil {
+		return nil, ErrNotPDF
+	}
+	pdfPage := C.pdf_page_from_fz_page(p.ctx.ctx, p.page)
+	if pdfPage == nil {
+		return nil, ErrNotPDF
+	}
+	var count, errcode C.int
+	res := C.gomupdf_page_resources(p.ctx.ctx, pdfPage, C.GOMUPDF_RES_FONT, &count, &errcode)
+	if errcode != 0 {
+		return nil, p.ctx.failed("Page.GetFonts", errcode, ErrFont)
+	}
+	defer C.gomupdf_free(p.ctx.ctx, unsafe.Pointer(res))
+
+	fonts := make([]FontInfo, 0, int(count))
+	for _, r := range unsafe.Slice(res, int(count)) {
+		var info C.gomupdf_font_info
+		C.gomupdf_font_get_info(p.ctx.ctx, r.obj, &info, &errcode)
+		if errcode != 0 {
+			return nil, p.ctx.failed("Page.GetFonts", errcode, ErrFont)
+		}
+		f := FontInfo{
+			Xref:       int(r.xref),
+			Ext:        C.GoString(info.ext),
+			Type:       C.GoString(info._type),
+			BaseName:   C.GoString(info.basename),
+			Name:       C.GoString(r.name),
+			Encoding:   C.GoString(info.encoding),
+			Referencer: int(r.referencer),
+		}
+		f.Embedded = f.Ext != "n/a"
+		f.Subset = isSubsetFontName(f.BaseName)
+		fonts = append(fonts, f)
+	}
+	return fonts, nil
+}
+
+// isSubsetFontName reports whether name starts with a subset tag: six
+// uppercase letters followed by "+".
+func isSubsetFontName(name string) bool {
+	if len(name) < 8 || name[6] != '+' {
+		return false
+	}
+	for i := 0; i < 6; i++ {
+		if name[i] < 'A' || name[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// ExtractFont returns the font program embedded for the font dictionary
+// xref, as reported in FontInfo.Xref, together with its file extension:
+// "ttf", "cff", "otf" or "pfa". The data is decoded, so it can be written
+// to a file as is. A font that is not embedded yields an error wrapping
+// ErrFont.
+func (d *Document) ExtractFont(xref int) ([]byte, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.isClosed {
+		return nil, "", ErrClosed
+	}
+	if d.pdf == nil {
+		return nil, "", ErrNotPDF
+	}
+	if xref <= 0 || xref >= int(C.gomupdf_xref_len(d.ctx.ctx, d.pdf)) {
+		return nil, "", fmt.Errorf("%w: xref %d", ErrInvalidArg, xref)
+	}
+	var ext *C.char
+	var outlen, errcode C.int
+	data := C.gomupdf_extract_font(d.ctx.ctx, d.pdf, C.int(xref), &ext, &outlen, &errcode)
+	if errcode != 0 {
+		return nil, "", d.ctx.failed("Document.ExtractFont", errcode, fmt.Errorf("%w: xref %d", ErrFont, xref))
+	}
+	if data == nil {
+		return nil, "", fmt.Errorf("%w: font %d is not embedded", ErrFont, xref)
+	}
+	defer d.ctx.freeBytes(data)
+	return C.GoBytes(unsafe.Pointer(data), outlen), C.GoString(ext), nil
+}
@@ -3,7 +3,9 @@
 package gomupdf
 
 import (
+	"errors"
 	"math"
+	"strings"
 	"testing"
 )
 
@@ -834,6 +836,7 @@ func TestErrors(t *testing.T) {
 		ErrEncrypted, ErrAuthFailed, ErrClosed, ErrTextExtract,
 		ErrPixmap, ErrSave, ErrInvalidArg, ErrOutline,
 		ErrSearch, ErrConvert, ErrEmbeddedFile, ErrXref,
+		ErrFont, ErrDevice,
 	}
 	for _, e := range errs {
 		if e == nil {
@@ -844,3 +847,65 @@ func TestErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestMuPDFError(t *testing.T) {
+	var err error = &MuPDFError{
+		Op:      "Page.InsertImage",
+		Code:    ErrorCodeFormat,
+		Message: "cannot recognize image",
+		Err:     ErrPixmap,
+	}
+	if !errors.Is(err, ErrPixmap) {
+		t.Error("MuPDFError should unwrap to its sentinel")
+	}
+	if errors.Is(err, ErrSave) {
+		t.Error("MuPDFError should not match an unrelated sentinel")
+	}
+	var me *MuPDFError
+	if !errors.As(err, &me) || me.Code != ErrorCodeFormat {
+		t.Fatalf("errors.As failed: %v", err)
+	}
+	msg := err.Error()
+	for _, want := range []string{"Page.InsertImage", "format error", "cannot recognize image"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Error() = %q, missing %q", msg, want)
+		}
+	}
+}
+
+// --- Log tests ---
+
+func TestLogSinkCollect(t *testing.T) {
+	var got []LogMessage
+	s := &logSink{}
+	s.configure("a.pdf", []OpenOptions{{LogFunc: func(m LogMessage) { got = append(got, m) }}})
+	s.log(LogWarning, "repairing PDF document")
+	collected := s.stopCollecting()
+	s.log(LogError, "later error")
+
+	if len(collected) != 1 || collected[0] != "repairing PDF document" {
+		t.Errorf("collected = %v", collected)
+	}
+	if len(got) != 2 {
+		t.Fatalf("LogFunc called %d times, want 2", len(got))
+	}
+	if got[0].Document != "a.pdf" || got[0].Level != LogWarning {
+		t.Errorf("got[0] = %+v", got[0])
+	}
+	if got[1].Level != LogError {
+		t.Errorf("got[1] = %+v", got[1])
+	}
+}
+
+func TestLogSinkPackageDefault(t *testing.T) {
+	var got []LogMessage
+	SetLogFunc(func(m LogMessage) { got = append(got, m) })
+	defer SetLogger(nil)
+
+	s := &logSink{}
+	s.configure("b.pdf", []OpenOptions{{Name: "custom"}})
+	s.log(LogWarning, "unknown font")
+	if len(got) != 1 || got[0].Document != "custom" {
+		t.Errorf("got = %+v", got)
+	}
+}
@@ -9,6 +9,11 @@
 #include <stdlib.h>
 #include <string.h>
 #include <stdio.h>
+#ifdef _WIN32
+#include <windows.h>
+#else
+#include <pthread.h>
+#endif
 
 // ============================================================
 // System font loading (for Story/HTML CJK support)
@@ -73,23 +78,325 @@ static fz_font* gomupdf_load_system_fallback_font(fz_context *ctx,
 // Context management
 // ============================================================
 
-static fz_context* gomupdf_new_context(void) {
-    fz_context *ctx = fz_new_context(NULL, NULL, FZ_STORE_DEFAULT);
-    if (ctx) {
-        fz_install_load_system_font_funcs(ctx,
-            gomupdf_load_system_font,
-            gomupdf_load_system_cjk_font,
-            gomupdf_load_system_fallback_font);
+/* Mutexes handed to MuPDF through fz_locks_context. One set is shared by a
+   base context and all of its clones, which is what allows fz_clone_context
+   to be used for per-goroutine contexts. */
+typedef struct {
+#ifdef _WIN32
+    CRITICAL_SECTION mutex[FZ_LOCK_MAX];
+#else
+    pthread_mutex_t mutex[FZ_LOCK_MAX];
+#endif
+} gomupdf_locks;
+
+static void gomupdf_lock(void *user, int lock) {
+    gomupdf_locks *locks = (gomupdf_locks *)user;
+#ifdef _WIN32
+    EnterCriticalSection(&locks->mutex[lock]);
+#else
+    pthread_mutex_lock(&locks->mutex[lock]);
+#endif
+}
+
+static void gomupdf_unlock(void *user, int lock) {
+    gomupdf_locks *locks = (gomupdf_locks *)user;
+#ifdef _WIN32
+    LeaveCriticalSection(&locks->mutex[lock]);
+#else
+    pthread_mutex_unlock(&locks->mutex[lock]);
+#endif
+}
+
+static gomupdf_locks* gomupdf_new_locks(void) {
+    gomupdf_locks *locks = (gomupdf_locks *)malloc(sizeof(gomupdf_locks));
+    int i;
+    if (!locks) return NULL;
+    for (i = 0; i < FZ_LOCK_MAX; i++) {
+#ifdef _WIN32
+        InitializeCriticalSection(&locks->mutex[i]);
+#else
+        pthread_mutex_init(&locks->mutex[i], NULL);
+#endif
     }
+    return locks;
+}
+
+/* Must only be called once every context using the locks has been dropped. */
+static void gomupdf_drop_locks(gomupdf_locks *locks) {
+    int i;
+    if (!locks) return;
+    for (i = 0; i < FZ_LOCK_MAX; i++) {
+#ifdef _WIN32
+        DeleteCriticalSection(&locks->mutex[i]);
+#else
+        pthread_mutex_destroy(&locks->mutex[i]);
+#endif
+    }
+    free(locks);
+}
+
+/* Counting allocator handed to MuPDF through fz_alloc_context. Every block
+   is prefixed with a header recording its size, so usage can be tracked and
+   capped. It is shared by a base context and all of its clones. */
+typedef struct {
+    size_t limit;    /* 0 means unlimited */
+    size_t used;
+    size_t peak;
+    size_t refused;  /* allocations refused because of the limit */
+} gomupdf_alloc_state;
+
+/* Allocator user data of a single context: the shared state, and whether
+   the context's last allocation was refused because of the limit. The flag
+   tells gomupdf_caught that an out-of-memory error was caused by the limit
+   during the call that raised it. */
+typedef struct {
+    gomupdf_alloc_state *shared;
+    int refused;
+} gomupdf_ctx_alloc;
+
+#define GOMUPDF_ALLOC_HEADER 16
+
+static void* gomupdf_counting_malloc(void *user, size_t size) {
+    gomupdf_ctx_alloc *ca = (gomupdf_ctx_alloc *)user;
+    gomupdf_alloc_state *st = ca->shared;
+    size_t used = __atomic_add_fetch(&st->used, size, __ATOMIC_RELAXED);
+    size_t peak;
+    unsigned char *p;
+    if (st->limit && used > st->limit) {
+        __atomic_sub_fetch(&st->used, size, __ATOMIC_RELAXED);
+        __atomic_add_fetch(&st->refused, 1, __ATOMIC_RELAXED);
+        __atomic_store_n(&ca->refused, 1, __ATOMIC_RELAXED);
+        return NULL;
+    }
+    __atomic_store_n(&ca->refused, 0, __ATOMIC_RELAXED);
+    p = (unsigned char *)malloc(size + GOMUPDF_ALLOC_HEADER);
+    if (!p) {
+        __atomic_sub_fetch(&st->used, size, __ATOMIC_RELAXED);
+        return NULL;
+    }
+    *(size_t *)p = size;
+    peak = __atomic_load_n(&st->peak, __ATOMIC_RELAXED);
+    while (used > peak && !__atomic_compare_exchange_n(&st->peak, &peak, used, 1,
+            __ATOMIC_RELAXED, __ATOMIC_RELAXED))
+        ;
+    return p + GOMUPDF_ALLOC_HEADER;
+}
+
+static void gomupdf_counting_free(void *user, void *ptr) {
+    gomupdf_alloc_state *st = ((gomupdf_ctx_alloc *)user)->shared;
+    unsigned char *p;
+    if (!ptr) return;
+    p = (unsigned char *)ptr - GOMUPDF_ALLOC_HEADER;
+    __atomic_sub_fetch(&st->used, *(size_t *)p, __ATOMIC_RELAXED);
+    free(p);
+}
+
+static void* gomupdf_counting_realloc(void *user, void *ptr, size_t size) {
+    gomupdf_ctx_alloc *ca = (gomupdf_ctx_alloc *)user;
+    gomupdf_alloc_state *st = ca->shared;
+    unsigned char *p, *np;
+    size_t old, used;
+    if (!ptr) return gomupdf_counting_malloc(user, size);
+    if (size == 0) { gomupdf_counting_free(user, ptr); return NULL; }
+    p = (unsigned char *)ptr - GOMUPDF_ALLOC_HEADER;
+    old = *(size_t *)p;
+    if (size > old) {
+        used = __atomic_add_fetch(&st->used, size - old, __ATOMIC_RELAXED);
+        if (st->limit && used > st->limit) {
+            __atomic_sub_fetch(&st->used, size - old, __ATOMIC_RELAXED);
+            __atomic_add_fetch(&st->refused, 1, __ATOMIC_RELAXED);
+            __atomic_store_n(&ca->refused, 1, __ATOMIC_RELAXED);
+            return NULL;
+        }
+    }
+    __atomic_store_n(&ca->refused, 0, __ATOMIC_RELAXED);
+    np = (unsigned char *)realloc(p, size + GOMUPDF_ALLOC_HEADER);
+    if (!np) {
+        if (size > old) __atomic_sub_fetch(&st->used, size - old, __ATOMIC_RELAXED);
+        return NULL;
+    }
+    if (size < old) __atomic_sub_fetch(&st->used, old - size, __ATOMIC_RELAXED);
+    *(size_t *)np = size;
+    used = __atomic_load_n(&st->used, __ATOMIC_RELAXED);
+    old = __atomic_load_n(&st->peak, __ATOMIC_RELAXED);
+    while (used > old && !__atomic_compare_exchange_n(&st->peak, &old, used, 1,
+            __ATOMIC_RELAXED, __ATOMIC_RELAXED))
+        ;
+    return np + GOMUPDF_ALLOC_HEADER;
+}
+
+static gomupdf_alloc_state* gomupdf_new_alloc_state(size_t limit) {
+    gomupdf_alloc_state *st = (gomupdf_alloc_state *)calloc(1, sizeof(gomupdf_alloc_state));
+    if (st) st->limit = limit;
+    return st;
+}
+
+/* Must only be called once every context using the allocator has been dropped. */
+static void gomupdf_drop_alloc_state(gomupdf_alloc_state *st) {
+    free(st);
+}
+
+static void gomupdf_alloc_stats(gomupdf_alloc_state *st, int64_t *used, int64_t *peak,
+    int64_t *limit, int64_t *refused) {
+    *used = (int64_t)__atomic_load_n(&st->used, __ATOMIC_RELAXED);
+    *peak = (int64_t)__atomic_load_n(&st->peak, __ATOMIC_RELAXED);
+    *limit = (int64_t)st->limit;
+    *refused = (int64_t)__atomic_load_n(&st->refused, __ATOMIC_RELAXED);
+}
+
+static fz_context* gomupdf_new_context(gomupdf_locks *locks, gomupdf_alloc_state *alloc,
+    size_t store_size) {
+    fz_locks_context lc;
+    fz_alloc_context ac;
+    gomupdf_ctx_alloc *ca = (gomupdf_ctx_alloc *)calloc(1, sizeof(gomupdf_ctx_alloc));
+    if (!ca) return NULL;
+    ca->shared = alloc;
+    lc.user = locks;
+    lc.lock = gomupdf_lock;
+    lc.unlock = gomupdf_unlock;
+    ac.user = ca;
+    ac.malloc = gomupdf_counting_malloc;
+    ac.realloc = gomupdf_counting_realloc;
+    ac.free = gomupdf_counting_free;
+    fz_context *ctx = fz_new_context(&ac, &lc, store_size);
+    if (!ctx) {
+        free(ca);
+        return NULL;
+    }
+    fz_install_load_system_font_funcs(ctx,
+        gomupdf_load_system_font,
+        gomupdf_load_system_cjk_font,
+        gomupdf_load_system_fallback_font);
     return ctx;
 }
 
+/* Drops a base context or clone along with its allocator user data, which
+   MuPDF still uses while freeing the context. */
 static void gomupdf_drop_context(fz_context *ctx) {
+    void *ca = ctx->alloc.user;
     fz_drop_context(ctx);
+    free(ca);
 }
 
+/* Clones ctx, giving the clone allocator user data of its own. */
 static fz_context* gomupdf_clone_context(fz_context *ctx) {
-    return fz_clone_context(ctx);
+    gomupdf_ctx_alloc *ca = (gomupdf_ctx_alloc *)calloc(1, sizeof(gomupdf_ctx_alloc));
+    fz_context *clone;
+    if (!ca) return NULL;
+    ca->shared = ((gomupdf_ctx_alloc *)ctx->alloc.user)->shared;
+    clone = fz_clone_context(ctx);
+    if (!clone) {
+        free(ca);
+        return NULL;
+    }
+    clone->alloc.user = ca;
+    return clone;
+}
+
+/* Route MuPDF's warning and error messages to Go. handle identifies the
+   Go-side log sink; clones inherit the callbacks along with it. */
+extern void gomupdfLogMessage(uintptr_t handle, int level, char *message);
+
+static void gomupdf_warning_cb(void *user, const char *message) {
+    gomupdfLogMessage((uintptr_t)user, 0, (char *)message);
+}
+
+static void gomupdf_error_cb(void *user, const char *message) {
+    gomupdfLogMessage((uintptr_t)user, 1, (char *)message);
+}
+
+static void gomupdf_set_log_callbacks(fz_context *ctx, uintptr_t handle) {
+    fz_set_warning_callback(ctx, gomupdf_warning_cb, (void *)handle);
+    fz_set_error_callback(ctx, gomupdf_error_cb, (void *)handle);
+}
+
+static void gomupdf_flush_warnings(fz_context *ctx) {
+    fz_flush_warnings(ctx);
+}
+
+/* Scans the output of fz_debug_store line by line for its summary line
+   ("max=..., size=..."), so that the store listing is never held in memory. */
+typedef struct {
+    char line[256];
+    size_t len;
+    int found;
+    size_t size;
+} gomupdf_store_scan;
+
+static void gomupdf_store_scan_line(gomupdf_store_scan *sc) {
+    const char *m;
+    size_t smax, ssize;
+    sc->line[sc->len] = 0;
+    sc->len = 0;
+    m = strstr(sc->line, "\tmax=");
+    if (m && sscanf(m, "\tmax=%zu, size=%zu", &smax, &ssize) == 2) {
+        sc->size = ssize;
+        sc->found = 1;
+    }
+}
+
+static void gomupdf_store_scan_write(fz_context *ctx, void *state, const void *data, size_t n) {
+    gomupdf_store_scan *sc = (gomupdf_store_scan *)state;
+    const char *p = (const char *)data;
+    size_t i;
+    for (i = 0; i < n; i++) {
+        if (p[i] == '\n')
+            gomupdf_store_scan_line(sc);
+        else if (sc->len < sizeof(sc->line) - 1)
+            sc->line[sc->len++] = p[i];
+    }
+}
+
+/* Bytes held by the resource store. MuPDF has no accessor for it, so the
+   summary line of fz_debug_store is parsed. Returns 0 if the size could
+   not be read. */
+static int gomupdf_store_size(fz_context *ctx, int64_t *size) {
+    gomupdf_store_scan sc;
+    fz_output *out = NULL;
+    fz_var(out);
+    memset(&sc, 0, sizeof(sc));
+    *size = 0;
+    fz_try(ctx) {
+        out = fz_new_output(ctx, 0, &sc, gomupdf_store_scan_write, NULL, NULL);
+        fz_debug_store(ctx, out);
+        fz_close_output(ctx, out);
+    }
+    fz_always(ctx)
+        fz_drop_output(ctx, out);
+    fz_catch(ctx)
+        return 0;
+    if (sc.len > 0)
+        gomupdf_store_scan_line(&sc);
+    if (!sc.found)
+        return 0;
+    *size = (int64_t)sc.size;
+    return 1;
+}
+
+static int gomupdf_shrink_store(fz_context *ctx, unsigned int percent) {
+    return fz_shrink_store(ctx, percent);
+}
+
+/* Set in the error code of out-of-memory errors raised because the memory
+   limit refused the context's last allocation. */
+#define GOMUPDF_ERROR_LIMIT 0x10000
+
+/* Error code of the exception just caught, never 0. Wrappers store it in
+   their errcode out-parameter so Go can report it with the message. */
+static int gomupdf_caught(fz_context *ctx) {
+    int code = fz_caught(ctx);
+    if (code == FZ_ERROR_NONE)
+        return FZ_ERROR_GENERIC;
+    if (code == FZ_ERROR_SYSTEM &&
+            __atomic_load_n(&((gomupdf_ctx_alloc *)ctx->alloc.user)->refused, __ATOMIC_RELAXED))
+        code |= GOMUPDF_ERROR_LIMIT;
+    return code;
+}
+
+/* Message of the last caught exception. Only valid until ctx is next used
+   for an operation that may throw. */
+static const char* gomupdf_caught_message(fz_context *ctx) {
+    return fz_caught_message(ctx);
 }
 
 // Free memory allocated by MuPDF
@@ -104,7 +411,7 @@ static void gomupdf_free(fz_context *ctx, void *ptr) {
 static fz_document* gomupdf_open_document(fz_context *ctx, const char *filename, int *errcode) {
     fz_document *doc = NULL;
     fz_try(ctx) { doc = fz_open_document(ctx, filename); *errcode = 0; }
-    fz_catch(ctx) { *errcode = 1; doc = NULL; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); doc = NULL; }
     return doc;
 }
 
@@ -119,7 +426,7 @@ static fz_document* gomupdf_open_document_from_memory(fz_context *ctx,
         fz_drop_stream(ctx, stream);
         *errcode = 0;
     }
-    fz_catch(ctx) { *errcode = 1; doc = NULL; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); doc = NULL; }
     return doc;
 }
 
@@ -155,6 +462,80 @@ static void gomupdf_layout_document(fz_context *ctx, fz_document *doc, float w,
     fz_catch(ctx) { }
 }
 
+// ============================================================
+// Go-backed streams (io.ReaderAt)
+// ============================================================
+
+/* Implemented in Go (stream.go). Reads up to len bytes at offset from the
+   io.ReaderAt behind handle. Returns the number of bytes read, 0 at end of
+   data, or -1 on a read error. */
+extern int gomupdfReadAt(uintptr_t handle, unsigned char *buf, int len, int64_t offset);
+
+typedef struct {
+    uintptr_t handle;
+    int64_t size;
+    unsigned char buf[16384];
+} gomupdf_reader_state;
+
+static int gomupdf_reader_next(fz_context *ctx, fz_stream *stm, size_t max) {
+    gomupdf_reader_state *state = (gomupdf_reader_state *)stm->state;
+    int64_t remaining = state->size - stm->pos;
+    int want = (int)sizeof(state->buf);
+    int n;
+    (void)max;
+    if (remaining <= 0) return EOF;
+    if (remaining < want) want = (int)remaining;
+    n = gomupdfReadAt(state->handle, state->buf, want, stm->pos);
+    if (n < 0)
+        fz_throw(ctx, FZ_ERROR_SYSTEM, "read error at offset %lld", (long long)stm->pos);
+    stm->rp = state->buf;
+    stm->wp = state->buf + n;
+    stm->pos += n;
+    if (n == 0) return EOF;
+    return *stm->rp++;
+}
+
+static void gomupdf_reader_seek(fz_context *ctx, fz_stream *stm, int64_t offset, int whence) {
+    gomupdf_reader_state *state = (gomupdf_reader_state *)stm->state;
+    int64_t pos;
+    (void)ctx;
+    switch (whence) {
+        case SEEK_END: pos = state->size + offset; break;
+        case SEEK_CUR: pos = stm->pos - (stm->wp - stm->rp) + offset; break;
+        default:       pos = offset; break;
+    }
+    if (pos < 0) pos = 0;
+    if (pos > state->size) pos = state->size;
+    stm->pos = pos;
+    stm->rp = state->buf;
+    stm->wp = state->buf;
+}
+
+static void gomupdf_reader_drop(fz_context *ctx, void *state) {
+    fz_free(ctx, state);
+}
+
+/* Open a document whose bytes are pulled on demand from Go. The handle must
+   stay valid until the document has been dropped. */
+static fz_document* gomupdf_open_document_from_reader(fz_context *ctx,
+    const char *magic, uintptr_t handle, int64_t size, int *errcode) {
+    fz_document *doc = NULL;
+    fz_stream *stream = NULL;
+    fz_var(stream);
+    fz_try(ctx) {
+        gomupdf_reader_state *state = fz_malloc_struct(ctx, gomupdf_reader_state);
+        state->handle = handle;
+        state->size = size;
+        stream = fz_new_stream(ctx, state, gomupdf_reader_next, gomupdf_reader_drop);
+        stream->seek = gomupdf_reader_seek;
+        doc = fz_open_document_with_stream(ctx, magic, stream);
+        *errcode = 0;
+    }
+    fz_always(ctx) { fz_drop_stream(ctx, stream); }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); doc = NULL; }
+    return doc;
+}
+
 // ============================================================
 // Metadata
 // ============================================================
@@ -163,7 +544,7 @@ static char* gomupdf_lookup_metadata(fz_context *ctx, fz_document *doc, const ch
     char buf[512];
     int n;
     fz_try(ctx) { n = fz_lookup_metadata(ctx, doc, key, buf, sizeof(buf)); *errcode = 0; }
-    fz_catch(ctx) { *errcode = 1; return NULL; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); return NULL; }
     if (n == -1) return NULL;
     return fz_strdup(ctx, buf);
 }
@@ -180,7 +561,7 @@ static void gomupdf_set_metadata(fz_context *ctx, fz_document *doc, const char *
 static fz_outline* gomupdf_load_outline(fz_context *ctx, fz_document *doc, int *errcode) {
     fz_outline *outline = NULL;
     fz_try(ctx) { outline = fz_load_outline(ctx, doc); *errcode = 0; }
-    fz_catch(ctx) { *errcode = 1; outline = NULL; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); outline = NULL; }
     return outline;
 }
 
@@ -195,7 +576,7 @@ static void gomupdf_drop_outline(fz_context *ctx, fz_outline *outline) {
 static fz_page* gomupdf_load_page(fz_context *ctx, fz_document *doc, int number, int *errcode) {
     fz_page *page = NULL;
     fz_try(ctx) { page = fz_load_page(ctx, doc, number); *errcode = 0; }
-    fz_catch(ctx) { *errcode = 1; page = NULL; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); page = NULL; }
     return page;
 }
 
@@ -218,21 +599,87 @@ static void gomupdf_set_page_rotation(fz_context *ctx, pdf_page *page, int rotat
 static char* gomupdf_page_label(fz_context *ctx, fz_page *page, int *errcode) {
     char buf[256];
     fz_try(ctx) { fz_page_label(ctx, page, buf, sizeof(buf)); *errcode = 0; }
-    fz_catch(ctx) { *errcode = 1; return NULL; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); return NULL; }
     return fz_strdup(ctx, buf);
 }
 
+// ============================================================
+// Display lists
+// ============================================================
+
+/* Record a page into a display list. This is the only step of rendering,
+   text extraction and search that touches the document; the list can then
+   be replayed on a cloned context while other threads use the document. */
+static fz_display_list* gomupdf_new_display_list(fz_context *ctx, fz_page *page,
+    int annots, fz_cookie *cookie, int *errcode) {
+    fz_display_list *list = NULL;
+    fz_device *dev = NULL;
+    fz_var(list);
+    fz_var(dev);
+    fz_try(ctx) {
+        list = fz_new_display_list(ctx, fz_bound_page(ctx, page));
+        dev = fz_new_list_device(ctx, list);
+        if (annots)
+            fz_run_page(ctx, page, dev, fz_identity, cookie);
+        else
+            fz_run_page_contents(ctx, page, dev, fz_identity, cookie);
+        fz_close_device(ctx, dev);
+        *errcode = 0;
+    }
+    fz_always(ctx) { fz_drop_device(ctx, dev); }
+    fz_catch(ctx) { fz_drop_display_list(ctx, list); *errcode = gomupdf_caught(ctx); list = NULL; }
+    return list;
+}
+
+// ============================================================
+// Cookies (cancellation and progress)
+// ============================================================
+
+static fz_cookie* gomupdf_new_cookie(void) {
+    return (fz_cookie *)calloc(1, sizeof(fz_cookie));
+}
+
+static void gomupdf_drop_cookie(fz_cookie *cookie) {
+    free(cookie);
+}
+
+static void gomupdf_cookie_abort(fz_cookie *cookie) {
+    __atomic_store_n(&cookie->abort, 1, __ATOMIC_RELAXED);
+}
+
+static void gomupdf_cookie_progress(fz_cookie *cookie, int *progress, int64_t *progress_max, int *errors) {
+    size_t max = __atomic_load_n(&cookie->progress_max, __ATOMIC_RELAXED);
+    *progress = __atomic_load_n(&cookie->progress, __ATOMIC_RELAXED);
+    *progress_max = max == (size_t)-1 ? -1 : (int64_t)max;
+    *errors = __atomic_load_n(&cookie->errors, __ATOMIC_RELAXED);
+}
+
+static void gomupdf_drop_display_list(fz_context *ctx, fz_display_list *list) {
+    fz_drop_display_list(ctx, list);
+}
+
 // ============================================================
 // Text extraction
 // ============================================================
 
-static fz_stext_page* gomupdf_new_stext_page(fz_context *ctx, fz_page *page, int flags, int *errcode) {
+static fz_stext_page* gomupdf_new_stext_page_from_display_list(fz_context *ctx,
+    fz_display_list *list, int flags, fz_cookie *cookie, int *errcode) {
     fz_stext_page *tp = NULL;
+    fz_device *dev = NULL;
     fz_stext_options opts;
     memset(&opts, 0, sizeof(opts));
     opts.flags = flags;
-    fz_try(ctx) { tp = fz_new_stext_page_from_page(ctx, page, &opts); *errcode = 0; }
-    fz_catch(ctx) { *errcode = 1; tp = NULL; }
+    fz_var(tp);
+    fz_var(dev);
+    fz_try(ctx) {
+        tp = fz_new_stext_page(ctx, fz_bound_display_list(ctx, list));
+        dev = fz_new_stext_device(ctx, tp, &opts);
+        fz_run_display_list(ctx, list, dev, fz_identity, fz_infinite_rect, cookie);
+        fz_close_device(ctx, dev);
+        *errcode = 0;
+    }
+    fz_always(ctx) { fz_drop_device(ctx, dev); }
+    fz_catch(ctx) { fz_drop_stext_page(ctx, tp); *errcode = gomupdf_caught(ctx); tp = NULL; }
     return tp;
 }
 
@@ -248,23 +695,256 @@ static char* gomupdf_stext_page_as_text(fz_context *ctx, fz_stext_page *tp, int
         fz_drop_buffer(ctx, buf);
         *errcode = 0;
     }
-    fz_catch(ctx) { *errcode = 1; text = NULL; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); text = NULL; }
+    return text;
+}
+
+enum {
+    GOMUPDF_TEXT_HTML,
+    GOMUPDF_TEXT_XHTML,
+    GOMUPDF_TEXT_XML,
+    GOMUPDF_TEXT_JSON
+};
+
+/* Print the page in one of the GOMUPDF_TEXT_* formats. id numbers the
+   page in HTML, XHTML and XML output, which are fragments without the
+   document header and trailer. */
+static char* gomupdf_stext_page_print(fz_context *ctx, fz_stext_page *tp, int format, int id, int *errcode) {
+    char *text = NULL;
+    fz_buffer *buf = NULL;
+    fz_output *out = NULL;
+    fz_var(buf);
+    fz_var(out);
+    fz_try(ctx) {
+        buf = fz_new_buffer(ctx, 4096);
+        out = fz_new_output_with_buffer(ctx, buf);
+        switch (format) {
+        case GOMUPDF_TEXT_HTML: fz_print_stext_page_as_html(ctx, out, tp, id); break;
+        case GOMUPDF_TEXT_XHTML: fz_print_stext_page_as_xhtml(ctx, out, tp, id); break;
+        case GOMUPDF_TEXT_XML: fz_print_stext_page_as_xml(ctx, out, tp, id); break;
+        default: fz_print_stext_page_as_json(ctx, out, tp, 1); break;
+        }
+        fz_close_output(ctx, out);
+        text = fz_strdup(ctx, fz_string_from_buffer(ctx, buf));
+        *errcode = 0;
+    }
+    fz_always(ctx) {
+        fz_drop_output(ctx, out);
+        fz_drop_buffer(ctx, buf);
+    }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); text = NULL; }
+    return text;
+}
+
+/* Whether r lies mostly (by area) inside clip. Degenerate rectangles,
+   such as those of some spaces, count as inside if their center is. */
+static int gomupdf_rect_mostly_inside(fz_rect r, fz_rect clip) {
+    float area = (r.x1 - r.x0) * (r.y1 - r.y0);
+    fz_rect i;
+    if (area <= 0)
+        return fz_is_point_inside_rect(fz_make_point((r.x0 + r.x1) / 2, (r.y0 + r.y1) / 2), clip);
+    i = fz_intersect_rect(r, clip);
+    if (fz_is_empty_rect(i)) return 0;
+    return (i.x1 - i.x0) * (i.y1 - i.y0) > area / 2;
+}
+
+static void gomupdf_stext_unlink_block(fz_stext_page *tp, fz_stext_block *block) {
+    if (block->prev) block->prev->next = block->next; else tp->first_block = block->next;
+    if (block->next) block->next->prev = block->prev; else tp->last_block = block->prev;
+}
+
+/* Drop the characters of the text page that are not mostly inside clip.
+   Lines and blocks left empty are removed and the bounding boxes of the
+   remaining ones shrink to their content. */
+static void gomupdf_stext_page_clip(fz_stext_page *tp, fz_rect clip) {
+    fz_stext_block *block, *next_block;
+    for (block = tp->first_block; block; block = next_block) {
+        fz_stext_line *line, *next_line;
+        next_block = block->next;
+        if (block->type != FZ_STEXT_BLOCK_TEXT) {
+            if (!gomupdf_rect_mostly_inside(block->bbox, clip))
+                gomupdf_stext_unlink_block(tp, block);
+            continue;
+        }
+        block->bbox = fz_empty_rect;
+        for (line = block->u.t.first_line; line; line = next_line) {
+            fz_stext_char *ch, *prev = NULL;
+            next_line = line->next;
+            line->bbox = fz_empty_rect;
+            for (ch = line->first_char; ch; ch = ch->next) {
+                fz_rect r = fz_rect_from_quad(ch->quad);
+                if (!gomupdf_rect_mostly_inside(r, clip)) continue;
+                if (prev) prev->next = ch; else line->first_char = ch;
+                prev = ch;
+                line->bbox = fz_union_rect(line->bbox, r);
+            }
+            if (prev) {
+                prev->next = NULL;
+                line->last_char = prev;
+                block->bbox = fz_union_rect(block->bbox, line->bbox);
+                continue;
+            }
+            if (line->prev) line->prev->next = line->next; else block->u.t.first_line = line->next;
+            if (line->next) line->next->prev = line->prev; else block->u.t.last_line = line->prev;
+        }
+        if (!block->u.t.first_line)
+            gomupdf_stext_unlink_block(tp, block);
+    }
+}
+
+static int gomupdf_stext_block_cmp(const void *a, const void *b) {
+    const fz_stext_block *x = *(fz_stext_block * const *)a;
+    const fz_stext_block *y = *(fz_stext_block * const *)b;
+    if (x->bbox.y1 != y->bbox.y1) return x->bbox.y1 < y->bbox.y1 ? -1 : 1;
+    if (x->bbox.x0 != y->bbox.x0) return x->bbox.x0 < y->bbox.x0 ? -1 : 1;
+    return 0;
+}
+
+/* Apply the clip and sort options of extraction to a new text page.
+   Blocks are sorted by their bottom, then left coordinate, like PyMuPDF
+   does. */
+static void gomupdf_stext_page_clip_sort(fz_context *ctx, fz_stext_page *tp, int has_clip,
+    float x0, float y0, float x1, float y1, int sort, int *errcode) {
+    fz_stext_block **blocks = NULL;
+    fz_var(blocks);
+    fz_try(ctx) {
+        fz_stext_block *block;
+        int n = 0, i;
+        if (has_clip)
+            gomupdf_stext_page_clip(tp, fz_make_rect(x0, y0, x1, y1));
+        if (sort) {
+            for (block = tp->first_block; block; block = block->next) n++;
+            if (n > 1) {
+                blocks = fz_malloc_array(ctx, n, fz_stext_block *);
+                for (i = 0, block = tp->first_block; block; block = block->next) blocks[i++] = block;
+                qsort(blocks, n, sizeof *blocks, gomupdf_stext_block_cmp);
+                for (i = 0; i < n; i++) {
+                    blocks[i]->prev = i > 0 ? blocks[i - 1] : NULL;
+                    blocks[i]->next = i < n - 1 ? blocks[i + 1] : NULL;
+                }
+                tp->first_block = blocks[0];
+                tp->last_block = blocks[n - 1];
+            }
+        }
+        *errcode = 0;
+    }
+    fz_always(ctx) { fz_free(ctx, blocks); }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); }
+}
+
+/* Select the text between a and b, snapped to whole words or lines as
+   mode says. The text is returned; its highlight quads go into a new
+   array of *count quads. The caller frees both. */
+static char *gomupdf_stext_selection(fz_context *ctx, fz_stext_page *tp,
+    float ax, float ay, float bx, float by, int mode, fz_quad **quads, int *count, int *errcode) {
+    char *text = NULL;
+    fz_quad *q = NULL;
+    int max = 16;
+    fz_var(text);
+    fz_var(q);
+    fz_var(max);
+    *count = 0;
+    fz_try(ctx) {
+        fz_point a = fz_make_point(ax, ay), b = fz_make_point(bx, by);
+        fz_snap_selection(ctx, tp, &a, &b, mode);
+        for (;;) {
+            q = fz_realloc_array(ctx, q, max, fz_quad);
+            *count = fz_highlight_selection(ctx, tp, a, b, q, max);
+            if (*count < max) break;
+            max *= 2;
+        }
+        text = fz_copy_selection(ctx, tp, a, b, 0);
+        *errcode = 0;
+    }
+    fz_catch(ctx) {
+        fz_free(ctx, q);
+        q = NULL;
+        *count = 0;
+        *errcode = gomupdf_caught(ctx);
+    }
+    *quads = q;
+    return text;
+}
+
+static char *gomupdf_stext_copy_rect(fz_context *ctx, fz_stext_page *tp,
+    float x0, float y0, float x1, float y1, int *errcode) {
+    char *text = NULL;
+    fz_try(ctx) {
+        text = fz_copy_rectangle(ctx, tp, fz_make_rect(x0, y0, x1, y1), 0);
+        *errcode = 0;
+    }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); text = NULL; }
     return text;
 }
 
+/* The image of an image block of a text page, encoded as PNG. */
+static unsigned char *gomupdf_stext_block_png(fz_context *ctx, fz_stext_block *block,
+    int *outlen, int *errcode) {
+    fz_buffer *buf = NULL;
+    unsigned char *data = NULL;
+    fz_var(buf);
+    fz_var(data);
+    fz_try(ctx) {
+        unsigned char *bufdata;
+        size_t len;
+        buf = fz_new_buffer_from_image_as_png(ctx, block->u.i.image, fz_default_color_params);
+        len = fz_buffer_storage(ctx, buf, &bufdata);
+        data = (unsigned char*)fz_malloc(ctx, len ? len : 1);
+        memcpy(data, bufdata, len);
+        *outlen = (int)len;
+        *errcode = 0;
+    }
+    fz_always(ctx) { fz_drop_buffer(ctx, buf); }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); data = NULL; }
+    return data;
+}
+
+/* Font properties reported for structured text spans. */
+typedef struct {
+    const char *name;
+    int bold, italic, serif, monospaced;
+    float ascender, descender;
+} gomupdf_stext_font;
+
+static void gomupdf_stext_font_info(fz_context *ctx, fz_font *font, gomupdf_stext_font *info) {
+    info->name = fz_font_name(ctx, font);
+    info->bold = fz_font_is_bold(ctx, font);
+    info->italic = fz_font_is_italic(ctx, font);
+    info->serif = fz_font_is_serif(ctx, font);
+    info->monospaced = fz_font_is_monospaced(ctx, font);
+    info->ascender = fz_font_ascender(ctx, font);
+    info->descender = fz_font_descender(ctx, font);
+}
+
 // ============================================================
 // Search
 // ============================================================
 
-static int gomupdf_search_page(fz_context *ctx, fz_page *page, const char *needle,
-    fz_quad *quads, int max_quads, int *errcode) {
-    int count = 0;
+/* Search tp for needle. The hits are returned in a new array of *count
+   quads, grown until every hit fits; the caller frees it. */
+static fz_quad *gomupdf_search_stext_page(fz_context *ctx, fz_stext_page *tp,
+    const char *needle, int *count, int *errcode) {
+    fz_quad *quads = NULL;
+    int max = 64;
+    fz_var(quads);
+    fz_var(max);
+    *count = 0;
     fz_try(ctx) {
-        count = fz_search_page(ctx, page, needle, NULL, quads, max_quads);
+        for (;;) {
+            quads = fz_realloc_array(ctx, quads, max, fz_quad);
+            *count = fz_search_stext_page(ctx, tp, needle, NULL, quads, max);
+            if (*count < max) break;
+            max *= 2;
+        }
         *errcode = 0;
     }
-    fz_catch(ctx) { *errcode = 1; count = 0; }
-    return count;
+    fz_catch(ctx) {
+        fz_free(ctx, quads);
+        quads = NULL;
+        *count = 0;
+        *errcode = gomupdf_caught(ctx);
+    }
+    return quads;
 }
 
 // ============================================================
@@ -274,7 +954,7 @@ static int gomupdf_search_page(fz_context *ctx, fz_page *page, const char *needl
 static fz_link* gomupdf_load_links(fz_context *ctx, fz_page *page, int *errcode) {
     fz_link *links = NULL;
     fz_try(ctx) { links = fz_load_links(ctx, page); *errcode = 0; }
-    fz_catch(ctx) { *errcode = 1; links = NULL; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); links = NULL; }
     return links;
 }
 
@@ -286,42 +966,34 @@ static void gomupdf_drop_link(fz_context *ctx, fz_link *link) {
 // Pixmap operations
 // ============================================================
 
-static fz_pixmap* gomupdf_page_to_pixmap(fz_context *ctx, fz_page *page,
-    float a, float b, float c, float d, float e, float f,
-    int colorspace, int alpha, int *errcode) {
-    fz_pixmap *pix = NULL;
-    fz_matrix ctm = {a, b, c, d, e, f};
-    fz_colorspace *cs;
-    switch(colorspace) {
-        case 0: cs = fz_device_gray(ctx); break;
-        case 2: cs = fz_device_cmyk(ctx); break;
-        default: cs = fz_device_rgb(ctx); break;
-    }
-    fz_try(ctx) { pix = fz_new_pixmap_from_page(ctx, page, ctm, cs, alpha); *errcode = 0; }
-    fz_catch(ctx) { *errcode = 1; pix = NULL; }
-    return pix;
-}
-
-static fz_pixmap* gomupdf_page_to_pixmap_clipped(fz_context *ctx, fz_page *page,
+static fz_pixmap* gomupdf_display_list_to_pixmap(fz_context *ctx, fz_display_list *list,
     float a, float b, float c, float d, float e, float f,
-    int colorspace, int alpha,
-    float cx0, float cy0, float cx1, float cy1, int *errcode) {
+    int colorspace, int alpha, fz_cookie *cookie, int *errcode) {
     fz_pixmap *pix = NULL;
+    fz_device *dev = NULL;
     fz_matrix ctm = {a, b, c, d, e, f};
-    fz_rect clip = {cx0, cy0, cx1, cy1};
-    fz_irect iclip = fz_round_rect(clip);
     fz_colorspace *cs;
     switch(colorspace) {
         case 0: cs = fz_device_gray(ctx); break;
         case 2: cs = fz_device_cmyk(ctx); break;
         default: cs = fz_device_rgb(ctx); break;
     }
+    fz_var(pix);
+    fz_var(dev);
     fz_try(ctx) {
-        pix = fz_new_pixmap_from_page_contents(ctx, page, ctm, cs, alpha);
+        fz_irect bbox = fz_round_rect(fz_transform_rect(fz_bound_display_list(ctx, list), ctm));
+        pix = fz_new_pixmap_with_bbox(ctx, cs, bbox, NULL, alpha);
+        if (alpha)
+            fz_clear_pixmap(ctx, pix);
+        else
+            fz_clear_pixmap_with_value(ctx, pix, 0xFF);
+        dev = fz_new_draw_device(ctx, ctm, pix);
+        fz_run_display_list(ctx, list, dev, fz_identity, fz_infinite_rect, cookie);
+        fz_close_device(ctx, dev);
         *errcode = 0;
     }
-    fz_catch(ctx) { *errcode = 1; pix = NULL; }
-    (void)iclip;
+    fz_always(ctx) { fz_drop_device(ctx, dev); }
+    fz_catch(ctx) { fz_drop_pixmap(ctx, pix); *errcode = gomupdf_caught(ctx); pix = NULL; }
     return pix;
 }
 
@@ -329,13 +1001,13 @@ static void gomupdf_drop_pixmap(fz_context *ctx, fz_pixmap *pix) {
     fz_drop_pixmap(ctx, pix);
 }
 
-static int gomupdf_pixmap_width(fz_pixmap *pix) { return pix->w; }
-static int gomupdf_pixmap_height(fz_pixmap *pix) { return pix->h; }
-static int gomupdf_pixmap_n(fz_pixmap *pix) { return pix->n; }
-static int gomupdf_pixmap_alpha(fz_pixmap *pix) { return pix->alpha; }
-static int gomupdf_pixmap_stride(fz_pixmap *pix) { return pix->stride; }
-static int gomupdf_pixmap_x(fz_pixmap *pix) { return pix->x; }
-static int gomupdf_pixmap_y(fz_pixmap *pix) { return pix->y; }
+static int gomupdf_pixmap_width(fz_pixmap *pix) { return pix ? pix->w : 0; }
+static int gomupdf_pixmap_height(fz_pixmap *pix) { return pix ? pix->h : 0; }
+static int gomupdf_pixmap_n(fz_pixmap *pix) { return pix ? pix->n : 0; }
+static int gomupdf_pixmap_alpha(fz_pixmap *pix) { return pix ? pix->alpha : 0; }
+static int gomupdf_pixmap_stride(fz_pixmap *pix) { return pix ? pix->stride : 0; }
+static int gomupdf_pixmap_x(fz_pixmap *pix) { return pix ? pix->x : 0; }
+static int gomupdf_pixmap_y(fz_pixmap *pix) { return pix ? pix->y : 0; }
 static unsigned char* gomupdf_pixmap_samples(fz_pixmap *pix) { return pix->samples; }
 static int gomupdf_pixmap_samples_len(fz_pixmap *pix) { return pix->h * pix->stride; }
 
@@ -351,7 +1023,7 @@ static unsigned char* gomupdf_pixmap_to_png(fz_context *ctx, fz_pixmap *pix, int
         fz_drop_buffer(ctx, buf);
         *errcode = 0;
     }
-    fz_catch(ctx) { *errcode = 1; data = NULL; *outlen = 0; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); data = NULL; *outlen = 0; }
     return data;
 }
 
@@ -379,7 +1051,7 @@ static fz_pixmap* gomupdf_pixmap_from_image(fz_context *ctx, fz_document *doc,
         pdf_drop_obj(ctx, ref);
         *errcode = 0;
     }
-    fz_catch(ctx) { *errcode = 1; pix = NULL; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); pix = NULL; }
     return pix;
 }
 
@@ -415,14 +1087,14 @@ static void gomupdf_pixmap_tint(fz_context *ctx, fz_pixmap *pix, int black, int
 static int gomupdf_pixmap_save_png(fz_context *ctx, fz_pixmap *pix, const char *filename) {
     int errcode = 0;
     fz_try(ctx) { fz_save_pixmap_as_png(ctx, pix, filename); }
-    fz_catch(ctx) { errcode = 1; }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
     return errcode;
 }
 
 static int gomupdf_pixmap_save_pnm(fz_context *ctx, fz_pixmap *pix, const char *filename) {
     int errcode = 0;
     fz_try(ctx) { fz_save_pixmap_as_pnm(ctx, pix, filename); }
-    fz_catch(ctx) { errcode = 1; }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
     return errcode;
 }
 
@@ -435,7 +1107,7 @@ static fz_pixmap* gomupdf_pixmap_convert(fz_context *ctx, fz_pixmap *pix, int co
     }
     fz_pixmap *result = NULL;
     fz_try(ctx) { result = fz_convert_pixmap(ctx, pix, cs, NULL, NULL, fz_default_color_params, 1); *errcode = 0; }
-    fz_catch(ctx) { *errcode = 1; result = NULL; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); result = NULL; }
     return result;
 }
 
@@ -465,7 +1137,7 @@ static int gomupdf_pdf_save(fz_context *ctx, pdf_document *pdf, const char *file
         pdf_subset_fonts(ctx, pdf, 0, NULL);
         pdf_save_document(ctx, pdf, filename, &opts);
     }
-    fz_catch(ctx) { errcode = 1; }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
     return errcode;
 }
 
@@ -495,7 +1167,7 @@ static unsigned char* gomupdf_pdf_tobytes(fz_context *ctx, pdf_document *pdf,
         fz_drop_buffer(ctx, buf);
         *errcode = 0;
     }
-    fz_catch(ctx) { *errcode = 1; data = NULL; *outlen = 0; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); data = NULL; *outlen = 0; }
     return data;
 }
 
@@ -519,14 +1191,14 @@ static int gomupdf_insert_page(fz_context *ctx, pdf_document *pdf, int pno,
         fz_drop_buffer(ctx, contents);
         pdf_drop_obj(ctx, resources);
     }
-    fz_catch(ctx) { errcode = 1; }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
     return errcode;
 }
 
 static int gomupdf_delete_page(fz_context *ctx, pdf_document *pdf, int pno) {
     int errcode = 0;
     fz_try(ctx) { pdf_delete_page(ctx, pdf, pno); }
-    fz_catch(ctx) { errcode = 1; }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
     return errcode;
 }
 
@@ -558,10 +1230,1106 @@ static char* gomupdf_xref_object_str(fz_context *ctx, pdf_document *pdf, int xre
         pdf_drop_obj(ctx, obj);
         *errcode = 0;
     }
-    fz_catch(ctx) { *errcode = 1; result = NULL; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); result = NULL; }
+    return result;
+}
+
+// ============================================================
+// Page resources (fonts, images, nested Form XObjects)
+// ============================================================
+
+enum { GOMUPDF_RES_FONT, GOMUPDF_RES_IMAGE };
+
+/* A resource found on a page. obj and name are borrowed from the
+   document and stay valid while the document is open. */
+typedef struct {
+    pdf_obj *obj;
+    const char *name;
+    int xref;
+    int referencer; /* xref of the page or Form XObject using it */
+} gomupdf_resource;
+
+typedef struct {
+    gomupdf_resource *items;
+    int len, cap;
+} gomupdf_resource_list;
+
+static void gomupdf_resource_add(fz_context *ctx, gomupdf_resource_list *list,
+    pdf_obj *obj, const char *name, int referencer) {
+    int xref = pdf_to_num(ctx, obj);
+    if (xref > 0) {
+        for (int i = 0; i < list->len; i++)
+            if (list->items[i].xref == xref) return;
+    }
+    if (list->len == list->cap) {
+        int cap = list->cap ? list->cap * 2 : 16;
+        list->items = fz_realloc(ctx, list->items, cap * sizeof(gomupdf_resource));
+        list->cap = cap;
+    }
+    gomupdf_resource *r = &list->items[list->len++];
+    r->obj = pdf_resolve_indirect(ctx, obj);
+    r->name = name;
+    r->xref = xref;
+    r->referencer = referencer;
+}
+
+static void gomupdf_scan_resources(fz_context *ctx, pdf_obj *res, int kind,
+    int referencer, gomupdf_resource_list *list, pdf_cycle_list *up) {
+    if (!pdf_is_dict(ctx, res)) return;
+
+    if (kind == GOMUPDF_RES_FONT) {
+        pdf_obj *fonts = pdf_dict_get(ctx, res, PDF_NAME(Font));
+        int n = pdf_dict_len(ctx, fonts);
+        for (int i = 0; i < n; i++) {
+            pdf_obj *font = pdf_dict_get_val(ctx, fonts, i);
+            if (pdf_is_dict(ctx, font))
+                gomupdf_resource_add(ctx, list, font,
+                    pdf_to_name(ctx, pdf_dict_get_key(ctx, fonts, i)), referencer);
+        }
+    }
+
+    pdf_obj *xobjs = pdf_dict_get(ctx, res, PDF_NAME(XObject));
+    int n = pdf_dict_len(ctx, xobjs);
+    for (int i = 0; i < n; i++) {
+        pdf_obj *xobj = pdf_dict_get_val(ctx, xobjs, i);
+        pdf_obj *subtype = pdf_dict_get(ctx, xobj, PDF_NAME(Subtype));
+        if (kind == GOMUPDF_RES_IMAGE && pdf_name_eq(ctx, subtype, PDF_NAME(Image)))
+            gomupdf_resource_add(ctx, list, xobj,
+                pdf_to_name(ctx, pdf_dict_get_key(ctx, xobjs, i)), referencer);
+    }
+    for (int i = 0; i < n; i++) {
+        pdf_obj *xobj = pdf_dict_get_val(ctx, xobjs, i);
+        pdf_cycle_list cycle;
+        if (!pdf_name_eq(ctx, pdf_dict_get(ctx, xobj, PDF_NAME(Subtype)), PDF_NAME(Form)))
+            continue;
+        if (pdf_cycle(ctx, &cycle, up, xobj))
+            continue;
+        gomupdf_scan_resources(ctx, pdf_dict_get(ctx, xobj, PDF_NAME(Resources)),
+            kind, pdf_to_num(ctx, xobj), list, &cycle);
+    }
+}
+
+/* Collects the resources of the given kind used by a page, including those
+   of nested Form XObjects. The returned array must be freed with
+   gomupdf_free. */
+static gomupdf_resource* gomupdf_page_resources(fz_context *ctx, pdf_page *page,
+    int kind, int *count, int *errcode) {
+    gomupdf_resource_list list = { NULL, 0, 0 };
+    *count = 0;
+    fz_try(ctx) {
+        gomupdf_scan_resources(ctx, pdf_page_resources(ctx, page), kind,
+            pdf_to_num(ctx, page->obj), &list, NULL);
+        *count = list.len;
+        *errcode = 0;
+    }
+    fz_catch(ctx) {
+        fz_free(ctx, list.items);
+        list.items = NULL;
+        *errcode = gomupdf_caught(ctx);
+    }
+    return list.items;
+}
+
+/* Properties of a font dictionary. Strings are borrowed from the document;
+   ext is "n/a" if the font program is not embedded. */
+typedef struct {
+    const char *type, *basename, *encoding, *ext;
+} gomupdf_font_info;
+
+static pdf_obj* gomupdf_font_descriptor(fz_context *ctx, pdf_obj *font) {
+    pdf_obj *desc = pdf_dict_get(ctx, font, PDF_NAME(FontDescriptor));
+    if (!desc) {
+        pdf_obj *descendant = pdf_array_get(ctx,
+            pdf_dict_get(ctx, font, PDF_NAME(DescendantFonts)), 0);
+        desc = pdf_dict_get(ctx, descendant, PDF_NAME(FontDescriptor));
+    }
+    return desc;
+}
+
+/* Returns the embedded font program stream of a font and its extension. */
+static pdf_obj* gomupdf_font_file(fz_context *ctx, pdf_obj *font, const char **ext) {
+    pdf_obj *desc = gomupdf_font_descriptor(ctx, font);
+    pdf_obj *file;
+    *ext = "n/a";
+    if ((file = pdf_dict_get(ctx, desc, PDF_NAME(FontFile))) != NULL) {
+        *ext = "pfa";
+    } else if ((file = pdf_dict_get(ctx, desc, PDF_NAME(FontFile2))) != NULL) {
+        *ext = "ttf";
+    } else if ((file = pdf_dict_get(ctx, desc, PDF_NAME(FontFile3))) != NULL) {
+        pdf_obj *sub = pdf_dict_get(ctx, file, PDF_NAME(Subtype));
+        *ext = pdf_name_eq(ctx, sub, PDF_NAME(OpenType)) ? "otf" : "cff";
+    }
+    return file;
+}
+
+static void gomupdf_font_get_info(fz_context *ctx, pdf_obj *font,
+    gomupdf_font_info *info, int *errcode) {
+    fz_try(ctx) {
+        pdf_obj *enc = pdf_dict_get(ctx, font, PDF_NAME(Encoding));
+        if (pdf_is_dict(ctx, enc))
+            enc = pdf_dict_get(ctx, enc, PDF_NAME(BaseEncoding));
+        info->type = pdf_to_name(ctx, pdf_dict_get(ctx, font, PDF_NAME(Subtype)));
+        info->basename = pdf_to_name(ctx, pdf_dict_get(ctx, font, PDF_NAME(BaseFont)));
+        info->encoding = pdf_to_name(ctx, enc);
+        gomupdf_font_file(ctx, font, &info->ext);
+        *errcode = 0;
+    }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); }
+}
+
+/* Returns the decoded font program embedded for the font dictionary xref,
+   or NULL with *errcode 0 if the font is not embedded. */
+static unsigned char* gomupdf_extract_font(fz_context *ctx, pdf_document *pdf, int xref,
+    const char **ext, int *outlen, int *errcode) {
+    unsigned char *data = NULL;
+    fz_buffer *buf = NULL;
+    pdf_obj *font = NULL;
+    *outlen = 0;
+    *ext = "n/a";
+    fz_var(buf);
+    fz_var(font);
+    fz_var(data);
+    fz_try(ctx) {
+        font = pdf_load_object(ctx, pdf, xref);
+        if (!pdf_name_eq(ctx, pdf_dict_get(ctx, font, PDF_NAME(Type)), PDF_NAME(Font)))
+            fz_throw(ctx, FZ_ERROR_ARGUMENT, "object %d is not a font", xref);
+        pdf_obj *file = gomupdf_font_file(ctx, font, ext);
+        if (file) {
+            buf = pdf_load_stream(ctx, file);
+            unsigned char *bufdata;
+            size_t len = fz_buffer_storage(ctx, buf, &bufdata);
+            data = (unsigned char*)fz_malloc(ctx, len ? len : 1);
+            memcpy(data, bufdata, len);
+            *outlen = (int)len;
+        }
+        *errcode = 0;
+    }
+    fz_always(ctx) {
+        fz_drop_buffer(ctx, buf);
+        pdf_drop_obj(ctx, font);
+    }
+    fz_catch(ctx) {
+        fz_free(ctx, data);
+        data = NULL;
+        *outlen = 0;
+        *errcode = gomupdf_caught(ctx);
+    }
+    return data;
+}
+
+/* Properties of an image XObject. Strings are borrowed from the document. */
+typedef struct {
+    int width, height, bpc, smask;
+    const char *colorspace, *altcs, *filter;
+} gomupdf_image_info;
+
+static const char* gomupdf_cs_name(fz_context *ctx, pdf_obj *cs) {
+    return pdf_to_name(ctx, pdf_is_array(ctx, cs) ? pdf_array_get(ctx, cs, 0) : cs);
+}
+
+static void gomupdf_image_get_info(fz_context *ctx, pdf_obj *img,
+    gomupdf_image_info *info, int *errcode) {
+    fz_try(ctx) {
+        pdf_obj *cs = pdf_dict_get(ctx, img, PDF_NAME(ColorSpace));
+        pdf_obj *filter = pdf_dict_get(ctx, img, PDF_NAME(Filter));
+        pdf_obj *alt = NULL;
+        info->width = pdf_dict_get_int(ctx, img, PDF_NAME(Width));
+        info->height = pdf_dict_get_int(ctx, img, PDF_NAME(Height));
+        info->bpc = pdf_dict_get_int(ctx, img, PDF_NAME(BitsPerComponent));
+        info->smask = pdf_to_num(ctx, pdf_dict_get(ctx, img, PDF_NAME(SMask)));
+        info->colorspace = gomupdf_cs_name(ctx, cs);
+        if (pdf_is_array(ctx, cs)) {
+            pdf_obj *family = pdf_array_get(ctx, cs, 0);
+            if (pdf_name_eq(ctx, family, PDF_NAME(ICCBased)))
+                alt = pdf_dict_get(ctx, pdf_array_get(ctx, cs, 1), PDF_NAME(Alternate));
+            else if (pdf_name_eq(ctx, family, PDF_NAME(Indexed)))
+                alt = pdf_array_get(ctx, cs, 1);
+            else if (pdf_name_eq(ctx, family, PDF_NAME(Separation)) ||
+                     pdf_name_eq(ctx, family, PDF_NAME(DeviceN)))
+                alt = pdf_array_get(ctx, cs, 2);
+        }
+        info->altcs = gomupdf_cs_name(ctx, alt);
+        if (pdf_is_array(ctx, filter))
+            filter = pdf_array_get(ctx, filter, 0);
+        info->filter = pdf_to_name(ctx, filter);
+        *errcode = 0;
+    }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); }
+}
+
+// ============================================================
+// Image placement (processor that records where an image is drawn)
+// ============================================================
+
+/* Interprets content streams, following the current transformation matrix
+   and resources, and records the matrix of every Do of the image xref. */
+typedef struct {
+    pdf_processor super;
+    pdf_document *doc;
+    int xref;
+    fz_matrix ctm;
+    fz_matrix *gstack;
+    int glen, gcap;
+    pdf_obj **rstack;
+    int rlen, rcap;
+    pdf_cycle_list *forms;
+    fz_matrix *ctms;
+    int len, cap;
+} gomupdf_image_proc;
+
+static void gomupdf_image_proc_push_resources(fz_context *ctx, pdf_processor *proc_, pdf_obj *res) {
+    gomupdf_image_proc *proc = (gomupdf_image_proc *)proc_;
+    if (proc->rlen == proc->rcap) {
+        int cap = proc->rcap ? proc->rcap * 2 : 4;
+        proc->rstack = fz_realloc(ctx, proc->rstack, cap * sizeof(pdf_obj *));
+        proc->rcap = cap;
+    }
+    proc->rstack[proc->rlen++] = pdf_keep_obj(ctx, res);
+}
+
+static pdf_obj* gomupdf_image_proc_pop_resources(fz_context *ctx, pdf_processor *proc_) {
+    gomupdf_image_proc *proc = (gomupdf_image_proc *)proc_;
+    return proc->rlen > 0 ? proc->rstack[--proc->rlen] : NULL;
+}
+
+static void gomupdf_image_proc_q(fz_context *ctx, pdf_processor *proc_) {
+    gomupdf_image_proc *proc = (gomupdf_image_proc *)proc_;
+    if (proc->glen == proc->gcap) {
+        int cap = proc->gcap ? proc->gcap * 2 : 8;
+        proc->gstack = fz_realloc(ctx, proc->gstack, cap * sizeof(fz_matrix));
+        proc->gcap = cap;
+    }
+    proc->gstack[proc->glen++] = proc->ctm;
+}
+
+static void gomupdf_image_proc_Q(fz_context *ctx, pdf_processor *proc_) {
+    gomupdf_image_proc *proc = (gomupdf_image_proc *)proc_;
+    if (proc->glen > 0)
+        proc->ctm = proc->gstack[--proc->glen];
+}
+
+static void gomupdf_image_proc_cm(fz_context *ctx, pdf_processor *proc_,
+    float a, float b, float c, float d, float e, float f) {
+    gomupdf_image_proc *proc = (gomupdf_image_proc *)proc_;
+    proc->ctm = fz_concat(fz_make_matrix(a, b, c, d, e, f), proc->ctm);
+}
+
+static void gomupdf_image_proc_Do_image(fz_context *ctx, pdf_processor *proc_,
+    const char *name, fz_image *image) {
+    gomupdf_image_proc *proc = (gomupdf_image_proc *)proc_;
+    if (proc->rlen == 0 || !name) return;
+    pdf_obj *xobjs = pdf_dict_get(ctx, proc->rstack[proc->rlen - 1], PDF_NAME(XObject));
+    if (pdf_to_num(ctx, pdf_dict_gets(ctx, xobjs, name)) != proc->xref) return;
+    if (proc->len == proc->cap) {
+        int cap = proc->cap ? proc->cap * 2 : 4;
+        proc->ctms = fz_realloc(ctx, proc->ctms, cap * sizeof(fz_matrix));
+        proc->cap = cap;
+    }
+    /* PDF images are drawn bottom-up into the unit square. */
+    proc->ctms[proc->len++] = fz_pre_scale(fz_pre_translate(proc->ctm, 0, 1), 1, -1);
+}
+
+static void gomupdf_image_proc_Do_form(fz_context *ctx, pdf_processor *proc_,
+    const char *name, pdf_obj *form) {
+    gomupdf_image_proc *proc = (gomupdf_image_proc *)proc_;
+    pdf_cycle_list cycle;
+    pdf_cycle_list *up = proc->forms;
+    fz_matrix ctm = proc->ctm;
+    int glen = proc->glen;
+    pdf_obj *res;
+    if (pdf_cycle(ctx, &cycle, up, form)) return;
+    res = pdf_xobject_resources(ctx, form);
+    if (!res && proc->rlen > 0)
+        res = proc->rstack[proc->rlen - 1];
+    proc->forms = &cycle;
+    proc->ctm = fz_concat(pdf_xobject_matrix(ctx, form), proc->ctm);
+    fz_try(ctx)
+        pdf_process_contents(ctx, proc_, proc->doc, res, form, NULL, NULL);
+    fz_always(ctx) {
+        proc->forms = up;
+        proc->ctm = ctm;
+        proc->glen = glen;
+    }
+    fz_catch(ctx)
+        fz_rethrow(ctx);
+}
+
+static void gomupdf_image_proc_drop(fz_context *ctx, pdf_processor *proc_) {
+    gomupdf_image_proc *proc = (gomupdf_image_proc *)proc_;
+    while (proc->rlen > 0)
+        pdf_drop_obj(ctx, proc->rstack[--proc->rlen]);
+    fz_free(ctx, proc->rstack);
+    fz_free(ctx, proc->gstack);
+    fz_free(ctx, proc->ctms);
+}
+
+/* Returns the matrices with which the image XObject xref is drawn on the
+   page and its annotations. The XObject is matched by its xref wherever a
+   content stream draws it, including inside Form XObjects; images are not
+   decoded. The returned array must be freed with gomupdf_free. */
+static fz_matrix* gomupdf_image_placements(fz_context *ctx, pdf_document *pdf, fz_page *page,
+    int xref, int *count, int *errcode) {
+    gomupdf_image_proc *proc = NULL;
+    pdf_obj *ref = NULL;
+    fz_matrix *result = NULL;
+    fz_matrix page_ctm;
+    pdf_obj *contents;
+    *count = 0;
+    fz_var(proc);
+    fz_var(ref);
+    fz_try(ctx) {
+        pdf_page *ppage = pdf_page_from_fz_page(ctx, page);
+        ref = pdf_new_indirect(ctx, pdf, xref, 0);
+        if (!pdf_name_eq(ctx, pdf_dict_get(ctx, ref, PDF_NAME(Subtype)), PDF_NAME(Image)))
+            fz_throw(ctx, FZ_ERROR_ARGUMENT, "object %d is not an image", xref);
+        proc = pdf_new_processor(ctx, sizeof *proc);
+        proc->super.drop_processor = gomupdf_image_proc_drop;
+        proc->super.push_resources = gomupdf_image_proc_push_resources;
+        proc->super.pop_resources = gomupdf_image_proc_pop_resources;
+        proc->super.op_q = gomupdf_image_proc_q;
+        proc->super.op_Q = gomupdf_image_proc_Q;
+        proc->super.op_cm = gomupdf_image_proc_cm;
+        proc->super.op_Do_image = gomupdf_image_proc_Do_image;
+        proc->super.op_Do_form = gomupdf_image_proc_Do_form;
+        proc->super.usage = "View";
+        proc->doc = pdf;
+        proc->xref = xref;
+        pdf_page_transform(ctx, ppage, NULL, &page_ctm);
+        proc->ctm = page_ctm;
+        contents = pdf_page_contents(ctx, ppage);
+        if (contents)
+            pdf_process_contents(ctx, &proc->super, pdf, pdf_page_resources(ctx, ppage),
+                contents, NULL, NULL);
+        /* Annotations start from the page matrix, whatever the contents left. */
+        for (pdf_annot *annot = pdf_first_annot(ctx, ppage); annot; annot = pdf_next_annot(ctx, annot)) {
+            proc->ctm = page_ctm;
+            proc->glen = 0;
+            pdf_process_annot(ctx, &proc->super, annot, NULL);
+        }
+        pdf_close_processor(ctx, &proc->super);
+        result = proc->ctms;
+        *count = proc->len;
+        proc->ctms = NULL;
+        *errcode = 0;
+    }
+    fz_always(ctx) {
+        pdf_drop_processor(ctx, (pdf_processor *)proc);
+        pdf_drop_obj(ctx, ref);
+    }
+    fz_catch(ctx) {
+        *count = 0;
+        *errcode = gomupdf_caught(ctx);
+    }
+    return result;
+}
+
+// ============================================================
+// Vector drawings (device that records filled and stroked paths)
+// ============================================================
+
+enum {
+    GOMUPDF_PATH_MOVE,
+    GOMUPDF_PATH_LINE,
+    GOMUPDF_PATH_CURVE,
+    GOMUPDF_PATH_RECT,
+    GOMUPDF_PATH_QUAD
+};
+
+/* One path segment. Lines use two points, curves four; rects and quads
+   store their corners as ul, ur, ll, lr. */
+typedef struct {
+    int kind;
+    float p[8];
+} gomupdf_path_item;
+
+/* Appends the segments of paths to items, transformed by ctm. */
+typedef struct {
+    gomupdf_path_item *items;
+    int len, cap;
+    fz_matrix ctm;
+    fz_point start, current;
+    int closed; /* the last subpath ended with closepath */
+} gomupdf_path_collector;
+
+static void gomupdf_path_add(fz_context *ctx, gomupdf_path_collector *pc, int kind,
+    int n, const fz_point *pts) {
+    gomupdf_path_item *item;
+    int i;
+    if (pc->len == pc->cap) {
+        int cap = pc->cap ? pc->cap * 2 : 32;
+        pc->items = fz_realloc(ctx, pc->items, cap * sizeof(gomupdf_path_item));
+        pc->cap = cap;
+    }
+    item = &pc->items[pc->len++];
+    memset(item, 0, sizeof *item);
+    item->kind = kind;
+    for (i = 0; i < n; i++) {
+        fz_point p = fz_transform_point(pts[i], pc->ctm);
+        item->p[2 * i] = p.x;
+        item->p[2 * i + 1] = p.y;
+    }
+}
+
+static void gomupdf_path_moveto(fz_context *ctx, void *arg, float x, float y) {
+    gomupdf_path_collector *pc = arg;
+    fz_point p = fz_make_point(x, y);
+    gomupdf_path_add(ctx, pc, GOMUPDF_PATH_MOVE, 1, &p);
+    pc->start = pc->current = p;
+    pc->closed = 0;
+}
+
+static void gomupdf_path_lineto(fz_context *ctx, void *arg, float x, float y) {
+    gomupdf_path_collector *pc = arg;
+    fz_point pts[2] = { pc->current, fz_make_point(x, y) };
+    gomupdf_path_add(ctx, pc, GOMUPDF_PATH_LINE, 2, pts);
+    pc->current = pts[1];
+    pc->closed = 0;
+}
+
+static void gomupdf_path_curveto(fz_context *ctx, void *arg, float x1, float y1,
+    float x2, float y2, float x3, float y3) {
+    gomupdf_path_collector *pc = arg;
+    fz_point pts[4] = { pc->current, fz_make_point(x1, y1), fz_make_point(x2, y2), fz_make_point(x3, y3) };
+    gomupdf_path_add(ctx, pc, GOMUPDF_PATH_CURVE, 4, pts);
+    pc->current = pts[3];
+    pc->closed = 0;
+}
+
+static void gomupdf_path_closepath(fz_context *ctx, void *arg) {
+    gomupdf_path_collector *pc = arg;
+    if (pc->current.x != pc->start.x || pc->current.y != pc->start.y) {
+        fz_point pts[2] = { pc->current, pc->start };
+        gomupdf_path_add(ctx, pc, GOMUPDF_PATH_LINE, 2, pts);
+        pc->current = pc->start;
+    }
+    pc->closed = 1;
+}
+
+static void gomupdf_path_rectto(fz_context *ctx, void *arg, float x0, float y0, float x1, float y1) {
+    gomupdf_path_collector *pc = arg;
+    fz_point pts[4] = { fz_make_point(x0, y0), fz_make_point(x1, y0), fz_make_point(x0, y1), fz_make_point(x1, y1) };
+    /* A rectangle stays one under rotations by multiples of 90 degrees. */
+    gomupdf_path_add(ctx, pc, fz_is_rectilinear(pc->ctm) ? GOMUPDF_PATH_RECT : GOMUPDF_PATH_QUAD, 4, pts);
+    pc->start = pc->current = pts[0];
+    pc->closed = 0;
+}
+
+static const fz_path_walker gomupdf_path_walker = {
+    gomupdf_path_moveto,
+    gomupdf_path_lineto,
+    gomupdf_path_curveto,
+    gomupdf_path_closepath,
+    NULL, NULL, NULL,
+    gomupdf_path_rectto
+};
+
+/* Appends the segments of path and returns how many were added. */
+static int gomupdf_collect_path(fz_context *ctx, gomupdf_path_collector *pc, const fz_path *path, fz_matrix ctm) {
+    int start = pc->len;
+    pc->ctm = ctm;
+    pc->start = pc->current = fz_make_point(0, 0);
+    pc->closed = 0;
+    fz_walk_path(ctx, path, &gomupdf_path_walker, pc);
+    return pc->len - start;
+}
+
+typedef struct {
+    int fill, stroke;
+    int item_start, item_count;
+    fz_rect rect;
+    float color[3], fill_color[3];
+    float stroke_alpha, fill_alpha;
+    float width, dash_phase;
+    float dashes[32];
+    int dash_count;
+    int cap, join;
+    int even_odd, close_path;
+} gomupdf_drawing;
+
+typedef struct {
+    fz_device super;
+    gomupdf_drawing *drawings;
+    int len, cap;
+    gomupdf_path_collector path;
+} gomupdf_drawing_device;
+
+static void gomupdf_drawing_rgb(fz_context *ctx, fz_colorspace *cs, const float *color,
+    fz_color_params cp, float rgb[3]) {
+    rgb[0] = rgb[1] = rgb[2] = 0;
+    if (cs && color)
+        fz_convert_color(ctx, cs, color, fz_device_rgb(ctx), rgb, NULL, cp);
+}
+
+static void gomupdf_drawing_add(fz_context *ctx, gomupdf_drawing_device *dev, const fz_path *path,
+    const fz_stroke_state *stroke, int even_odd, fz_matrix ctm, fz_colorspace *cs,
+    const float *color, float alpha, fz_color_params cp) {
+    gomupdf_drawing *d;
+    gomupdf_path_item *items = NULL;
+    int start = dev->path.len;
+    int count = gomupdf_collect_path(ctx, &dev->path, path, ctm);
+    if (count == 0) return;
+    items = dev->path.items;
+
+    /* The B operators fill a path and then stroke the same path; report
+       that as a single drawing. */
+    d = NULL;
+    if (stroke && dev->len > 0) {
+        gomupdf_drawing *prev = &dev->drawings[dev->len - 1];
+        if (prev->fill && !prev->stroke && prev->item_count == count &&
+            !memcmp(&items[prev->item_start], &items[start], count * sizeof(gomupdf_path_item))) {
+            dev->path.len = start;
+            d = prev;
+        }
+    }
+    if (!d) {
+        if (dev->len == dev->cap) {
+            int cap = dev->cap ? dev->cap * 2 : 16;
+            dev->drawings = fz_realloc(ctx, dev->drawings, cap * sizeof(gomupdf_drawing));
+            dev->cap = cap;
+        }
+        d = &dev->drawings[dev->len++];
+        memset(d, 0, sizeof *d);
+        d->item_start = start;
+        d->item_count = count;
+        d->close_path = dev->path.closed;
+    }
+
+    if (stroke) {
+        float expansion = fz_matrix_expansion(ctm);
+        int i;
+        d->stroke = 1;
+        gomupdf_drawing_rgb(ctx, cs, color, cp, d->color);
+        d->stroke_alpha = alpha;
+        d->width = stroke->linewidth * expansion;
+        d->cap = stroke->start_cap;
+        d->join = stroke->linejoin == FZ_LINEJOIN_MITER_XPS ? FZ_LINEJOIN_MITER : stroke->linejoin;
+        d->dash_count = fz_mini(stroke->dash_len, 32);
+        for (i = 0; i < d->dash_count; i++)
+            d->dashes[i] = stroke->dash_list[i] * expansion;
+        d->dash_phase = stroke->dash_phase * expansion;
+        d->rect = fz_bound_path(ctx, path, stroke, ctm);
+    } else {
+        d->fill = 1;
+        gomupdf_drawing_rgb(ctx, cs, color, cp, d->fill_color);
+        d->fill_alpha = alpha;
+        d->even_odd = even_odd;
+        d->rect = fz_bound_path(ctx, path, NULL, ctm);
+    }
+}
+
+static void gomupdf_drawing_fill_path(fz_context *ctx, fz_device *dev, const fz_path *path,
+    int even_odd, fz_matrix ctm, fz_colorspace *cs, const float *color, float alpha,
+    fz_color_params cp) {
+    gomupdf_drawing_add(ctx, (gomupdf_drawing_device *)dev, path, NULL, even_odd, ctm, cs, color, alpha, cp);
+}
+
+static void gomupdf_drawing_stroke_path(fz_context *ctx, fz_device *dev, const fz_path *path,
+    const fz_stroke_state *stroke, fz_matrix ctm, fz_colorspace *cs, const float *color,
+    float alpha, fz_color_params cp) {
+    gomupdf_drawing_add(ctx, (gomupdf_drawing_device *)dev, path, stroke, 0, ctm, cs, color, alpha, cp);
+}
+
+/* Runs the page through a device that records every filled or stroked
+   path in page coordinates. Both returned arrays must be freed with
+   gomupdf_free. */
+static gomupdf_drawing* gomupdf_page_drawings(fz_context *ctx, fz_page *page, int *count,
+    gomupdf_path_item **items, int *nitems, int *errcode) {
+    gomupdf_drawing_device *dev = NULL;
+    gomupdf_drawing *result = NULL;
+    *count = *nitems = 0;
+    *items = NULL;
+    fz_var(dev);
+    fz_try(ctx) {
+        dev = fz_new_derived_device(ctx, gomupdf_drawing_device);
+        dev->super.fill_path = gomupdf_drawing_fill_path;
+        dev->super.stroke_path = gomupdf_drawing_stroke_path;
+        fz_run_page(ctx, page, &dev->super, fz_identity, NULL);
+        fz_close_device(ctx, &dev->super);
+        result = dev->drawings;
+        *count = dev->len;
+        *items = dev->path.items;
+        *nitems = dev->path.len;
+        dev->drawings = NULL;
+        dev->path.items = NULL;
+        *errcode = 0;
+    }
+    fz_always(ctx) {
+        if (dev) {
+            fz_free(ctx, dev->drawings);
+            fz_free(ctx, dev->path.items);
+        }
+        fz_drop_device(ctx, (fz_device *)dev);
+    }
+    fz_catch(ctx) {
+        *count = *nitems = 0;
+        *errcode = gomupdf_caught(ctx);
+    }
     return result;
 }
 
+// ============================================================
+// Go devices (Page.Run)
+// ============================================================
+
+enum {
+    GOMUPDF_DEV_FILL_PATH,
+    GOMUPDF_DEV_STROKE_PATH,
+    GOMUPDF_DEV_CLIP_PATH,
+    GOMUPDF_DEV_CLIP_STROKE_PATH,
+    GOMUPDF_DEV_FILL_TEXT,
+    GOMUPDF_DEV_STROKE_TEXT,
+    GOMUPDF_DEV_CLIP_TEXT,
+    GOMUPDF_DEV_CLIP_STROKE_TEXT,
+    GOMUPDF_DEV_IGNORE_TEXT,
+    GOMUPDF_DEV_FILL_SHADE,
+    GOMUPDF_DEV_FILL_IMAGE,
+    GOMUPDF_DEV_FILL_IMAGE_MASK,
+    GOMUPDF_DEV_CLIP_IMAGE_MASK,
+    GOMUPDF_DEV_POP_CLIP,
+    GOMUPDF_DEV_BEGIN_MASK,
+    GOMUPDF_DEV_END_MASK,
+    GOMUPDF_DEV_BEGIN_GROUP,
+    GOMUPDF_DEV_END_GROUP
+};
+
+/* Arguments of one device callback. Only the fields used by op are set. */
+typedef struct {
+    int op;
+    fz_context *ctx;
+    fz_matrix ctm;
+    fz_rect rect; /* scissor, mask or group area, or shading bounds */
+    const gomupdf_path_item *items;
+    int nitems;
+    int even_odd;
+    const fz_stroke_state *stroke;
+    const fz_text *text;
+    fz_image *image;
+    int has_color;
+    const char *colorspace;
+    int n;
+    float color[FZ_MAX_COLORS];
+    float rgb[3];
+    float alpha;
+    int isolated, knockout, luminosity;
+    const char *blendmode;
+} gomupdf_device_call;
+
+/* Implemented in Go (device.go). Passes call to the Device behind handle.
+   Returns non-zero if the Device panicked. */
+extern int gomupdfDeviceCall(uintptr_t handle, gomupdf_device_call *call);
+
+typedef struct {
+    fz_device super;
+    uintptr_t handle;
+    gomupdf_path_collector path;
+} gomupdf_go_device;
+
+static void gomupdf_go_device_send(fz_context *ctx, fz_device *dev_, gomupdf_device_call *call) {
+    gomupdf_go_device *dev = (gomupdf_go_device *)dev_;
+    call->ctx = ctx;
+    if (gomupdfDeviceCall(dev->handle, call))
+        fz_throw(ctx, FZ_ERROR_ABORT, "device callback panicked");
+}
+
+/* Paths are passed untransformed; call->ctm maps them to device space. */
+static void gomupdf_go_device_path(fz_context *ctx, fz_device *dev_, gomupdf_device_call *call, const fz_path *path) {
+    gomupdf_go_device *dev = (gomupdf_go_device *)dev_;
+    dev->path.len = 0;
+    call->nitems = gomupdf_collect_path(ctx, &dev->path, path, fz_identity);
+    call->items = dev->path.items;
+}
+
+static void gomupdf_go_device_color(fz_context *ctx, gomupdf_device_call *call, fz_colorspace *cs,
+    const float *color, float alpha, fz_color_params cp) {
+    call->alpha = alpha;
+    if (!cs || !color) return;
+    call->has_color = 1;
+    call->colorspace = fz_colorspace_name(ctx, cs);
+    call->n = fz_mini(fz_colorspace_n(ctx, cs), FZ_MAX_COLORS);
+    memcpy(call->color, color, call->n * sizeof(float));
+    fz_convert_color(ctx, cs, color, fz_device_rgb(ctx), call->rgb, NULL, cp);
+}
+
+static void gomupdf_go_fill_path(fz_context *ctx, fz_device *dev, const fz_path *path, int even_odd,
+    fz_matrix ctm, fz_colorspace *cs, const float *color, float alpha, fz_color_params cp) {
+    gomupdf_device_call call = { GOMUPDF_DEV_FILL_PATH };
+    call.ctm = ctm;
+    call.even_odd = even_odd;
+    gomupdf_go_device_path(ctx, dev, &call, path);
+    gomupdf_go_device_color(ctx, &call, cs, color, alpha, cp);
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_stroke_path(fz_context *ctx, fz_device *dev, const fz_path *path,
+    const fz_stroke_state *stroke, fz_matrix ctm, fz_colorspace *cs, const float *color,
+    float alpha, fz_color_params cp) {
+    gomupdf_device_call call = { GOMUPDF_DEV_STROKE_PATH };
+    call.ctm = ctm;
+    call.stroke = stroke;
+    gomupdf_go_device_path(ctx, dev, &call, path);
+    gomupdf_go_device_color(ctx, &call, cs, color, alpha, cp);
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_clip_path(fz_context *ctx, fz_device *dev, const fz_path *path, int even_odd,
+    fz_matrix ctm, fz_rect scissor) {
+    gomupdf_device_call call = { GOMUPDF_DEV_CLIP_PATH };
+    call.ctm = ctm;
+    call.even_odd = even_odd;
+    call.rect = scissor;
+    gomupdf_go_device_path(ctx, dev, &call, path);
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_clip_stroke_path(fz_context *ctx, fz_device *dev, const fz_path *path,
+    const fz_stroke_state *stroke, fz_matrix ctm, fz_rect scissor) {
+    gomupdf_device_call call = { GOMUPDF_DEV_CLIP_STROKE_PATH };
+    call.ctm = ctm;
+    call.stroke = stroke;
+    call.rect = scissor;
+    gomupdf_go_device_path(ctx, dev, &call, path);
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_fill_text(fz_context *ctx, fz_device *dev, const fz_text *text, fz_matrix ctm,
+    fz_colorspace *cs, const float *color, float alpha, fz_color_params cp) {
+    gomupdf_device_call call = { GOMUPDF_DEV_FILL_TEXT };
+    call.ctm = ctm;
+    call.text = text;
+    gomupdf_go_device_color(ctx, &call, cs, color, alpha, cp);
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_stroke_text(fz_context *ctx, fz_device *dev, const fz_text *text,
+    const fz_stroke_state *stroke, fz_matrix ctm, fz_colorspace *cs, const float *color,
+    float alpha, fz_color_params cp) {
+    gomupdf_device_call call = { GOMUPDF_DEV_STROKE_TEXT };
+    call.ctm = ctm;
+    call.text = text;
+    call.stroke = stroke;
+    gomupdf_go_device_color(ctx, &call, cs, color, alpha, cp);
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_clip_text(fz_context *ctx, fz_device *dev, const fz_text *text, fz_matrix ctm,
+    fz_rect scissor) {
+    gomupdf_device_call call = { GOMUPDF_DEV_CLIP_TEXT };
+    call.ctm = ctm;
+    call.text = text;
+    call.rect = scissor;
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_clip_stroke_text(fz_context *ctx, fz_device *dev, const fz_text *text,
+    const fz_stroke_state *stroke, fz_matrix ctm, fz_rect scissor) {
+    gomupdf_device_call call = { GOMUPDF_DEV_CLIP_STROKE_TEXT };
+    call.ctm = ctm;
+    call.text = text;
+    call.stroke = stroke;
+    call.rect = scissor;
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_ignore_text(fz_context *ctx, fz_device *dev, const fz_text *text, fz_matrix ctm) {
+    gomupdf_device_call call = { GOMUPDF_DEV_IGNORE_TEXT };
+    call.ctm = ctm;
+    call.text = text;
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_fill_shade(fz_context *ctx, fz_device *dev, fz_shade *shade, fz_matrix ctm,
+    float alpha, fz_color_params cp) {
+    gomupdf_device_call call = { GOMUPDF_DEV_FILL_SHADE };
+    call.ctm = ctm;
+    call.rect = fz_bound_shade(ctx, shade, ctm);
+    call.alpha = alpha;
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_fill_image(fz_context *ctx, fz_device *dev, fz_image *image, fz_matrix ctm,
+    float alpha, fz_color_params cp) {
+    gomupdf_device_call call = { GOMUPDF_DEV_FILL_IMAGE };
+    call.ctm = ctm;
+    call.image = image;
+    call.alpha = alpha;
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_fill_image_mask(fz_context *ctx, fz_device *dev, fz_image *image, fz_matrix ctm,
+    fz_colorspace *cs, const float *color, float alpha, fz_color_params cp) {
+    gomupdf_device_call call = { GOMUPDF_DEV_FILL_IMAGE_MASK };
+    call.ctm = ctm;
+    call.image = image;
+    gomupdf_go_device_color(ctx, &call, cs, color, alpha, cp);
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_clip_image_mask(fz_context *ctx, fz_device *dev, fz_image *image, fz_matrix ctm,
+    fz_rect scissor) {
+    gomupdf_device_call call = { GOMUPDF_DEV_CLIP_IMAGE_MASK };
+    call.ctm = ctm;
+    call.image = image;
+    call.rect = scissor;
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_pop_clip(fz_context *ctx, fz_device *dev) {
+    gomupdf_device_call call = { GOMUPDF_DEV_POP_CLIP };
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_begin_mask(fz_context *ctx, fz_device *dev, fz_rect area, int luminosity,
+    fz_colorspace *cs, const float *bc, fz_color_params cp) {
+    gomupdf_device_call call = { GOMUPDF_DEV_BEGIN_MASK };
+    call.rect = area;
+    call.luminosity = luminosity;
+    gomupdf_go_device_color(ctx, &call, cs, bc, 1, cp);
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_end_mask(fz_context *ctx, fz_device *dev, fz_function *fn) {
+    gomupdf_device_call call = { GOMUPDF_DEV_END_MASK };
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_begin_group(fz_context *ctx, fz_device *dev, fz_rect area, fz_colorspace *cs,
+    int isolated, int knockout, int blendmode, float alpha) {
+    gomupdf_device_call call = { GOMUPDF_DEV_BEGIN_GROUP };
+    call.rect = area;
+    call.isolated = isolated;
+    call.knockout = knockout;
+    call.blendmode = fz_blendmode_name(blendmode);
+    call.alpha = alpha;
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_end_group(fz_context *ctx, fz_device *dev) {
+    gomupdf_device_call call = { GOMUPDF_DEV_END_GROUP };
+    gomupdf_go_device_send(ctx, dev, &call);
+}
+
+static void gomupdf_go_drop_device(fz_context *ctx, fz_device *dev) {
+    fz_free(ctx, ((gomupdf_go_device *)dev)->path.items);
+}
+
+/* Replays a display list through a device that forwards every callback
+   to the Go Device behind handle. */
+static int gomupdf_run_go_device(fz_context *ctx, fz_display_list *list, uintptr_t handle,
+    float a, float b, float c, float d, float e, float f, fz_cookie *cookie) {
+    gomupdf_go_device *dev = NULL;
+    int errcode = 0;
+    fz_var(dev);
+    fz_try(ctx) {
+        dev = fz_new_derived_device(ctx, gomupdf_go_device);
+        dev->handle = handle;
+        dev->super.drop_device = gomupdf_go_drop_device;
+        dev->super.fill_path = gomupdf_go_fill_path;
+        dev->super.stroke_path = gomupdf_go_stroke_path;
+        dev->super.clip_path = gomupdf_go_clip_path;
+        dev->super.clip_stroke_path = gomupdf_go_clip_stroke_path;
+        dev->super.fill_text = gomupdf_go_fill_text;
+        dev->super.stroke_text = gomupdf_go_stroke_text;
+        dev->super.clip_text = gomupdf_go_clip_text;
+        dev->super.clip_stroke_text = gomupdf_go_clip_stroke_text;
+        dev->super.ignore_text = gomupdf_go_ignore_text;
+        dev->super.fill_shade = gomupdf_go_fill_shade;
+        dev->super.fill_image = gomupdf_go_fill_image;
+        dev->super.fill_image_mask = gomupdf_go_fill_image_mask;
+        dev->super.clip_image_mask = gomupdf_go_clip_image_mask;
+        dev->super.pop_clip = gomupdf_go_pop_clip;
+        dev->super.begin_mask = gomupdf_go_begin_mask;
+        dev->super.end_mask = gomupdf_go_end_mask;
+        dev->super.begin_group = gomupdf_go_begin_group;
+        dev->super.end_group = gomupdf_go_end_group;
+        fz_run_display_list(ctx, list, &dev->super, fz_make_matrix(a, b, c, d, e, f), fz_infinite_rect, cookie);
+        fz_close_device(ctx, &dev->super);
+    }
+    fz_always(ctx) { fz_drop_device(ctx, (fz_device *)dev); }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
+    return errcode;
+}
+
+/* Accessors for fz_text_span bit-fields, which cgo cannot read. */
+static int gomupdf_text_span_wmode(const fz_text_span *span) { return span->wmode; }
+static int gomupdf_text_span_bidi_level(const fz_text_span *span) { return span->bidi_level; }
+
+/* Information about an image passed to a device. */
+typedef struct {
+    int width, height, bpc, n, xres, yres, imagemask;
+    const char *colorspace;
+} gomupdf_device_image;
+
+static void gomupdf_device_image_info(fz_context *ctx, fz_image *image, gomupdf_device_image *info) {
+    info->width = image->w;
+    info->height = image->h;
+    info->bpc = image->bpc;
+    info->n = image->n;
+    info->xres = image->xres;
+    info->yres = image->yres;
+    info->imagemask = image->imagemask;
+    info->colorspace = image->colorspace ? fz_colorspace_name(ctx, image->colorspace) : "";
+}
+
+// ============================================================
+// Image extraction
+// ============================================================
+
+typedef struct {
+    int width, height, bpc, n, smask;
+    const char *ext;
+    char colorspace[64];
+} gomupdf_extracted_image;
+
+/* Returns the image XObject xref as a file. JPEG, JPX and JBIG2 streams are
+   returned as stored; other images are decoded and encoded as PNG, after
+   conversion to RGB if PNG cannot hold their colorspace. With merge_smask,
+   the soft mask becomes the PNG's alpha channel. */
+static unsigned char* gomupdf_extract_image(fz_context *ctx, pdf_document *pdf, int xref,
+    int merge_smask, gomupdf_extracted_image *info, int *outlen, int *errcode) {
+    pdf_obj *ref = NULL;
+    fz_image *image = NULL;
+    fz_pixmap *pix = NULL, *mask = NULL, *tmp = NULL;
+    fz_buffer *buf = NULL;
+    unsigned char *data = NULL;
+    *outlen = 0;
+    fz_var(ref);
+    fz_var(image);
+    fz_var(pix);
+    fz_var(mask);
+    fz_var(tmp);
+    fz_var(buf);
+    fz_var(data);
+    fz_try(ctx) {
+        ref = pdf_new_indirect(ctx, pdf, xref, 0);
+        if (!pdf_name_eq(ctx, pdf_dict_get(ctx, ref, PDF_NAME(Subtype)), PDF_NAME(Image)))
+            fz_throw(ctx, FZ_ERROR_ARGUMENT, "object %d is not an image", xref);
+        info->smask = pdf_to_num(ctx, pdf_dict_get(ctx, ref, PDF_NAME(SMask)));
+        image = pdf_load_image(ctx, pdf, ref);
+
+        fz_compressed_buffer *cbuf = fz_compressed_image_buffer(ctx, image);
+        int type = cbuf ? cbuf->params.type : FZ_IMAGE_UNKNOWN;
+        fz_colorspace *cs;
+        if (!(merge_smask && image->mask) &&
+            (type == FZ_IMAGE_JPEG || type == FZ_IMAGE_JPX || type == FZ_IMAGE_JBIG2)) {
+            buf = fz_keep_buffer(ctx, cbuf->buffer);
+            info->ext = type == FZ_IMAGE_JPEG ? "jpeg" : type == FZ_IMAGE_JPX ? "jpx" : "jb2";
+            info->width = image->w;
+            info->height = image->h;
+            info->bpc = image->bpc;
+            info->n = image->n;
+            cs = image->colorspace;
+        } else {
+            pix = fz_get_pixmap_from_image(ctx, image, NULL, NULL, NULL, NULL);
+            if (pix->colorspace && !fz_colorspace_is_gray(ctx, pix->colorspace) &&
+                !fz_colorspace_is_rgb(ctx, pix->colorspace)) {
+                tmp = fz_convert_pixmap(ctx, pix, fz_device_rgb(ctx), NULL, NULL,
+                    fz_default_color_params, 1);
+                fz_drop_pixmap(ctx, pix);
+                pix = tmp;
+                tmp = NULL;
+            }
+            if (merge_smask && image->mask && !pix->alpha) {
+                mask = fz_get_pixmap_from_image(ctx, image->mask, NULL, NULL, NULL, NULL);
+                if (mask->w != pix->w || mask->h != pix->h) {
+                    tmp = fz_scale_pixmap(ctx, mask, 0, 0, pix->w, pix->h, NULL);
+                    fz_drop_pixmap(ctx, mask);
+                    mask = tmp;
+                    tmp = NULL;
+                }
+                tmp = fz_new_pixmap_from_color_and_mask(ctx, pix, mask);
+                fz_drop_pixmap(ctx, pix);
+                pix = tmp;
+                tmp = NULL;
+            }
+            buf = fz_new_buffer_from_pixmap_as_png(ctx, pix, fz_default_color_params);
+            info->ext = "png";
+            info->width = pix->w;
+            info->height = pix->h;
+            info->bpc = 8;
+            info->n = pix->n;
+            cs = pix->colorspace;
+        }
+        fz_strlcpy(info->colorspace, cs ? fz_colorspace_name(ctx, cs) : "",
+            sizeof info->colorspace);
+
+        unsigned char *bufdata;
+        size_t len = fz_buffer_storage(ctx, buf, &bufdata);
+        data = (unsigned char*)fz_malloc(ctx, len ? len : 1);
+        memcpy(data, bufdata, len);
+        *outlen = (int)len;
+        *errcode = 0;
+    }
+    fz_always(ctx) {
+        fz_drop_buffer(ctx, buf);
+        fz_drop_pixmap(ctx, tmp);
+        fz_drop_pixmap(ctx, mask);
+        fz_drop_pixmap(ctx, pix);
+        fz_drop_image(ctx, image);
+        pdf_drop_obj(ctx, ref);
+    }
+    fz_catch(ctx) {
+        fz_free(ctx, data);
+        data = NULL;
+        *outlen = 0;
+        *errcode = gomupdf_caught(ctx);
+    }
+    return data;
+}
+
+// ============================================================
+// Image replacement
+// ============================================================
+
+/* Rewrites the image XObject xref in place with the given image, so every
+   placement of it changes. If data is NULL, a transparent 1x1 image is
+   used instead. */
+static int gomupdf_replace_image(fz_context *ctx, pdf_document *pdf, int xref,
+    const unsigned char *data, int len) {
+    int errcode = 0;
+    pdf_obj *ref = NULL, *newref = NULL, *dict = NULL;
+    fz_buffer *buf = NULL, *stm = NULL;
+    fz_pixmap *pix = NULL;
+    fz_image *image = NULL;
+    fz_var(ref);
+    fz_var(newref);
+    fz_var(dict);
+    fz_var(buf);
+    fz_var(stm);
+    fz_var(pix);
+    fz_var(image);
+    fz_try(ctx) {
+        ref = pdf_new_indirect(ctx, pdf, xref, 0);
+        if (!pdf_name_eq(ctx, pdf_dict_get(ctx, ref, PDF_NAME(Subtype)), PDF_NAME(Image)))
+            fz_throw(ctx, FZ_ERROR_ARGUMENT, "object %d is not an image", xref);
+        if (data) {
+            buf = fz_new_buffer_from_copied_data(ctx, data, len);
+            image = fz_new_image_from_buffer(ctx, buf);
+        } else {
+            pix = fz_new_pixmap(ctx, fz_device_rgb(ctx), 1, 1, NULL, 1);
+            fz_clear_pixmap(ctx, pix);
+            image = fz_new_image_from_pixmap(ctx, pix, NULL);
+        }
+        newref = pdf_add_image(ctx, pdf, image);
+        dict = pdf_copy_dict(ctx, pdf_resolve_indirect(ctx, newref));
+        stm = pdf_load_raw_stream(ctx, newref);
+        pdf_update_object(ctx, pdf, xref, dict);
+        pdf_update_stream(ctx, pdf, ref, stm, 1);
+        pdf_delete_object(ctx, pdf, pdf_to_num(ctx, newref));
+        pdf_remove_item(ctx, fz_drop_image_imp, ref);
+    }
+    fz_always(ctx) {
+        fz_drop_buffer(ctx, stm);
+        pdf_drop_obj(ctx, dict);
+        pdf_drop_obj(ctx, newref);
+        fz_drop_image(ctx, image);
+        fz_drop_pixmap(ctx, pix);
+        fz_drop_buffer(ctx, buf);
+        pdf_drop_obj(ctx, ref);
+    }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
+    return errcode;
+}
+
 // ============================================================
 // PDF InsertPDF (graft pages)
 // ============================================================
@@ -572,7 +2340,7 @@ static int gomupdf_graft_page(fz_context *ctx, pdf_document *dst, pdf_document *
     fz_try(ctx) {
         pdf_graft_mapped_page(ctx, map, page_to, src, page_from);
     }
-    fz_catch(ctx) { errcode = 1; }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
     return errcode;
 }
 
@@ -581,7 +2349,7 @@ static int gomupdf_graft_page(fz_context *ctx, pdf_document *dst, pdf_document *
 // ============================================================
 
 static unsigned char* gomupdf_convert_to_pdf(fz_context *ctx, fz_document *doc,
-    int from_page, int to_page, int rotate, int *outlen, int *errcode) {
+    int from_page, int to_page, int rotate, fz_cookie *cookie, int *outlen, int *errcode) {
     unsigned char *data = NULL;
     fz_try(ctx) {
         pdf_document *pdfout = pdf_create_document(ctx);
@@ -595,9 +2363,16 @@ static unsigned char* gomupdf_convert_to_pdf(fz_context *ctx, fz_document *doc,
             pdf_obj *resources = NULL;
             fz_buffer *contents = NULL;
             fz_device *dev = pdf_page_write(ctx, pdfout, mediabox, &resources, &contents);
-            fz_run_page(ctx, page, dev, fz_identity, NULL);
+            fz_run_page(ctx, page, dev, fz_identity, cookie);
             fz_close_device(ctx, dev);
             fz_drop_device(ctx, dev);
+            if (cookie && __atomic_load_n(&cookie->abort, __ATOMIC_RELAXED)) {
+                fz_drop_buffer(ctx, contents);
+                pdf_drop_obj(ctx, resources);
+                fz_drop_page(ctx, page);
+                pdf_drop_document(ctx, pdfout);
+                fz_throw(ctx, FZ_ERROR_ABORT, "conversion aborted");
+            }
             pdf_obj *page_obj = pdf_add_page(ctx, pdfout, mediabox, rotate, resources, contents);
             pdf_insert_page(ctx, pdfout, -1, page_obj);
             pdf_drop_obj(ctx, page_obj);
@@ -624,7 +2399,7 @@ static unsigned char* gomupdf_convert_to_pdf(fz_context *ctx, fz_document *doc,
         pdf_drop_document(ctx, pdfout);
         *errcode = 0;
     }
-    fz_catch(ctx) { *errcode = 1; data = NULL; *outlen = 0; }
+    fz_catch(ctx) { *errcode = gomupdf_caught(ctx); data = NULL; *outlen = 0; }
     return data;
 }
 
@@ -734,7 +2509,7 @@ static int gomupdf_set_widget_value(fz_context *ctx, pdf_document *doc, pdf_anno
         pdf_set_annot_field_value(ctx, doc, widget, value, 0);
         pdf_update_annot(ctx, widget);
     }
-    fz_catch(ctx) { errcode = 1; }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
     return errcode;
 }
 
@@ -945,6 +2720,21 @@ static pdf_obj* gomupdf_create_cjk_font(fz_context *ctx, pdf_document *doc, int
     return fontdict_ref;
 }
 
+/* Returns the /Resources dictionary of the page object to add resources
+   to. Resources inherited from the page tree are copied into the page
+   first, so that adding to them does not change other pages. */
+static pdf_obj* gomupdf_page_own_resources(fz_context *ctx, pdf_obj *page_obj) {
+    pdf_obj *resources = pdf_dict_get(ctx, page_obj, PDF_NAME(Resources));
+    if (resources)
+        return resources;
+    pdf_obj *inherited = pdf_dict_get_inheritable(ctx, page_obj, PDF_NAME(Resources));
+    if (!inherited)
+        return pdf_dict_put_dict(ctx, page_obj, PDF_NAME(Resources), 2);
+    resources = pdf_deep_copy_obj(ctx, pdf_resolve_indirect(ctx, inherited));
+    pdf_dict_put_drop(ctx, page_obj, PDF_NAME(Resources), resources);
+    return resources;
+}
+
 // ============================================================
 // Text insertion
 // ============================================================
@@ -957,9 +2747,7 @@ static int gomupdf_insert_text(fz_context *ctx, pdf_document *doc, int pno,
         int use_cjk = gomupdf_text_needs_cjk(text);
         pdf_obj *page_obj = pdf_lookup_page_obj(ctx, doc, pno);
 
-        pdf_obj *resources = pdf_dict_get(ctx, page_obj, PDF_NAME(Resources));
-        if (!resources)
-            resources = pdf_dict_put_dict(ctx, page_obj, PDF_NAME(Resources), 2);
+        pdf_obj *resources = gomupdf_page_own_resources(ctx, page_obj);
         pdf_obj *fonts = pdf_dict_get(ctx, resources, PDF_NAME(Font));
         if (!fonts)
             fonts = pdf_dict_put_dict(ctx, resources, PDF_NAME(Font), 4);
@@ -1032,7 +2820,157 @@ static int gomupdf_insert_text(fz_context *ctx, pdf_document *doc, int pno,
 
         fz_drop_buffer(ctx, content);
     }
-    fz_catch(ctx) { errcode = 1; }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
+    return errcode;
+}
+
+// ============================================================
+// Shapes (vector drawing)
+// ============================================================
+
+/* Adds an ExtGState with the given stroke and fill opacity to the page's
+   resources under name, unless one of that name exists. */
+static int gomupdf_page_add_extgstate(fz_context *ctx, pdf_document *doc, int pno,
+    const char *name, float stroke_alpha, float fill_alpha) {
+    int errcode = 0;
+    fz_try(ctx) {
+        pdf_obj *page_obj = pdf_lookup_page_obj(ctx, doc, pno);
+        pdf_obj *resources = gomupdf_page_own_resources(ctx, page_obj);
+        pdf_obj *gstates = pdf_dict_get(ctx, resources, PDF_NAME(ExtGState));
+        if (!gstates)
+            gstates = pdf_dict_put_dict(ctx, resources, PDF_NAME(ExtGState), 2);
+        if (!pdf_dict_gets(ctx, gstates, name)) {
+            pdf_obj *gs = pdf_dict_puts_dict(ctx, gstates, name, 3);
+            pdf_dict_put(ctx, gs, PDF_NAME(Type), PDF_NAME(ExtGState));
+            pdf_dict_put_real(ctx, gs, PDF_NAME(CA), stroke_alpha);
+            pdf_dict_put_real(ctx, gs, PDF_NAME(ca), fill_alpha);
+        }
+    }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
+    return errcode;
+}
+
+/* Reports whether the page contents are already wrapped in q/Q, that is
+   whether they are an array whose first stream holds nothing but q. */
+static int gomupdf_contents_wrapped(fz_context *ctx, pdf_obj *contents) {
+    fz_buffer *buf = NULL;
+    int wrapped = 0;
+    if (!pdf_is_array(ctx, contents) || !pdf_is_stream(ctx, pdf_array_get(ctx, contents, 0)))
+        return 0;
+    fz_var(buf);
+    fz_try(ctx) {
+        unsigned char *data;
+        size_t len;
+        buf = pdf_load_stream(ctx, pdf_array_get(ctx, contents, 0));
+        len = fz_buffer_storage(ctx, buf, &data);
+        for (size_t i = 0; i < len; i++) {
+            if (data[i] == 'q')
+                wrapped = 1;
+            else if (!strchr(" \t\r\n", data[i])) {
+                wrapped = 0;
+                break;
+            }
+        }
+    }
+    fz_always(ctx) fz_drop_buffer(ctx, buf);
+    fz_catch(ctx) fz_rethrow(ctx);
+    return wrapped;
+}
+
+/* Wraps the page contents in q/Q, as separate streams before and after
+   them, so that graphics state they leave behind does not reach contents
+   added later. Unbalanced q and Q operators are balanced as well. */
+static void gomupdf_wrap_contents(fz_context *ctx, pdf_document *doc, pdf_obj *page_obj) {
+    pdf_obj *contents = pdf_dict_get(ctx, page_obj, PDF_NAME(Contents));
+    fz_buffer *buf = NULL;
+    pdf_obj *q = NULL, *Q = NULL, *arr = NULL;
+    int prepend = 0, append = 0;
+    if (!contents || gomupdf_contents_wrapped(ctx, contents))
+        return;
+    fz_var(buf);
+    fz_var(q);
+    fz_var(Q);
+    fz_var(arr);
+    fz_try(ctx) {
+        pdf_count_q_balance(ctx, doc,
+            pdf_dict_get_inheritable(ctx, page_obj, PDF_NAME(Resources)),
+            contents, &prepend, &append);
+        buf = fz_new_buffer(ctx, 16);
+        for (int i = 0; i <= prepend; i++)
+            fz_append_string(ctx, buf, "q\n");
+        q = pdf_add_stream(ctx, doc, buf, NULL, 0);
+        fz_clear_buffer(ctx, buf);
+        for (int i = 0; i <= append; i++)
+            fz_append_string(ctx, buf, "Q\n");
+        Q = pdf_add_stream(ctx, doc, buf, NULL, 0);
+        if (pdf_is_array(ctx, contents)) {
+            pdf_array_insert(ctx, contents, q, 0);
+            pdf_array_push(ctx, contents, Q);
+        } else {
+            arr = pdf_new_array(ctx, doc, 3);
+            pdf_array_push(ctx, arr, q);
+            pdf_array_push(ctx, arr, contents);
+            pdf_array_push(ctx, arr, Q);
+            pdf_dict_put(ctx, page_obj, PDF_NAME(Contents), arr);
+        }
+    }
+    fz_always(ctx) {
+        pdf_drop_obj(ctx, arr);
+        pdf_drop_obj(ctx, Q);
+        pdf_drop_obj(ctx, q);
+        fz_drop_buffer(ctx, buf);
+    }
+    fz_catch(ctx) fz_rethrow(ctx);
+}
+
+/* Adds a content stream drawn in page coordinates (top-left origin, as
+   used by the Go API) in front of or behind the existing page contents.
+   In front, the existing contents are wrapped in q/Q first, so that the
+   graphics state they leave behind does not apply to the new stream. */
+static int gomupdf_add_page_contents(fz_context *ctx, pdf_document *doc, int pno,
+    const char *data, int len, int overlay) {
+    int errcode = 0;
+    fz_buffer *content = NULL;
+    pdf_obj *stream = NULL, *arr = NULL;
+    fz_var(content);
+    fz_var(stream);
+    fz_var(arr);
+    fz_try(ctx) {
+        pdf_obj *page_obj = pdf_lookup_page_obj(ctx, doc, pno);
+        fz_rect mediabox;
+        fz_matrix ctm;
+        pdf_page_obj_transform(ctx, page_obj, &mediabox, &ctm);
+        fz_matrix inv = fz_invert_matrix(ctm);
+
+        content = fz_new_buffer(ctx, len + 64);
+        fz_append_printf(ctx, content, "q\n%g %g %g %g %g %g cm\n",
+            inv.a, inv.b, inv.c, inv.d, inv.e, inv.f);
+        fz_append_data(ctx, content, data, len);
+        fz_append_string(ctx, content, "Q\n");
+        stream = pdf_add_stream(ctx, doc, content, NULL, 0);
+
+        if (overlay)
+            gomupdf_wrap_contents(ctx, doc, page_obj);
+        pdf_obj *existing = pdf_dict_get(ctx, page_obj, PDF_NAME(Contents));
+        if (pdf_is_array(ctx, existing)) {
+            if (overlay)
+                pdf_array_push(ctx, existing, stream);
+            else
+                pdf_array_insert(ctx, existing, stream, 0);
+        } else {
+            arr = pdf_new_array(ctx, doc, 2);
+            if (!overlay) pdf_array_push(ctx, arr, stream);
+            if (existing) pdf_array_push(ctx, arr, existing);
+            if (overlay) pdf_array_push(ctx, arr, stream);
+            pdf_dict_put(ctx, page_obj, PDF_NAME(Contents), arr);
+        }
+    }
+    fz_always(ctx) {
+        pdf_drop_obj(ctx, arr);
+        pdf_drop_obj(ctx, stream);
+        fz_drop_buffer(ctx, content);
+    }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
     return errcode;
 }
 
@@ -1075,9 +3013,7 @@ static int gomupdf_insert_image(fz_context *ctx, pdf_document *doc, int pno,
         pdf_page_obj_transform(ctx, page_obj, &mediabox, &page_ctm);
         float page_height = mediabox.y1 - mediabox.y0;
 
-        pdf_obj *resources = pdf_dict_get(ctx, page_obj, PDF_NAME(Resources));
-        if (!resources)
-            resources = pdf_dict_put_dict(ctx, page_obj, PDF_NAME(Resources), 2);
+        pdf_obj *resources = gomupdf_page_own_resources(ctx, page_obj);
 
         pdf_obj *xobjects = pdf_dict_get(ctx, resources, PDF_NAME(XObject));
         if (!xobjects)
@@ -1118,7 +3054,7 @@ static int gomupdf_insert_image(fz_context *ctx, pdf_document *doc, int pno,
         fz_drop_image(ctx, img);
         pdf_drop_obj(ctx, imgref);
     }
-    fz_catch(ctx) { errcode = 1; }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
     return errcode;
 }
 
@@ -1134,8 +3070,9 @@ static int gomupdf_insert_image(fz_context *ctx, pdf_document *doc, int pno,
 static int gomupdf_insert_htmlbox(fz_context *ctx, pdf_document *doc, int pno,
     float x0, float y0, float x1, float y1,
     const char *html, const char *css, float scale_low, int overlay,
-    float *spare_height, float *scale_used) {
+    float *spare_height, float *scale_used, int *overflow) {
     int errcode = 0;
+    *overflow = 0;
     fz_try(ctx) {
         pdf_obj *page_obj = pdf_lookup_page_obj(ctx, doc, pno);
 
@@ -1222,9 +3159,7 @@ static int gomupdf_insert_htmlbox(fz_context *ctx, pdf_document *doc, int pno,
         fz_drop_device(ctx, dev);
 
         /* Merge resources from the story into the page's resources */
-        pdf_obj *page_resources = pdf_dict_get(ctx, page_obj, PDF_NAME(Resources));
-        if (!page_resources)
-            page_resources = pdf_dict_put_dict(ctx, page_obj, PDF_NAME(Resources), 4);
+        pdf_obj *page_resources = gomupdf_page_own_resources(ctx, page_obj);
 
         /* Merge each resource category (Font, XObject, ExtGState, etc.) */
         static const pdf_obj *res_keys[] = {
@@ -1296,10 +3231,10 @@ static int gomupdf_insert_htmlbox(fz_context *ctx, pdf_document *doc, int pno,
 
         if (more && scale_low >= 1.0f) {
             /* Content didn't fit and no scaling allowed — report overflow */
-            errcode = 2;
+            *overflow = 1;
         }
     }
-    fz_catch(ctx) { errcode = 1; }
+    fz_catch(ctx) { errcode = gomupdf_caught(ctx); }
     return errcode;
 }
 
@@ -3,9 +3,25 @@
 package gomupdf
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // createTestPDF creates a minimal test PDF file and returns its path.
@@ -123,6 +139,150 @@ func TestOpenFromMemoryEmpty(t *testing.T) {
 	}
 }
 
+func TestOpenFromMemoryCorrupt(t *testing.T) {
+	_, err := OpenFromMemory([]byte("this is not a PDF"), "application/pdf")
+	if !errors.Is(err, ErrOpenFailed) {
+		t.Fatalf("expected ErrOpenFailed, got %v", err)
+	}
+	var me *MuPDFError
+	if !errors.As(err, &me) {
+		t.Fatalf("expected *MuPDFError, got %T", err)
+	}
+	if me.Code == ErrorCodeNone || me.Message == "" {
+		t.Errorf("unexpected MuPDFError: %+v", me)
+	}
+}
+
+// minimalPDF is a tiny one-page PDF used by the reader tests.
+var minimalPDF = []byte(`%PDF-1.0
+1 0 obj<</Pages 2 0 R>>endobj
+2 0 obj<</Kids[3 0 R]/Count 1>>endobj
+3 0 obj<</MediaBox[0 0 612 792]>>endobj
+trailer<</Root 1 0 R>>`)
+
+func TestOpenReader(t *testing.T) {
+	doc, err := OpenReader(bytes.NewReader(minimalPDF), int64(len(minimalPDF)), "application/pdf")
+	if err != nil {
+		t.Fatalf("OpenReader: %v", err)
+	}
+	defer doc.Close()
+
+	if !doc.IsPDF() {
+		t.Error("expected IsPDF() == true")
+	}
+	if doc.PageCount() != 1 {
+		t.Errorf("expected 1 page, got %d", doc.PageCount())
+	}
+}
+
+// seekOnly hides the io.ReaderAt implementation of the wrapped reader.
+type seekOnly struct{ io.ReadSeeker }
+
+func TestOpenWarnings(t *testing.T) {
+	var got []LogMessage
+	doc, err := OpenFromMemory(minimalPDF, "application/pdf", OpenOptions{
+		Name:    "minimal.pdf",
+		LogFunc: func(m LogMessage) { got = append(got, m) },
+	})
+	if err != nil {
+		t.Fatalf("OpenFromMemory: %v", err)
+	}
+	defer doc.Close()
+
+	// minimalPDF has no xref table, so MuPDF has to repair it.
+	warnings := doc.Warnings()
+	if len(warnings) == 0 {
+		t.Fatal("expected warnings for a PDF without xref")
+	}
+	if len(got) == 0 {
+		t.Fatal("LogFunc was not called")
+	}
+	for _, m := range got {
+		if m.Document != "minimal.pdf" {
+			t.Errorf("message tagged %q, want %q", m.Document, "minimal.pdf")
+		}
+	}
+}
+
+func TestOpenLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	doc, err := OpenFromMemory(minimalPDF, "application/pdf", OpenOptions{Logger: logger})
+	if err != nil {
+		t.Fatalf("OpenFromMemory: %v", err)
+	}
+	defer doc.Close()
+	if !strings.Contains(buf.String(), "document=application/pdf") {
+		t.Errorf("logger output missing document tag: %q", buf.String())
+	}
+}
+
+func TestWarningsCleanDocument(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	if w := doc.Warnings(); len(w) != 0 {
+		t.Errorf("unexpected warnings: %v", w)
+	}
+}
+
+func TestOpenReadSeeker(t *testing.T) {
+	doc, err := OpenReadSeeker(seekOnly{bytes.NewReader(minimalPDF)}, "application/pdf")
+	if err != nil {
+		t.Fatalf("OpenReadSeeker: %v", err)
+	}
+	defer doc.Close()
+
+	if doc.PageCount() != 1 {
+		t.Errorf("expected 1 page, got %d", doc.PageCount())
+	}
+	page, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer page.Close()
+	if r := page.Rect(); r.Width() != 612 || r.Height() != 792 {
+		t.Errorf("unexpected page rect %v", r)
+	}
+}
+
+func TestOpenReaderFromFile(t *testing.T) {
+	path := createTestPDF(t)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("os.Open: %v", err)
+	}
+	defer f.Close()
+
+	doc, err := OpenReadSeeker(f, "application/pdf")
+	if err != nil {
+		t.Fatalf("OpenReadSeeker: %v", err)
+	}
+	defer doc.Close()
+
+	if doc.PageCount() != 1 {
+		t.Errorf("expected 1 page, got %d", doc.PageCount())
+	}
+}
+
+// failingReaderAt returns an error for every read.
+type failingReaderAt struct{}
+
+func (failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("boom")
+}
+
+func TestOpenReaderErrors(t *testing.T) {
+	if _, err := OpenReader(nil, 10, "application/pdf"); !errors.Is(err, ErrOpenFailed) {
+		t.Errorf("expected ErrOpenFailed for nil reader, got %v", err)
+	}
+	if _, err := OpenReader(bytes.NewReader(nil), 0, "application/pdf"); !errors.Is(err, ErrOpenFailed) {
+		t.Errorf("expected ErrOpenFailed for empty reader, got %v", err)
+	}
+	if _, err := OpenReader(failingReaderAt{}, 1024, "application/pdf"); !errors.Is(err, ErrOpenFailed) {
+		t.Errorf("expected ErrOpenFailed for failing reader, got %v", err)
+	}
+}
+
 func TestOpenNonExistent(t *testing.T) {
 	_, err := Open("nonexistent_file_12345.pdf")
 	if err == nil {
@@ -207,6 +367,127 @@ func TestClosedDocOperations(t *testing.T) {
 	}
 }
 
+func TestPageAfterDocumentClose(t *testing.T) {
+	doc := newTestPDFWithText(t, "Closed")
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		doc.Close()
+		t.Fatalf("LoadPage: %v", err)
+	}
+	again, err := doc.LoadPage(0)
+	if err != nil {
+		doc.Close()
+		t.Fatalf("LoadPage again: %v", err)
+	}
+	again.Close()
+	annots := p.GetAnnots()
+	doc.Close()
+
+	if _, err := p.GetText("text"); !errors.Is(err, ErrClosed) {
+		t.Errorf("GetText: got %v, want ErrClosed", err)
+	}
+	if _, err := p.GetPixmap(); !errors.Is(err, ErrClosed) {
+		t.Errorf("GetPixmap: got %v, want ErrClosed", err)
+	}
+	if _, err := p.SearchFor("Closed", false); !errors.Is(err, ErrClosed) {
+		t.Errorf("SearchFor: got %v, want ErrClosed", err)
+	}
+	if _, err := p.GetLinks(); !errors.Is(err, ErrClosed) {
+		t.Errorf("GetLinks: got %v, want ErrClosed", err)
+	}
+	if _, err := p.InsertText(Point{X: 10, Y: 10}, "x"); !errors.Is(err, ErrClosed) {
+		t.Errorf("InsertText: got %v, want ErrClosed", err)
+	}
+	if r := p.Rect(); !r.IsEmpty() {
+		t.Errorf("Rect = %v, want empty", r)
+	}
+	for _, a := range annots {
+		if a.Contents() != "" {
+			t.Error("annotation of closed page should have no contents")
+		}
+	}
+	p.Close()
+	p.Close()
+}
+
+func TestPageClose(t *testing.T) {
+	doc := newTestPDFWithText(t, "Page")
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	p.Close()
+	if _, err := p.GetText("text"); !errors.Is(err, ErrClosed) {
+		t.Errorf("GetText: got %v, want ErrClosed", err)
+	}
+	if p.GetLabel() != "" {
+		t.Error("closed page should have no label")
+	}
+	// The document is still usable.
+	if _, err := doc.GetPageText(0, "text"); err != nil {
+		t.Errorf("GetPageText: %v", err)
+	}
+}
+
+func TestPixmapAfterClose(t *testing.T) {
+	pix, err := NewPixmap(CsRGB, 4, 4, false)
+	if err != nil {
+		t.Fatalf("NewPixmap: %v", err)
+	}
+	pix.Close()
+	if pix.Width() != 0 || pix.Samples() != nil {
+		t.Error("closed pixmap should report zero size and no samples")
+	}
+	if _, err := pix.ToBytes(); !errors.Is(err, ErrClosed) {
+		t.Errorf("ToBytes: got %v, want ErrClosed", err)
+	}
+	if _, err := pix.Convert(CsGray); !errors.Is(err, ErrClosed) {
+		t.Errorf("Convert: got %v, want ErrClosed", err)
+	}
+	pix.Invert()
+	pix.Close()
+}
+
+func TestLeakHandler(t *testing.T) {
+	leaks := make(chan Leak, 8)
+	SetLeakHandler(func(l Leak) { leaks <- l })
+	defer SetLeakHandler(nil)
+
+	func() {
+		doc := newTestPDFWithText(t, "Leak")
+		if _, err := doc.LoadPage(0); err != nil {
+			t.Fatalf("LoadPage: %v", err)
+		}
+		if _, err := NewPixmap(CsRGB, 4, 4, false); err != nil {
+			t.Fatalf("NewPixmap: %v", err)
+		}
+		closed, err := NewPixmap(CsRGB, 4, 4, false)
+		if err != nil {
+			t.Fatalf("NewPixmap: %v", err)
+		}
+		closed.Close()
+	}()
+
+	got := map[string]Leak{}
+	deadline := time.After(5 * time.Second)
+	for len(got) < 3 {
+		runtime.GC()
+		select {
+		case l := <-leaks:
+			got[l.Type] = l
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("leaks reported: %v, want Document, Page and Pixmap", got)
+		}
+	}
+	for typ, l := range got {
+		if !strings.Contains(l.Stack, "TestLeakHandler") {
+			t.Errorf("%s leak stack does not name the test:\n%s", typ, l.Stack)
+		}
+	}
+}
+
 // --- Page loading tests ---
 
 func TestLoadPage(t *testing.T) {
@@ -392,6 +673,46 @@ func TestGetTextWithFlags(t *testing.T) {
 	_ = text
 }
 
+func TestGetTextFormats(t *testing.T) {
+	doc := newTestPDFWithText(t, "Hello World")
+	defer doc.Close()
+
+	for _, tc := range []struct {
+		output string
+		want   []string
+	}{
+		{"text", []string{"Hello World"}},
+		{"html", []string{`<div id="page0"`, "Hello World</span>"}},
+		{"xhtml", []string{`<div id="page0">`, "<p>Hello World</p>"}},
+		{"xml", []string{`<page id="page0"`, `<font name="Helvetica"`, `c="W"`}},
+		{"json", []string{`"text":"Hello World"`}},
+		{"blocks", []string{`"Hello World\n" 0 0`}},
+		{"words", []string{`"Hello" `, `"World" `}},
+	} {
+		text, err := doc.GetPageText(0, tc.output)
+		if err != nil {
+			t.Errorf("GetPageText(%q): %v", tc.output, err)
+			continue
+		}
+		for _, w := range tc.want {
+			if !strings.Contains(text, w) {
+				t.Errorf("GetPageText(%q) = %q, want it to contain %q", tc.output, text, w)
+			}
+		}
+	}
+
+	text, err := doc.GetPageText(0, "json")
+	if err != nil {
+		t.Fatalf("GetPageText(json): %v", err)
+	}
+	if !json.Valid([]byte(text)) {
+		t.Errorf("json output is not valid JSON: %s", text)
+	}
+	if _, err := doc.GetPageText(0, "dict"); !errors.Is(err, ErrInvalidArg) {
+		t.Errorf("GetPageText(dict) = %v, want ErrInvalidArg", err)
+	}
+}
+
 func TestGetTextWithContent(t *testing.T) {
 	doc := newTestPDFWithText(t, "Hello GoMuPDF World")
 	defer doc.Close()
@@ -459,6 +780,94 @@ func TestGetTextWords(t *testing.T) {
 	_ = words
 }
 
+func TestGetTextWordsNumbering(t *testing.T) {
+	doc := newTestPDFWithText(t, "Hello brave,new World")
+	defer doc.Close()
+	page, _ := doc.LoadPage(0)
+	defer page.Close()
+	if _, err := page.InsertText(NewPoint(72, 400), "Second block"); err != nil {
+		t.Fatal(err)
+	}
+
+	words, err := page.GetTextWords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TextWord{
+		{Text: "Hello", BlockNo: 0, WordNo: 0},
+		{Text: "brave,new", BlockNo: 0, WordNo: 1},
+		{Text: "World", BlockNo: 0, WordNo: 2},
+		{Text: "Second", BlockNo: 1, WordNo: 0},
+		{Text: "block", BlockNo: 1, WordNo: 1},
+	}
+	if len(words) != len(want) {
+		t.Fatalf("words = %+v", words)
+	}
+	for i, w := range words {
+		if w.Text != want[i].Text || w.BlockNo != want[i].BlockNo || w.LineNo != 0 || w.WordNo != want[i].WordNo {
+			t.Errorf("word %d = %q %d/%d/%d, want %q %d/0/%d", i, w.Text, w.BlockNo, w.LineNo, w.WordNo,
+				want[i].Text, want[i].BlockNo, want[i].WordNo)
+		}
+		if w.Rect.IsEmpty() || w.Rect.X0 < 72-0.01 {
+			t.Errorf("word %q rect = %v", w.Text, w.Rect)
+		}
+		if q := w.Quad.Rect(); math.Abs(q.X0-w.Rect.X0) > 0.01 || math.Abs(q.X1-w.Rect.X1) > 0.01 {
+			t.Errorf("word %q quad %v does not match rect %v", w.Text, q, w.Rect)
+		}
+		if i > 0 && w.BlockNo == words[i-1].BlockNo && w.Rect.X0 <= words[i-1].Rect.X1 {
+			t.Errorf("word %q overlaps the previous word", w.Text)
+		}
+	}
+
+	opt := DefaultTextOptions()
+	opt.Delimiters = ","
+	words, err = page.GetTextWordsWithOptions(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(words) != 6 || words[1].Text != "brave" || words[2].Text != "new" || words[2].WordNo != 2 {
+		t.Errorf("words split at commas = %+v", words)
+	}
+	text, err := page.GetTextWithOptions("words", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "\"new\" 0 0 2\n") {
+		t.Errorf("words output = %q", text)
+	}
+}
+
+func TestGetTextWordsRotated(t *testing.T) {
+	doc, err := NewPDF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer doc.Close()
+	page, err := doc.NewPage(-1, 595, 842)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Close()
+	if _, err := page.InsertText(NewPoint(300, 400), "Upward"); err != nil {
+		t.Fatal(err)
+	}
+	if err := page.SetRotation(270); err != nil {
+		t.Fatal(err)
+	}
+	words, err := page.GetTextWords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(words) != 1 {
+		t.Fatalf("words = %+v", words)
+	}
+	// The text runs up the page, so the quad's left edge is at the bottom.
+	q := words[0].Quad
+	if q.UL.Y <= q.UR.Y || q.Rect().Height() <= q.Rect().Width() {
+		t.Errorf("quad of rotated word = %+v", q)
+	}
+}
+
 func TestGetTextPage(t *testing.T) {
 	doc := newTestPDFWithPage(t)
 	defer doc.Close()
@@ -502,68 +911,382 @@ func TestGetTextPageWithFlags(t *testing.T) {
 	tp.Close()
 }
 
-func TestGetPageText(t *testing.T) {
-	doc := newTestPDFWithPage(t)
+func TestTextPageSearchRegexp(t *testing.T) {
+	doc := newTestPDFWithText(t, "Invoice INV-2024-0042 of 2024-03-15, due date:")
 	defer doc.Close()
+	page, _ := doc.LoadPage(0)
+	defer page.Close()
+	if _, err := page.InsertText(NewPoint(72, 86), "2024-04-01 for infor-"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := page.InsertText(NewPoint(72, 100), "mation services"); err != nil {
+		t.Fatal(err)
+	}
 
-	text, err := doc.GetPageText(0, "text")
+	tp, err := page.GetTextPage()
 	if err != nil {
-		t.Fatalf("GetPageText: %v", err)
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	hits, err := tp.SearchRegexp(regexp.MustCompile(`INV-\d{4}-\d{4}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || len(hits[0].Quads) != 1 || !strings.HasPrefix(hits[0].Context, "Invoice INV-2024-0042") {
+		t.Fatalf("invoice hits = %+v", hits)
+	}
+	if _, err := page.AddHighlightAnnot(hits[0].Quads); err != nil {
+		t.Errorf("AddHighlightAnnot: %v", err)
 	}
-	_ = text
-}
 
-// --- Metadata tests ---
+	dates, _ := tp.SearchRegexp(regexp.MustCompile(`\d{4}-\d\d-\d\d`))
+	if len(dates) != 2 || dates[1].Quads[0].Rect().Y0 < dates[0].Quads[0].Rect().Y0+10 {
+		t.Errorf("date hits = %+v", dates)
+	}
+	due, _ := tp.SearchRegexp(regexp.MustCompile(`date:\s+\d{4}`))
+	if len(due) != 1 || len(due[0].Quads) != 2 {
+		t.Errorf("hits across a line break = %+v", due)
+	}
+	if hyph, _ := tp.SearchRegexp(regexp.MustCompile(`information`)); len(hyph) != 0 {
+		t.Errorf("hyphenated word matched without TextDeHyphenate: %+v", hyph)
+	}
 
-func TestMetadata(t *testing.T) {
-	doc, err := NewPDF()
+	dehyph, err := page.GetTextPageWithOptions(TextOptions{Flags: TextFlagsDefault | TextDeHyphenate})
 	if err != nil {
-		t.Fatalf("NewPDF: %v", err)
+		t.Fatal(err)
+	}
+	defer dehyph.Close()
+	hyph, _ := dehyph.SearchRegexp(regexp.MustCompile(`information`))
+	if len(hyph) != 1 || len(hyph[0].Quads) != 2 {
+		t.Fatalf("dehyphenated hits = %+v", hyph)
+	}
+	if q := hyph[0].Quads; q[1].Rect().Y0 < q[0].Rect().Y0+10 || q[1].Rect().X0 > 80 {
+		t.Errorf("quads of a dehyphenated word = %v", q)
 	}
-	defer doc.Close()
 
-	meta := doc.Metadata()
-	if meta == nil {
-		t.Error("expected non-nil metadata map")
+	if _, err := tp.SearchRegexp(nil); !errors.Is(err, ErrInvalidArg) {
+		t.Errorf("SearchRegexp(nil): got %v, want ErrInvalidArg", err)
 	}
-	if f, ok := meta["format"]; ok {
-		t.Logf("format: %s", f)
+	tp.Close()
+	if _, err := tp.SearchRegexp(regexp.MustCompile("x")); !errors.Is(err, ErrClosed) {
+		t.Errorf("SearchRegexp after Close: got %v, want ErrClosed", err)
 	}
 }
 
-func TestSetMetadata(t *testing.T) {
-	doc, err := NewPDF()
+func TestTextPageSelection(t *testing.T) {
+	doc := newTestPDFWithText(t, "Hello brave new")
+	defer doc.Close()
+	page, _ := doc.LoadPage(0)
+	defer page.Close()
+	if _, err := page.InsertText(NewPoint(72, 86), "world of text"); err != nil {
+		t.Fatal(err)
+	}
+	tp, err := page.GetTextPage()
 	if err != nil {
-		t.Fatalf("NewPDF: %v", err)
+		t.Fatal(err)
 	}
-	defer doc.Close()
+	defer tp.Close()
 
-	err = doc.SetMetadata(map[string]string{
-		"title":   "Test Document",
-		"author":  "GoMuPDF",
-		"subject": "Testing",
-		"unknown": "should be ignored",
-	})
-	if err != nil {
-		t.Fatalf("SetMetadata: %v", err)
+	// From inside "brave" on the first line to inside "world" on the second.
+	a, b := NewPoint(100, 70), NewPoint(90, 85)
+	for _, tc := range []struct {
+		mode int
+		want string
+	}{
+		{SelectChars, "brave new\nwor"},
+		{SelectWords, "brave new\nworld"},
+		{SelectLines, "Hello brave new\nworld of text"},
+	} {
+		sel, err := tp.Selection(a, b, tc.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sel.Text != tc.want || len(sel.Quads) != 2 {
+			t.Errorf("mode %d: selection = %q with %d quads, want %q with 2", tc.mode, sel.Text, len(sel.Quads), tc.want)
+		}
+	}
+	if _, err := tp.Selection(a, b, 7); !errors.Is(err, ErrInvalidArg) {
+		t.Errorf("Selection with mode 7: got %v, want ErrInvalidArg", err)
 	}
 
-	meta := doc.Metadata()
-	if meta["title"] != "Test Document" {
-		t.Errorf("expected title 'Test Document', got '%s'", meta["title"])
+	text, err := tp.CopyRect(NewRect(0, 0, 110, 842))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if meta["author"] != "GoMuPDF" {
-		t.Errorf("expected author 'GoMuPDF', got '%s'", meta["author"])
+	if text != "Hello bra\nworld of" {
+		t.Errorf("CopyRect = %q", text)
 	}
-	if meta["subject"] != "Testing" {
-		t.Errorf("expected subject 'Testing', got '%s'", meta["subject"])
+
+	tp.Close()
+	if _, err := tp.Selection(a, b, SelectChars); !errors.Is(err, ErrClosed) {
+		t.Errorf("Selection after Close: got %v, want ErrClosed", err)
+	}
+	if _, err := tp.CopyRect(NewRect(0, 0, 100, 100)); !errors.Is(err, ErrClosed) {
+		t.Errorf("CopyRect after Close: got %v, want ErrClosed", err)
 	}
 }
 
-func TestSetMetadataPersistence(t *testing.T) {
-	dir := t.TempDir()
-	path := filepath.Join(dir, "meta.pdf")
-
+func TestTextPageMethods(t *testing.T) {
+	doc := newTestPDFWithText(t, "Hello cached world")
+	defer doc.Close()
+	page, _ := doc.LoadPage(0)
+	defer page.Close()
+	tp, err := page.GetTextPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+
+	for _, output := range []string{"text", "words", "blocks", "json"} {
+		want, err := page.GetText(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := tp.Text(output); err != nil || got != want {
+			t.Errorf("Text(%q) = %q, %v; want %q", output, got, err, want)
+		}
+	}
+	if _, err := tp.Text("pdf"); !errors.Is(err, ErrInvalidArg) {
+		t.Errorf("Text(\"pdf\"): got %v, want ErrInvalidArg", err)
+	}
+	words, _ := page.GetTextWords()
+	if got := tp.Words(); fmt.Sprint(got) != fmt.Sprint(words) {
+		t.Errorf("Words = %v, want %v", got, words)
+	}
+	blocks, _ := page.GetTextBlocks()
+	if got := tp.TextBlocks(); fmt.Sprint(got) != fmt.Sprint(blocks) {
+		t.Errorf("TextBlocks = %v, want %v", got, blocks)
+	}
+	hits, _ := page.Search("cached")
+	if got, err := tp.Search("cached"); err != nil || len(got) != 1 || fmt.Sprint(got) != fmt.Sprint(hits) {
+		t.Errorf("Search = %v, %v; want %v", got, err, hits)
+	}
+
+	tp.Close()
+	if _, err := tp.Text("text"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Text after Close: got %v, want ErrClosed", err)
+	}
+	if tp.Words() != nil || tp.TextBlocks() != nil {
+		t.Error("Words and TextBlocks after Close are not nil")
+	}
+	if _, err := tp.Search("cached"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Search after Close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestPageTextCache(t *testing.T) {
+	doc := newTestPDFWithText(t, "Before")
+	defer doc.Close()
+	page, _ := doc.LoadPage(0)
+	defer page.Close()
+
+	page.CacheTextPages(true)
+	text, err := page.GetText("text")
+	if err != nil || !strings.Contains(text, "Before") {
+		t.Fatalf("GetText = %q, %v", text, err)
+	}
+	if _, err := page.GetTextWordsWithOptions(TextOptions{Flags: TextFlagsDefault, Delimiters: "e"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := page.GetTextBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := page.Search("before"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(page.textPages); n != 1 {
+		t.Errorf("%d text pages cached for one set of options, want 1", n)
+	}
+	if _, err := page.SearchFor("before", true); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(page.textPages); n != 2 {
+		t.Errorf("%d text pages cached for two sets of options, want 2", n)
+	}
+
+	// Edits are not seen until the cache is invalidated.
+	if _, err := page.InsertText(NewPoint(72, 200), "After"); err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := page.GetText("text"); strings.Contains(text, "After") {
+		t.Errorf("cached text changed: %q", text)
+	}
+	page.InvalidateTextPages()
+	if text, _ := page.GetText("text"); !strings.Contains(text, "After") {
+		t.Errorf("text after invalidation = %q", text)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if hits, err := page.SearchFor("after", false); err != nil || len(hits) != 1 {
+				t.Errorf("concurrent SearchFor = %v, %v", hits, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// A cancelled context is reported even when the text page is cached.
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := page.GetTextCtx(cctx, "text"); !errors.Is(err, context.Canceled) {
+		t.Errorf("cached GetTextCtx with a cancelled context: got %v, want context.Canceled", err)
+	}
+
+	page.CacheTextPages(false)
+	if page.textPages != nil {
+		t.Error("text pages still cached after turning caching off")
+	}
+
+	page.CacheTextPages(true)
+	if _, err := page.GetText("text"); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+	if _, err := page.GetText("text"); !errors.Is(err, ErrClosed) {
+		t.Errorf("cached GetText after Document.Close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestTextPageSpans(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	page, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer page.Close()
+	for _, ins := range []struct {
+		pos  Point
+		text string
+		opts []TextInsertOption
+	}{
+		{NewPoint(72, 72), "Bold", []TextInsertOption{WithFontName("Helvetica-Bold"), WithColor(ColorRed)}},
+		{NewPoint(102, 72), "Ital", []TextInsertOption{WithFontName("Times-Italic")}},
+		{NewPoint(118, 70), "2", []TextInsertOption{WithFontName("Times-Italic"), WithFontSize(6)}},
+		{NewPoint(72, 100), "Mono", []TextInsertOption{WithFontName("Courier")}},
+	} {
+		if _, err := page.InsertText(ins.pos, ins.text, ins.opts...); err != nil {
+			t.Fatalf("InsertText(%q): %v", ins.text, err)
+		}
+	}
+
+	tp, err := page.GetTextPage()
+	if err != nil {
+		t.Fatalf("GetTextPage: %v", err)
+	}
+	defer tp.Close()
+	var spans []STextSpan
+	for _, b := range tp.Blocks() {
+		for _, l := range b.Lines {
+			n := 0
+			for _, s := range l.Spans {
+				n += len(s.Chars)
+			}
+			if n != len(l.Chars) {
+				t.Errorf("line %q: spans hold %d chars, want %d", l.Text(), n, len(l.Chars))
+			}
+			spans = append(spans, l.Spans...)
+		}
+	}
+	want := []struct {
+		text  string
+		font  string
+		size  float64
+		flags int
+		color Color
+	}{
+		{"Bold", "Helvetica-Bold", 11, TextFontBold, ColorRed},
+		{" Ital", "Times-Italic", 11, TextFontItalic | TextFontSerifed, ColorBlack},
+		{"2", "Times-Italic", 6, TextFontItalic | TextFontSerifed | TextFontSuperscript, ColorBlack},
+		{"Mono", "Courier", 11, TextFontMonospaced, ColorBlack},
+	}
+	if len(spans) != len(want) {
+		t.Fatalf("got %d spans, want %d", len(spans), len(want))
+	}
+	for i, w := range want {
+		s := spans[i]
+		if s.Text() != w.text || s.Font != w.font || s.Size != w.size || s.Flags != w.flags || s.Color != w.color {
+			t.Errorf("span %d = %q %s %g flags %#x %v; want %q %s %g flags %#x %v",
+				i, s.Text(), s.Font, s.Size, s.Flags, s.Color, w.text, w.font, w.size, w.flags, w.color)
+		}
+		if s.Ascender <= 0 || s.Descender >= 0 {
+			t.Errorf("span %d ascender %g, descender %g", i, s.Ascender, s.Descender)
+		}
+	}
+	ch := spans[0].Chars[0]
+	if ch.Quad.UL.X != 72 || ch.Rect != ch.Quad.Rect() || ch.Font != "Helvetica-Bold" || ch.Size != 11 {
+		t.Errorf("first char = %+v", ch)
+	}
+	if !spans[0].Rect.ContainsRect(ch.Rect) {
+		t.Errorf("span rect %v does not contain char rect %v", spans[0].Rect, ch.Rect)
+	}
+}
+
+func TestGetPageText(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+
+	text, err := doc.GetPageText(0, "text")
+	if err != nil {
+		t.Fatalf("GetPageText: %v", err)
+	}
+	_ = text
+}
+
+// --- Metadata tests ---
+
+func TestMetadata(t *testing.T) {
+	doc, err := NewPDF()
+	if err != nil {
+		t.Fatalf("NewPDF: %v", err)
+	}
+	defer doc.Close()
+
+	meta := doc.Metadata()
+	if meta == nil {
+		t.Error("expected non-nil metadata map")
+	}
+	if f, ok := meta["format"]; ok {
+		t.Logf("format: %s", f)
+	}
+}
+
+func TestSetMetadata(t *testing.T) {
+	doc, err := NewPDF()
+	if err != nil {
+		t.Fatalf("NewPDF: %v", err)
+	}
+	defer doc.Close()
+
+	err = doc.SetMetadata(map[string]string{
+		"title":   "Test Document",
+		"author":  "GoMuPDF",
+		"subject": "Testing",
+		"unknown": "should be ignored",
+	})
+	if err != nil {
+		t.Fatalf("SetMetadata: %v", err)
+	}
+
+	meta := doc.Metadata()
+	if meta["title"] != "Test Document" {
+		t.Errorf("expected title 'Test Document', got '%s'", meta["title"])
+	}
+	if meta["author"] != "GoMuPDF" {
+		t.Errorf("expected author 'GoMuPDF', got '%s'", meta["author"])
+	}
+	if meta["subject"] != "Testing" {
+		t.Errorf("expected subject 'Testing', got '%s'", meta["subject"])
+	}
+}
+
+func TestSetMetadataPersistence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "meta.pdf")
+
 	doc, err := NewPDF()
 	if err != nil {
 		t.Fatalf("NewPDF: %v", err)
@@ -1464,6 +2187,164 @@ func TestSearchFor(t *testing.T) {
 	}
 }
 
+func TestSearchForMany(t *testing.T) {
+	doc, err := NewPDF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer doc.Close()
+	page, err := doc.NewPage(-1, 595, 842)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Close()
+	line := strings.Repeat("hit ", 12)
+	for y := 40.0; y < 800; y += 12 {
+		if _, err := page.InsertText(NewPoint(40, y), line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	quads, err := page.SearchFor("hit", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quads) != 64*12 {
+		t.Errorf("SearchFor found %d hits, want %d", len(quads), 64*12)
+	}
+}
+
+func TestSearchForRects(t *testing.T) {
+	doc := newTestPDFWithText(t, "Sideways")
+	defer doc.Close()
+	page, _ := doc.LoadPage(0)
+	defer page.Close()
+	if err := page.SetRotation(270); err != nil {
+		t.Fatal(err)
+	}
+	quads, err := page.SearchFor("Sideways", true)
+	if err != nil || len(quads) != 1 {
+		t.Fatalf("SearchFor = %v, %v", quads, err)
+	}
+	if q := quads[0]; q.UL.Y <= q.UR.Y {
+		t.Errorf("quad does not follow the text: %v", q)
+	}
+	rects, err := page.SearchFor("Sideways", false)
+	if err != nil || len(rects) != 1 {
+		t.Fatalf("SearchFor = %v, %v", rects, err)
+	}
+	if r := rects[0]; r != r.Rect().Quad() || r.Rect() != quads[0].Rect() {
+		t.Errorf("rect of %v = %v", quads[0], r)
+	}
+}
+
+func TestPageSearch(t *testing.T) {
+	doc := newTestPDFWithText(t, "The quick brown")
+	defer doc.Close()
+	page, _ := doc.LoadPage(0)
+	defer page.Close()
+	if _, err := page.InsertText(NewPoint(72, 90), "fox jumps over the Brown dog"); err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err := page.Search("brown  fox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || len(hits[0].Quads) != 2 {
+		t.Fatalf("hits = %+v", hits)
+	}
+	h := hits[0]
+	if h.Page != 0 || h.Context != "The quick brown fox jumps over the Brown dog" {
+		t.Errorf("hit = %+v", h)
+	}
+	if h.Quads[0].Rect().Y1 > h.Quads[1].Rect().Y0+1 || h.Quads[1].Rect().X0 > 80 {
+		t.Errorf("quads of a hit across lines = %v", h.Quads)
+	}
+
+	count := func(needle string, opt SearchOptions) int {
+		t.Helper()
+		hits, err := page.Search(needle, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(hits)
+	}
+	opt := DefaultSearchOptions()
+	if n := count("brown", opt); n != 2 {
+		t.Errorf("case-insensitive hits = %d, want 2", n)
+	}
+	opt.CaseSensitive = true
+	if n := count("Brown", opt); n != 1 {
+		t.Errorf("case-sensitive hits = %d, want 1", n)
+	}
+	opt = DefaultSearchOptions()
+	if n := count("row", opt); n != 2 {
+		t.Errorf("hits inside words = %d, want 2", n)
+	}
+	opt.WholeWords = true
+	if n := count("row", opt); n != 0 {
+		t.Errorf("whole-word hits of a part of a word = %d, want 0", n)
+	}
+	if n := count("the", opt); n != 2 {
+		t.Errorf("whole-word hits = %d, want 2", n)
+	}
+}
+
+func TestDocumentSearch(t *testing.T) {
+	doc := newTestPDFWithPages(t, 4)
+	defer doc.Close()
+
+	var pages []int
+	for res, err := range doc.Search("page", DefaultSearchOptions()) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, res.Page)
+	}
+	if fmt.Sprint(pages) != "[0 1 2 3]" {
+		t.Errorf("pages with hits = %v", pages)
+	}
+
+	pages = nil
+	for res, err := range doc.Search("page", SearchOptions{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, res.Page)
+	}
+	if fmt.Sprint(pages) != "[0 1 2 3]" {
+		t.Errorf("pages with hits for zero options = %v", pages)
+	}
+
+	pages = nil
+	for res, err := range doc.Search("page", SearchOptions{Pages: []int{2, 0}}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, res.Page)
+	}
+	if fmt.Sprint(pages) != "[2 0]" {
+		t.Errorf("pages with hits of listed pages = %v", pages)
+	}
+
+	// Stopping early is fine.
+	for res := range doc.Search("page", DefaultSearchOptions()) {
+		if res.Context != "Page 0" {
+			t.Errorf("context = %q", res.Context)
+		}
+		break
+	}
+
+	doc.Close()
+	var errs []error
+	for _, err := range doc.Search("page", DefaultSearchOptions()) {
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrClosed) {
+		t.Errorf("search of a closed document: %v", errs)
+	}
+}
+
 func TestSearchPageFor(t *testing.T) {
 	doc := newTestPDFWithPage(t)
 	defer doc.Close()
@@ -2139,6 +3020,29 @@ func TestInsertImageEmpty(t *testing.T) {
 	}
 }
 
+func TestInsertImageInvalidData(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+
+	page, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer page.Close()
+
+	err = page.InsertImage(NewRect(100, 100, 200, 200), []byte("not an image"))
+	if !errors.Is(err, ErrPixmap) {
+		t.Fatalf("expected ErrPixmap, got %v", err)
+	}
+	var me *MuPDFError
+	if !errors.As(err, &me) {
+		t.Fatalf("expected *MuPDFError, got %T", err)
+	}
+	if me.Code == ErrorCodeNone || me.Message == "" || me.Op != "Page.InsertImage" {
+		t.Errorf("unexpected MuPDFError: %+v", me)
+	}
+}
+
 // --- Font/Image info tests ---
 
 func TestGetFonts(t *testing.T) {
@@ -2153,40 +3057,1356 @@ func TestGetFonts(t *testing.T) {
 	_ = fonts
 }
 
-func TestGetImages(t *testing.T) {
-	doc := newTestPDFWithPage(t)
+func TestGetFontsBase14(t *testing.T) {
+	doc := newTestPDFWithText(t, "Hello")
 	defer doc.Close()
 
-	images, err := doc.GetPageImages(0)
+	fonts, err := doc.GetPageFonts(0)
 	if err != nil {
-		t.Fatalf("GetPageImages: %v", err)
+		t.Fatalf("GetPageFonts: %v", err)
 	}
-	_ = images
-}
-
-// --- TextInsertOption tests ---
-
-func TestTextInsertOptions(t *testing.T) {
-	cfg := textInsertConfig{}
-	WithFontName("Courier")(&cfg)
-	if cfg.fontname != "Courier" {
-		t.Errorf("expected Courier, got %s", cfg.fontname)
+	if len(fonts) != 1 {
+		t.Fatalf("got %d fonts, want 1: %+v", len(fonts), fonts)
 	}
-	WithFontSize(14)(&cfg)
-	if cfg.fontsize != 14 {
-		t.Errorf("expected 14, got %f", cfg.fontsize)
+	f := fonts[0]
+	if f.BaseName != "Helvetica" || f.Type != "Type1" || f.Ext != "n/a" || f.Embedded {
+		t.Errorf("unexpected font %+v", f)
 	}
-	WithColor(ColorBlue)(&cfg)
-	if cfg.color != ColorBlue {
-		t.Error("color mismatch")
+	if f.Xref <= 0 || f.Name == "" {
+		t.Errorf("font should have an xref and a resource name: %+v", f)
 	}
-	WithRotate(90)(&cfg)
-	if cfg.rotate != 90 {
-		t.Errorf("expected 90, got %d", cfg.rotate)
+	if _, _, err := doc.ExtractFont(f.Xref); !errors.Is(err, ErrFont) {
+		t.Errorf("ExtractFont of non-embedded font: got %v, want ErrFont", err)
 	}
 }
 
-// --- PixmapOption tests ---
+func TestGetFontsEmbedded(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	_, err = p.InsertHTMLBox(Rect{X0: 50, Y0: 50, X1: 500, Y1: 200}, "<p>Embedded <b>fonts</b></p>")
+	p.Close()
+	if err != nil {
+		t.Fatalf("InsertHTMLBox: %v", err)
+	}
+
+	fonts, err := doc.GetPageFonts(0)
+	if err != nil {
+		t.Fatalf("GetPageFonts: %v", err)
+	}
+	if len(fonts) < 2 {
+		t.Fatalf("got %d fonts, want regular and bold: %+v", len(fonts), fonts)
+	}
+	for _, f := range fonts {
+		if !f.Embedded {
+			t.Errorf("font %q should be embedded", f.BaseName)
+			continue
+		}
+		data, ext, err := doc.ExtractFont(f.Xref)
+		if err != nil {
+			t.Errorf("ExtractFont(%d): %v", f.Xref, err)
+			continue
+		}
+		if ext != f.Ext || len(data) == 0 {
+			t.Errorf("ExtractFont(%d) = %d bytes, %q; want data with ext %q", f.Xref, len(data), ext, f.Ext)
+		}
+	}
+}
+
+// formFontPDF draws a Form XObject that uses its own font.
+var formFontPDF = []byte(`%PDF-1.4
+1 0 obj<</Type/Catalog/Pages 2 0 R>>endobj
+2 0 obj<</Type/Pages/Kids[3 0 R]/Count 1>>endobj
+3 0 obj<</Type/Page/Parent 2 0 R/MediaBox[0 0 612 792]/Contents 4 0 R
+/Resources<</Font<</F1 5 0 R>>/XObject<</Fm1 6 0 R>>>>>>endobj
+4 0 obj<</Length 44>>stream
+BT /F1 12 Tf 72 720 Td (Page) Tj ET /Fm1 Do
+endstream endobj
+5 0 obj<</Type/Font/Subtype/Type1/BaseFont/Helvetica>>endobj
+6 0 obj<</Type/XObject/Subtype/Form/BBox[0 0 612 792]/Length 39
+/Resources<</Font<</F2 7 0 R>>/XObject<</Fm1 6 0 R>>>>>>stream
+BT /F2 12 Tf 72 700 Td (Form) Tj ET
+endstream endobj
+7 0 obj<</Type/Font/Subtype/Type1/BaseFont/ABCDEF+Courier/Encoding/WinAnsiEncoding>>endobj
+trailer<</Root 1 0 R>>`)
+
+func TestGetFontsFormXObject(t *testing.T) {
+	doc, err := OpenFromMemory(formFontPDF, "application/pdf", OpenOptions{LogFunc: func(LogMessage) {}})
+	if err != nil {
+		t.Fatalf("OpenFromMemory: %v", err)
+	}
+	defer doc.Close()
+
+	fonts, err := doc.GetPageFonts(0)
+	if err != nil {
+		t.Fatalf("GetPageFonts: %v", err)
+	}
+	if len(fonts) != 2 {
+		t.Fatalf("got %d fonts, want 2: %+v", len(fonts), fonts)
+	}
+	page, form := fonts[0], fonts[1]
+	if page.Xref != 5 || page.Name != "F1" || page.Referencer != 3 || page.Subset {
+		t.Errorf("unexpected page font %+v", page)
+	}
+	if form.Xref != 7 || form.Name != "F2" || form.Referencer != 6 {
+		t.Errorf("unexpected form font %+v", form)
+	}
+	if !form.Subset || form.Encoding != "WinAnsiEncoding" {
+		t.Errorf("form font should be a WinAnsi subset: %+v", form)
+	}
+	if _, _, err := doc.ExtractFont(4); !errors.Is(err, ErrFont) {
+		t.Errorf("ExtractFont of a content stream: got %v, want ErrFont", err)
+	}
+}
+
+func TestGetImages(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+
+	images, err := doc.GetPageImages(0)
+	if err != nil {
+		t.Fatalf("GetPageImages: %v", err)
+	}
+	_ = images
+}
+
+// testPNG returns a small PNG produced by the package itself.
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	pix, err := NewPixmap(CsRGB, 8, 4, false)
+	if err != nil {
+		t.Fatalf("NewPixmap: %v", err)
+	}
+	defer pix.Close()
+	pix.Clear(128)
+	data, err := pix.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes: %v", err)
+	}
+	return data
+}
+
+func TestGetImagesInserted(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+	target := NewRect(100, 100, 300, 200)
+	if err := p.InsertImage(target, testPNG(t)); err != nil {
+		t.Fatalf("InsertImage: %v", err)
+	}
+
+	images, err := p.GetImages()
+	if err != nil {
+		t.Fatalf("GetImages: %v", err)
+	}
+	if len(images) != 1 {
+		t.Fatalf("got %d images, want 1: %+v", len(images), images)
+	}
+	img := images[0]
+	if img.Width != 8 || img.Height != 4 || img.BPC != 8 || img.Xref <= 0 || img.Name == "" {
+		t.Errorf("unexpected image %+v", img)
+	}
+
+	rects, err := p.GetImageRects(img.Xref)
+	if err != nil {
+		t.Fatalf("GetImageRects: %v", err)
+	}
+	if len(rects) != 1 {
+		t.Fatalf("got %d placements, want 1", len(rects))
+	}
+	if r := rects[0].Rect; !target.ContainsRect(r) || r.Width() != target.Width() {
+		t.Errorf("image drawn at %v, want inside %v with full width", r, target)
+	}
+}
+
+// formImagePDF draws the image 5 0 R once on the page and twice through a
+// Form XObject; 7 0 R is declared but never drawn.
+var formImagePDF = []byte(`%PDF-1.4
+1 0 obj<</Type/Catalog/Pages 2 0 R>>endobj
+2 0 obj<</Type/Pages/Kids[3 0 R]/Count 1>>endobj
+3 0 obj<</Type/Page/Parent 2 0 R/MediaBox[0 0 600 800]/Contents 4 0 R
+/Resources<</XObject<</Im1 5 0 R/Fm1 6 0 R/Im2 7 0 R>>>>>>endobj
+4 0 obj<</Length 81>>stream
+q 100 0 0 50 10 10 cm /Im1 Do Q q 1 0 0 1 0 100 cm /Fm1 Do Q q 1 0 0 1 0 300 cm /Fm1 Do Q
+endstream endobj
+5 0 obj<</Type/XObject/Subtype/Image/Width 2/Height 2/BitsPerComponent 8
+/ColorSpace[/Indexed/DeviceRGB 1<000000FFFFFF>]/Filter[/ASCIIHexDecode]/Length 9>>stream
+00010100>
+endstream endobj
+6 0 obj<</Type/XObject/Subtype/Form/BBox[0 0 600 800]/Length 29
+/Resources<</XObject<</Im9 5 0 R>>>>>>stream
+q 20 0 0 20 0 0 cm /Im9 Do Q
+endstream endobj
+7 0 obj<</Type/XObject/Subtype/Image/Width 1/Height 1/BitsPerComponent 8
+/ColorSpace/DeviceGray/Filter/ASCIIHexDecode/Length 3>>stream
+80>
+endstream endobj
+trailer<</Root 1 0 R>>`)
+
+func TestGetImageRectsFormXObject(t *testing.T) {
+	doc, err := OpenFromMemory(formImagePDF, "application/pdf", OpenOptions{LogFunc: func(LogMessage) {}})
+	if err != nil {
+		t.Fatalf("OpenFromMemory: %v", err)
+	}
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+
+	images, err := p.GetImages()
+	if err != nil {
+		t.Fatalf("GetImages: %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("got %d images, want 2: %+v", len(images), images)
+	}
+	img := images[0]
+	if img.Xref != 5 || img.Name != "Im1" || img.Colorspace != "Indexed" ||
+		img.AltCS != "DeviceRGB" || img.Filter != "ASCIIHexDecode" || img.Referencer != 3 {
+		t.Errorf("unexpected image %+v", img)
+	}
+
+	rects, err := p.GetImageRects(5)
+	if err != nil {
+		t.Fatalf("GetImageRects: %v", err)
+	}
+	want := []Rect{
+		NewRect(10, 740, 110, 790),
+		NewRect(0, 680, 20, 700),
+		NewRect(0, 480, 20, 500),
+	}
+	if len(rects) != len(want) {
+		t.Fatalf("got %d placements, want %d: %+v", len(rects), len(want), rects)
+	}
+	for i, r := range rects {
+		if r.Rect != want[i] {
+			t.Errorf("placement %d: got %v, want %v", i, r.Rect, want[i])
+		}
+		if r.Rect != NewRect(0, 0, 1, 1).Transform(r.Matrix) {
+			t.Errorf("placement %d: matrix %v does not match rect %v", i, r.Matrix, r.Rect)
+		}
+	}
+
+	if rects, err := p.GetImageRects(7); err != nil || len(rects) != 0 {
+		t.Errorf("GetImageRects of unused image = %v, %v; want none", rects, err)
+	}
+	if _, err := p.GetImageRects(4); !errors.Is(err, ErrXref) {
+		t.Errorf("GetImageRects of a content stream: got %v, want ErrXref", err)
+	}
+}
+
+func TestExtractImageJPEG(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for i := range src.Pix {
+		src.Pix[i] = byte(i * 7)
+	}
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, src, nil); err != nil {
+		t.Fatalf("jpeg.Encode: %v", err)
+	}
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+	if err := p.InsertImage(NewRect(50, 50, 210, 130), jpg.Bytes()); err != nil {
+		t.Fatalf("InsertImage: %v", err)
+	}
+	images, err := p.GetImages()
+	if err != nil || len(images) != 1 {
+		t.Fatalf("GetImages = %v, %v; want one image", images, err)
+	}
+
+	img, err := doc.ExtractImage(images[0].Xref)
+	if err != nil {
+		t.Fatalf("ExtractImage: %v", err)
+	}
+	if img.Ext != "jpeg" || img.Width != 16 || img.Height != 8 || img.N != 3 {
+		t.Errorf("unexpected image %+v", *img)
+	}
+	if !bytes.Equal(img.Image, jpg.Bytes()) {
+		t.Error("JPEG was not returned as stored")
+	}
+}
+
+func TestExtractImageSMask(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(src.Pix); i += 4 {
+		src.Pix[i], src.Pix[i+3] = 255, byte(i*16)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+	if err := p.InsertImage(NewRect(50, 50, 100, 100), buf.Bytes()); err != nil {
+		t.Fatalf("InsertImage: %v", err)
+	}
+	images, err := p.GetImages()
+	if err != nil || len(images) != 1 {
+		t.Fatalf("GetImages = %v, %v; want one image", images, err)
+	}
+	xref := images[0].Xref
+
+	plain, err := doc.ExtractImage(xref)
+	if err != nil {
+		t.Fatalf("ExtractImage: %v", err)
+	}
+	if plain.Ext != "png" || plain.N != 3 || plain.SMask == 0 {
+		t.Errorf("unexpected image without mask %+v", *plain)
+	}
+	merged, err := doc.ExtractImage(xref, ExtractImageOptions{MergeSMask: true})
+	if err != nil {
+		t.Fatalf("ExtractImage merged: %v", err)
+	}
+	if merged.Ext != "png" || merged.N != 4 {
+		t.Errorf("unexpected merged image %+v", *merged)
+	}
+	decoded, err := png.Decode(bytes.NewReader(merged.Image))
+	if err != nil {
+		t.Fatalf("png.Decode: %v", err)
+	}
+	if _, _, _, a := decoded.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("alpha at (0,0) = %d, want 0", a)
+	}
+}
+
+func TestExtractAllImages(t *testing.T) {
+	doc, err := OpenFromMemory(formImagePDF, "application/pdf", OpenOptions{LogFunc: func(LogMessage) {}})
+	if err != nil {
+		t.Fatalf("OpenFromMemory: %v", err)
+	}
+	defer doc.Close()
+
+	var xrefs []int
+	err = doc.ExtractAllImages(func(pno int, img *ExtractedImage) error {
+		if pno != 0 || len(img.Image) == 0 {
+			t.Errorf("unexpected image %+v on page %d", *img, pno)
+		}
+		xrefs = append(xrefs, img.Xref)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ExtractAllImages: %v", err)
+	}
+	if fmt.Sprint(xrefs) != "[5 7]" {
+		t.Errorf("visited xrefs %v, want [5 7]", xrefs)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = doc.ExtractAllImages(func(int, *ExtractedImage) error { n++; return stop })
+	if err != stop || n != 1 {
+		t.Errorf("ExtractAllImages = %v after %d calls, want stop after 1", err, n)
+	}
+	if _, err := doc.ExtractImage(4); !errors.Is(err, ErrXref) {
+		t.Errorf("ExtractImage of a content stream: got %v, want ErrXref", err)
+	}
+}
+
+func TestReplaceImage(t *testing.T) {
+	doc, err := OpenFromMemory(formImagePDF, "application/pdf", OpenOptions{LogFunc: func(LogMessage) {}})
+	if err != nil {
+		t.Fatalf("OpenFromMemory: %v", err)
+	}
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+	pixelAt := func(x, y int) []byte {
+		t.Helper()
+		pix, err := p.GetPixmap()
+		if err != nil {
+			t.Fatalf("GetPixmap: %v", err)
+		}
+		defer pix.Close()
+		return pix.GetPixel(x, y)
+	}
+	// Render once so that the old image is cached.
+	pixelAt(0, 0)
+
+	red := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	for i := 0; i < len(red.Pix); i += 4 {
+		red.Pix[i], red.Pix[i+3] = 255, 255
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, red); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	if err := p.ReplaceImage(5, buf.Bytes()); err != nil {
+		t.Fatalf("ReplaceImage: %v", err)
+	}
+	img, err := doc.ExtractImage(5)
+	if err != nil {
+		t.Fatalf("ExtractImage: %v", err)
+	}
+	if img.Width != 8 || img.Height != 4 {
+		t.Errorf("replaced image is %dx%d, want 8x4", img.Width, img.Height)
+	}
+	rects, err := p.GetImageRects(5)
+	if err != nil || len(rects) != 3 {
+		t.Fatalf("GetImageRects = %d placements, %v; want 3", len(rects), err)
+	}
+	// Centers of the page placement and of a Form XObject placement.
+	for _, pt := range [][2]int{{60, 765}, {10, 690}} {
+		if c := pixelAt(pt[0], pt[1]); !bytes.Equal(c, []byte{255, 0, 0}) {
+			t.Errorf("pixel at %v = %v, want red", pt, c)
+		}
+	}
+
+	if err := p.DeleteImage(5); err != nil {
+		t.Fatalf("DeleteImage: %v", err)
+	}
+	if c := pixelAt(60, 765); !bytes.Equal(c, []byte{255, 255, 255}) {
+		t.Errorf("pixel of deleted image = %v, want white", c)
+	}
+	data, err := doc.ToBytes()
+	if err != nil {
+		t.Fatalf("ToBytes: %v", err)
+	}
+	saved, err := OpenFromMemory(data, "application/pdf")
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer saved.Close()
+	if img, err := saved.ExtractImage(5); err != nil || img.Width != 1 || img.SMask == 0 {
+		t.Errorf("deleted image after save = %+v, %v; want transparent 1x1", img, err)
+	}
+
+	if err := p.DeleteImage(4); !errors.Is(err, ErrXref) {
+		t.Errorf("DeleteImage of a content stream: got %v, want ErrXref", err)
+	}
+	if err := p.ReplaceImage(5, nil); !errors.Is(err, ErrInvalidArg) {
+		t.Errorf("ReplaceImage without data: got %v, want ErrInvalidArg", err)
+	}
+}
+
+// --- Shape tests ---
+
+func TestShapeFillRect(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+
+	s := p.NewShape()
+	s.DrawRect(NewRect(100, 100, 200, 150))
+	opts := DefaultFinishOptions()
+	opts.Fill = &ColorRed
+	opts.Color = nil
+	s.Finish(opts)
+	if err := s.Commit(true); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	pix, err := p.GetPixmap()
+	if err != nil {
+		t.Fatalf("GetPixmap: %v", err)
+	}
+	defer pix.Close()
+	if c := pix.GetPixel(150, 125); !bytes.Equal(c, []byte{255, 0, 0}) {
+		t.Errorf("pixel inside rect = %v, want red", c)
+	}
+	// The rectangle is measured from the top of the page.
+	if c := pix.GetPixel(150, 842-125); !bytes.Equal(c, []byte{255, 255, 255}) {
+		t.Errorf("pixel outside rect = %v, want white", c)
+	}
+}
+
+func TestShapeDrawings(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+
+	s := p.NewShape()
+	if end := s.DrawLine(NewPoint(50, 50), NewPoint(250, 50)); end != NewPoint(250, 50) {
+		t.Errorf("DrawLine = %v, want (250, 50)", end)
+	}
+	s.DrawPolyline([]Point{NewPoint(50, 80), NewPoint(100, 120), NewPoint(150, 80)})
+	s.DrawBezier(NewPoint(50, 200), NewPoint(100, 150), NewPoint(150, 250), NewPoint(200, 200))
+	s.Finish(FinishOptions{Color: &ColorBlue, Width: 4, Dashes: []float64{6, 3}, LineCap: LineCapRound})
+
+	end := s.DrawSector(NewPoint(300, 400), NewPoint(400, 400), 90, true)
+	if math.Abs(end.X-300) > 1e-6 || math.Abs(end.Y-500) > 1e-6 {
+		t.Errorf("DrawSector end = %v, want (300, 500)", end)
+	}
+	s.Finish(FinishOptions{Color: &ColorBlack, Fill: &ColorGreen, Width: 1, LineJoin: LineJoinRound})
+
+	s.DrawCircle(NewPoint(150, 600), 50)
+	s.DrawCircle(NewPoint(150, 600), 25)
+	s.Finish(FinishOptions{Fill: &ColorRed, FillOpacity: 0.5, EvenOdd: true})
+	if err := s.Commit(true); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	pix, err := p.GetPixmap()
+	if err != nil {
+		t.Fatalf("GetPixmap: %v", err)
+	}
+	defer pix.Close()
+	for _, tc := range []struct {
+		x, y int
+		want []byte
+	}{
+		{52, 50, []byte{0, 0, 255}},       // start of the dashed line
+		{340, 440, []byte{0, 255, 0}},     // inside the sector
+		{260, 440, []byte{255, 255, 255}}, // outside the sector
+		{110, 600, []byte{255, 128, 128}}, // translucent ring
+		{150, 600, []byte{255, 255, 255}}, // even-odd hole
+	} {
+		c := pix.GetPixel(tc.x, tc.y)
+		for i := range c {
+			if d := int(c[i]) - int(tc.want[i]); d < -2 || d > 2 {
+				t.Errorf("pixel at (%d, %d) = %v, want %v", tc.x, tc.y, c, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestShapeUnderlay(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+
+	top := p.NewShape()
+	top.DrawRect(NewRect(100, 100, 200, 200))
+	top.Finish(FinishOptions{Fill: &ColorBlue})
+	if err := top.Commit(true); err != nil {
+		t.Fatalf("Commit overlay: %v", err)
+	}
+	under := p.NewShape()
+	under.DrawRect(NewRect(50, 50, 250, 250))
+	under.Finish(FinishOptions{Fill: &ColorRed})
+	if err := under.Commit(false); err != nil {
+		t.Fatalf("Commit underlay: %v", err)
+	}
+
+	pix, err := p.GetPixmap()
+	if err != nil {
+		t.Fatalf("GetPixmap: %v", err)
+	}
+	defer pix.Close()
+	if c := pix.GetPixel(150, 150); !bytes.Equal(c, []byte{0, 0, 255}) {
+		t.Errorf("pixel of overlay = %v, want blue", c)
+	}
+	if c := pix.GetPixel(75, 75); !bytes.Equal(c, []byte{255, 0, 0}) {
+		t.Errorf("pixel of underlay = %v, want red", c)
+	}
+}
+
+func TestShapeErrors(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+
+	s := p.NewShape()
+	s.DrawLine(NewPoint(0, 0), NewPoint(100, 100))
+	if err := s.Commit(true); !errors.Is(err, ErrInvalidArg) {
+		t.Errorf("Commit before Finish = %v, want ErrInvalidArg", err)
+	}
+	s.Finish()
+	p.Close()
+	if err := s.Commit(true); !errors.Is(err, ErrClosed) {
+		t.Errorf("Commit on closed page = %v, want ErrClosed", err)
+	}
+}
+
+// --- Drawing extraction tests ---
+
+func TestGetDrawings(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+
+	s := p.NewShape()
+	s.DrawRect(NewRect(100, 100, 200, 150))
+	s.Finish(FinishOptions{Color: &ColorBlue, Fill: &ColorRed, Width: 2, Dashes: []float64{6, 3}})
+	s.DrawLine(NewPoint(50, 300), NewPoint(250, 320))
+	s.Finish(FinishOptions{Color: &ColorGreen, Width: 1, LineCap: LineCapRound, LineJoin: LineJoinBevel})
+	s.DrawCircle(NewPoint(300, 500), 40)
+	s.Finish(FinishOptions{Fill: &ColorBlack, FillOpacity: 0.5, EvenOdd: true})
+	if err := s.Commit(true); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	drawings, err := p.GetDrawings()
+	if err != nil {
+		t.Fatalf("GetDrawings: %v", err)
+	}
+	if len(drawings) != 3 {
+		t.Fatalf("GetDrawings returned %d drawings, want 3", len(drawings))
+	}
+
+	rect := drawings[0]
+	if len(rect.Items) != 1 || rect.Items[0].Kind != PathRect || rect.Items[0].Rect != NewRect(100, 100, 200, 150) {
+		t.Errorf("rect items = %+v, want one PathRect (100,100,200,150)", rect.Items)
+	}
+	if rect.Color == nil || *rect.Color != ColorBlue || rect.Fill == nil || *rect.Fill != ColorRed {
+		t.Errorf("rect colors = %v, %v; want blue stroke, red fill", rect.Color, rect.Fill)
+	}
+	if rect.Width != 2 || len(rect.Dashes) != 2 || rect.Dashes[0] != 6 || rect.Dashes[1] != 3 {
+		t.Errorf("rect width %v, dashes %v; want 2, [6 3]", rect.Width, rect.Dashes)
+	}
+	if !rect.Rect.ContainsRect(NewRect(100, 100, 200, 150)) {
+		t.Errorf("rect bounds %v do not contain the rectangle", rect.Rect)
+	}
+
+	line := drawings[1]
+	if len(line.Items) != 2 || line.Items[0].Kind != PathMove || line.Items[1].Kind != PathLine {
+		t.Fatalf("line items = %+v, want move and line", line.Items)
+	}
+	if pts := line.Items[1].Points; pts[0] != NewPoint(50, 300) || pts[1] != NewPoint(250, 320) {
+		t.Errorf("line points = %v, want (50,300)-(250,320)", pts)
+	}
+	if line.Fill != nil || line.LineCap != LineCapRound || line.LineJoin != LineJoinBevel {
+		t.Errorf("line fill %v, cap %d, join %d", line.Fill, line.LineCap, line.LineJoin)
+	}
+
+	circle := drawings[2]
+	if circle.Color != nil || circle.Fill == nil || !circle.EvenOdd || !circle.ClosePath {
+		t.Errorf("circle = %+v, want closed even-odd fill without stroke", circle)
+	}
+	if math.Abs(circle.FillOpacity-0.5) > 0.01 {
+		t.Errorf("circle fill opacity = %v, want 0.5", circle.FillOpacity)
+	}
+	curves := 0
+	for _, it := range circle.Items {
+		if it.Kind == PathCurve {
+			curves++
+		}
+	}
+	if curves != 4 {
+		t.Errorf("circle has %d curves, want 4", curves)
+	}
+	r := circle.Rect
+	if math.Abs(r.X0-260) > 0.5 || math.Abs(r.Y0-460) > 0.5 || math.Abs(r.X1-340) > 0.5 || math.Abs(r.Y1-540) > 0.5 {
+		t.Errorf("circle bounds = %v, want (260,460,340,540)", r)
+	}
+}
+
+func TestGetDrawingsEmpty(t *testing.T) {
+	doc := newTestPDFWithText(t, "no vector graphics")
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	drawings, err := p.GetDrawings()
+	if err != nil || len(drawings) != 0 {
+		t.Errorf("GetDrawings = %d drawings, %v; want none", len(drawings), err)
+	}
+	p.Close()
+	if _, err := p.GetDrawings(); !errors.Is(err, ErrClosed) {
+		t.Errorf("GetDrawings on closed page = %v, want ErrClosed", err)
+	}
+}
+
+// --- Device tests ---
+
+// recordingDevice records the calls of Page.Run that the tests look at.
+type recordingDevice struct {
+	BaseDevice
+	doc    *Document
+	fills  [][]PathItem
+	ctms   []Matrix
+	colors []DeviceColor
+	text   []TextSpan
+	images []DeviceImage
+	clips  int
+	pages  int
+}
+
+func (d *recordingDevice) FillPath(path []PathItem, evenOdd bool, ctm Matrix, color DeviceColor) {
+	d.fills = append(d.fills, path)
+	d.ctms = append(d.ctms, ctm)
+	d.colors = append(d.colors, color)
+}
+
+func (d *recordingDevice) FillText(text []TextSpan, ctm Matrix, color DeviceColor) {
+	d.text = append(d.text, text...)
+	// The document is not locked while the device runs.
+	d.pages = d.doc.PageCount()
+}
+
+func (d *recordingDevice) FillImage(img DeviceImage, ctm Matrix, alpha float64) {
+	d.images = append(d.images, img)
+}
+
+func (d *recordingDevice) ClipPath(path []PathItem, evenOdd bool, ctm Matrix, scissor Rect) {
+	d.clips++
+}
+
+func (d *recordingDevice) PopClip() { d.clips-- }
+
+func TestPageRun(t *testing.T) {
+	doc := newTestPDFWithText(t, "Hello")
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+	s := p.NewShape()
+	s.DrawRect(NewRect(100, 100, 200, 150))
+	s.Finish(FinishOptions{Fill: &ColorRed})
+	if err := s.Commit(true); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := p.InsertImage(NewRect(300, 300, 380, 340), testPNG(t)); err != nil {
+		t.Fatalf("InsertImage: %v", err)
+	}
+
+	dev := &recordingDevice{doc: doc}
+	if err := p.Run(dev, ScaleMatrix(2, 2)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if len(dev.fills) != 1 || len(dev.fills[0]) != 1 || dev.fills[0][0].Kind != PathRect {
+		t.Fatalf("fills = %+v, want one rectangle", dev.fills)
+	}
+	r := dev.fills[0][0].Rect.Transform(dev.ctms[0])
+	if want := NewRect(200, 200, 400, 300); math.Abs(r.X0-want.X0) > 0.01 || math.Abs(r.Y1-want.Y1) > 0.01 {
+		t.Errorf("rectangle in device space = %v, want %v", r, want)
+	}
+	if c := dev.colors[0]; c.Colorspace != "DeviceRGB" || c.RGB != ColorRed || c.Alpha != 1 || len(c.Components) != 3 {
+		t.Errorf("fill color = %+v, want opaque DeviceRGB red", c)
+	}
+
+	var text strings.Builder
+	for _, span := range dev.text {
+		if !strings.Contains(span.Font, "Helvetica") {
+			t.Errorf("span font = %q, want Helvetica", span.Font)
+		}
+		for _, g := range span.Glyphs {
+			text.WriteRune(g.Rune)
+		}
+	}
+	if text.String() != "Hello" {
+		t.Errorf("text = %q, want %q", text.String(), "Hello")
+	}
+	if dev.pages != 1 {
+		t.Errorf("PageCount inside the device = %d, want 1", dev.pages)
+	}
+
+	if len(dev.images) != 1 || dev.images[0].Width != 8 || dev.images[0].Height != 4 {
+		t.Errorf("images = %+v, want one 8x4 image", dev.images)
+	}
+	if dev.clips != 0 {
+		t.Errorf("clip depth after run = %d, want 0", dev.clips)
+	}
+}
+
+type panickingDevice struct{ BaseDevice }
+
+func (panickingDevice) FillText([]TextSpan, Matrix, DeviceColor) { panic("stop") }
+
+func TestPageRunSubsetFont(t *testing.T) {
+	doc, err := OpenFromMemory(formFontPDF, "application/pdf", OpenOptions{LogFunc: func(LogMessage) {}})
+	if err != nil {
+		t.Fatalf("OpenFromMemory: %v", err)
+	}
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+
+	dev := &recordingDevice{doc: doc}
+	if err := p.Run(dev, Identity); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var fonts []string
+	for _, span := range dev.text {
+		fonts = append(fonts, span.Font)
+	}
+	if len(fonts) != 2 || fonts[1] != "Courier" {
+		t.Errorf("span fonts = %q, want the form's font without its subset tag", fonts)
+	}
+}
+
+func TestPageRunPanic(t *testing.T) {
+	doc := newTestPDFWithText(t, "Hello")
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+	func() {
+		defer func() {
+			if v := recover(); v != "stop" {
+				t.Errorf("recovered %v, want the device's panic", v)
+			}
+		}()
+		p.Run(panickingDevice{}, Identity)
+	}()
+	// The page is still usable.
+	if err := p.Run(BaseDevice{}, Identity); err != nil {
+		t.Errorf("Run after panic: %v", err)
+	}
+	if err := p.Run(nil, Identity); !errors.Is(err, ErrInvalidArg) {
+		t.Errorf("Run(nil) = %v, want ErrInvalidArg", err)
+	}
+}
+
+// --- TextOptions tests ---
+
+func TestTextOptionsClip(t *testing.T) {
+	doc := newTestPDFWithText(t, "Inside")
+	defer doc.Close()
+	page, _ := doc.LoadPage(0)
+	defer page.Close()
+	if _, err := page.InsertText(NewPoint(72, 400), "Outside"); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := DefaultTextOptions()
+	opt.Clip = NewRect(0, 0, 595, 200)
+	text, err := page.GetTextWithOptions("text", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "Inside") || strings.Contains(text, "Outside") {
+		t.Errorf("clipped text = %q", text)
+	}
+	words, err := page.GetTextWordsWithOptions(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(words) != 1 || words[0].Text != "Inside" {
+		t.Errorf("clipped words = %+v", words)
+	}
+	blocks, err := page.GetTextBlocksWithOptions(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || blocks[0].Rect.Y1 > 200 {
+		t.Errorf("clipped blocks = %+v", blocks)
+	}
+
+	// A character counts as inside only if most of it is.
+	tp, err := page.GetTextPageWithOptions(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	r := tp.Blocks()[0].Lines[0].Chars[0].Rect
+	opt.Clip = NewRect(0, 0, r.X0+r.Width()/4, 842)
+	if text, _ := page.GetTextWithOptions("text", opt); strings.TrimSpace(text) != "" {
+		t.Errorf("text of a mostly clipped character = %q", text)
+	}
+	opt.Clip = NewRect(0, 0, r.X1-r.Width()/4, 842)
+	if text, _ := page.GetTextWithOptions("text", opt); strings.TrimSpace(text) != "I" {
+		t.Errorf("text of a mostly inside character = %q", text)
+	}
+}
+
+func TestTextOptionsSort(t *testing.T) {
+	doc, err := NewPDF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer doc.Close()
+	page, err := doc.NewPage(-1, 595, 842)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Close()
+	for _, ins := range []struct {
+		p    Point
+		text string
+	}{{NewPoint(72, 600), "Third"}, {NewPoint(300, 350), "Second"}, {NewPoint(72, 100), "First"}} {
+		if _, err := page.InsertText(ins.p, ins.text); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	order := func(opt TextOptions) []string {
+		t.Helper()
+		blocks, err := page.GetTextBlocksWithOptions(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var texts []string
+		for _, b := range blocks {
+			texts = append(texts, strings.TrimSpace(b.Text))
+		}
+		return texts
+	}
+	if got := order(DefaultTextOptions()); strings.Join(got, " ") != "Third Second First" {
+		t.Errorf("unsorted blocks = %q", got)
+	}
+	opt := DefaultTextOptions()
+	opt.Sort = true
+	if got := order(opt); strings.Join(got, " ") != "First Second Third" {
+		t.Errorf("sorted blocks = %q", got)
+	}
+}
+
+func TestTextOptionsZeroFlags(t *testing.T) {
+	if opt := (TextOptions{Clip: NewRect(0, 0, 100, 100)}).withDefaults(); opt.Flags != TextFlagsDefault {
+		t.Errorf("flags of zero TextOptions = %d, want TextFlagsDefault", opt.Flags)
+	}
+	if opt := (TextOptions{Flags: TextPreserveImages}).withDefaults(); opt.Flags != TextPreserveImages {
+		t.Errorf("explicit flags = %d, want TextPreserveImages", opt.Flags)
+	}
+	// The flags argument still allows extracting with no flags at all.
+	if opt := textFlags([]int{0}); opt.Flags != 0 {
+		t.Errorf("flags of GetText(output, 0) = %d, want 0", opt.Flags)
+	}
+	if opt := textFlags(nil); opt.Flags != TextFlagsDefault {
+		t.Errorf("flags when omitted = %d, want TextFlagsDefault", opt.Flags)
+	}
+}
+
+// --- Table tests ---
+
+// insertTexts writes each text at its point on page.
+func insertTexts(t *testing.T, page *Page, texts map[Point]string) {
+	t.Helper()
+	for p, text := range texts {
+		if _, err := page.InsertText(p, text); err != nil {
+			t.Fatalf("InsertText: %v", err)
+		}
+	}
+}
+
+func TestFindTablesLines(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	page, _ := doc.LoadPage(0)
+	defer page.Close()
+
+	// A 3x3 grid from (100,100) to (400,190); the last row has one cell
+	// spanning the first two columns.
+	s := page.NewShape()
+	for _, y := range []float64{100, 130, 160, 190} {
+		s.DrawLine(NewPoint(100, y), NewPoint(400, y))
+	}
+	s.DrawLine(NewPoint(100, 100), NewPoint(100, 190))
+	s.DrawLine(NewPoint(200, 100), NewPoint(200, 160))
+	s.DrawLine(NewPoint(300, 100), NewPoint(300, 190))
+	s.DrawLine(NewPoint(400, 100), NewPoint(400, 190))
+	s.Finish()
+	if err := s.Commit(true); err != nil {
+		t.Fatal(err)
+	}
+	insertTexts(t, page, map[Point]string{
+		NewPoint(105, 120): "Item", NewPoint(205, 120): "Qty", NewPoint(305, 120): "Price",
+		NewPoint(105, 150): "Apples", NewPoint(205, 150): "3", NewPoint(305, 150): "1.50",
+		NewPoint(105, 180): "Total", NewPoint(305, 180): "4.50",
+	})
+
+	tables, err := page.FindTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 {
+		t.Fatalf("found %d tables, want 1", len(tables))
+	}
+	tab := tables[0]
+	if tab.Rect != NewRect(100, 100, 400, 190) {
+		t.Errorf("table rect = %v", tab.Rect)
+	}
+	want := [][]string{{"Item", "Qty", "Price"}, {"Apples", "3", "1.50"}, {"Total", "", "4.50"}}
+	if got := tab.ToRows(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("rows = %q, want %q", got, want)
+	}
+	if merged := tab.Cells[2][0].Rect; merged != NewRect(100, 160, 300, 190) {
+		t.Errorf("merged cell rect = %v", merged)
+	}
+	if !tab.Cells[2][1].Rect.IsEmpty() {
+		t.Errorf("covered cell rect = %v, want empty", tab.Cells[2][1].Rect)
+	}
+	if fmt.Sprint(tab.Header) != "[Item Qty Price]" {
+		t.Errorf("header = %q", tab.Header)
+	}
+	if csv := tab.ToCSV(); csv != "Item,Qty,Price\nApples,3,1.50\nTotal,,4.50\n" {
+		t.Errorf("CSV = %q", csv)
+	}
+	wantMD := "|Item|Qty|Price|\n|---|---|---|\n|Apples|3|1.50|\n|Total||4.50|\n"
+	if md := tab.ToMarkdown(); md != wantMD {
+		t.Errorf("Markdown = %q, want %q", md, wantMD)
+	}
+
+	opt := DefaultTableOptions()
+	opt.Strategy = TableStrategyText
+	if tables, _ := page.FindTables(opt); len(tables) != 1 || len(tables[0].Cells) != 3 {
+		t.Errorf("text strategy found %d tables", len(tables))
+	}
+	opt = DefaultTableOptions()
+	opt.Clip = NewRect(0, 300, 595, 842)
+	if tables, _ := page.FindTables(opt); len(tables) != 0 {
+		t.Errorf("found %d tables outside the clip", len(tables))
+	}
+}
+
+func TestFindTablesText(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	page, _ := doc.LoadPage(0)
+	defer page.Close()
+
+	insertTexts(t, page, map[Point]string{
+		NewPoint(72, 100):  "A paragraph of ordinary text above the statement.",
+		NewPoint(300, 140): "2024", NewPoint(400, 140): "2023",
+		NewPoint(72, 155): "Revenue", NewPoint(300, 155): "1,200", NewPoint(400, 155): "1,100",
+		NewPoint(72, 170): "Cost of sales", NewPoint(300, 170): "(800)", NewPoint(400, 170): "(700)",
+		NewPoint(72, 185): "Gross profit", NewPoint(300, 185): "400", NewPoint(400, 185): "400",
+		NewPoint(72, 300): "Two columns of running text are", NewPoint(320, 300): "not a table even if their lines",
+		NewPoint(72, 315): "line up with each other on the", NewPoint(320, 315): "page, as they do in this case",
+		NewPoint(72, 330): "and continue for a few lines.", NewPoint(320, 330): "with more words than a table.",
+	})
+
+	tables, err := page.FindTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 {
+		t.Fatalf("found %d tables, want 1: %+v", len(tables), tables)
+	}
+	want := [][]string{
+		{"", "2024", "2023"},
+		{"Revenue", "1,200", "1,100"},
+		{"Cost of sales", "(800)", "(700)"},
+		{"Gross profit", "400", "400"},
+	}
+	if got := tables[0].ToRows(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("rows = %q, want %q", got, want)
+	}
+	// The years are numbers, so the first row is not taken for a header.
+	if tables[0].Header != nil {
+		t.Errorf("header = %q", tables[0].Header)
+	}
+	if md := tables[0].ToMarkdown(); !strings.HasPrefix(md, "|Col1|Col2|Col3|\n|---|---|---|\n||2024|2023|\n") {
+		t.Errorf("Markdown = %q", md)
+	}
+
+	opt := DefaultTableOptions()
+	opt.Strategy = TableStrategyLines
+	if tables, _ := page.FindTables(opt); len(tables) != 0 {
+		t.Errorf("lines strategy found %d tables on a page without lines", len(tables))
+	}
+}
+
+// --- Markdown tests ---
+
+func TestPageToMarkdown(t *testing.T) {
+	doc := newTestPDFWithPage(t)
+	defer doc.Close()
+	page, _ := doc.LoadPage(0)
+	defer page.Close()
+
+	for _, ins := range []struct {
+		pos  Point
+		text string
+		opts []TextInsertOption
+	}{
+		{NewPoint(72, 72), "Report", []TextInsertOption{WithFontSize(24)}},
+		{NewPoint(72, 110), "Summary", []TextInsertOption{WithFontSize(16)}},
+		{NewPoint(72, 140), "Sales grew", nil},
+		{NewPoint(130, 140), "strongly", []TextInsertOption{WithFontName("Helvetica-Bold")}},
+		{NewPoint(72, 180), "- First point", nil},
+		{NewPoint(72, 220), "2) Second point", nil},
+		{NewPoint(72, 260), "See the website", nil},
+	} {
+		if _, err := page.InsertText(ins.pos, ins.text, ins.opts...); err != nil {
+			t.Fatalf("InsertText(%q): %v", ins.text, err)
+		}
+	}
+	s := page.NewShape()
+	for _, y := range []float64{400, 430, 460} {
+		s.DrawLine(NewPoint(100, y), NewPoint(300, y))
+	}
+	for _, x := range []float64{100, 200, 300} {
+		s.DrawLine(NewPoint(x, 400), NewPoint(x, 460))
+	}
+	s.Finish()
+	if err := s.Commit(true); err != nil {
+		t.Fatal(err)
+	}
+	insertTexts(t, page, map[Point]string{
+		NewPoint(105, 420): "Item", NewPoint(205, 420): "Qty",
+		NewPoint(105, 450): "Apples", NewPoint(205, 450): "3",
+	})
+	if err := page.InsertImage(NewRect(100, 500, 150, 550), testPNG(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	md, err := page.ToMarkdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Report\n\n## Summary\n\nSales grew **strongly**\n\n- First point\n\n2. Second point\n\n" +
+		"See the website\n\n|Item|Qty|\n|---|---|\n|Apples|3|\n"
+	if md != want {
+		t.Errorf("Markdown = %q, want %q", md, want)
+	}
+
+	// Links on the page are written around their text.
+	m, err := page.markdownPage(DefaultMarkdownOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	quads, err := page.SearchFor("website", false)
+	if err != nil || len(quads) != 1 {
+		t.Fatalf("SearchFor: %v, %d hits", err, len(quads))
+	}
+	m.links = []Link{{Rect: quads[0].Rect(), URI: "https://example.com"}}
+	if got := m.markdown(headingLevels([]mdPage{m})); !strings.Contains(got, "See the [website](https://example.com)\n") {
+		t.Errorf("Markdown with link = %q", got)
+	}
+
+	opt := DefaultMarkdownOptions()
+	opt.ImageDir = t.TempDir()
+	md, err = page.ToMarkdown(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.ToSlash(filepath.Join(opt.ImageDir, "page0-image0.png"))
+	if !strings.HasSuffix(md, "|Apples|3|\n\n![]("+path+")\n") {
+		t.Errorf("Markdown with images = %q", md)
+	}
+	if data, err := os.ReadFile(path); err != nil || !bytes.HasPrefix(data, []byte("\x89PNG")) {
+		t.Errorf("image file: %v", err)
+	}
+}
+
+func TestDocumentToMarkdown(t *testing.T) {
+	doc := newTestPDFWithPages(t, 3)
+	defer doc.Close()
+	for pno, ins := range []struct {
+		text string
+		size float64
+	}{{"Title", 20}, {"Body text", 11}, {"Chapter", 16}} {
+		page, _ := doc.LoadPage(pno)
+		if _, err := page.InsertText(NewPoint(72, 200), ins.text, WithFontSize(ins.size)); err != nil {
+			t.Fatal(err)
+		}
+		page.Close()
+	}
+
+	// Heading levels are chosen across the pages converted.
+	md, err := doc.ToMarkdown(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Page 0\n\n# Title\n\nPage 1\n\nBody text\n\nPage 2\n\n## Chapter\n"; md != want {
+		t.Errorf("Markdown = %q, want %q", md, want)
+	}
+	md, err = doc.ToMarkdown([]int{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Page 1\n\nBody text\n\nPage 2\n\n# Chapter\n"; md != want {
+		t.Errorf("Markdown = %q, want %q", md, want)
+	}
+	if _, err := doc.ToMarkdown([]int{5}); err == nil {
+		t.Error("expected error for invalid page")
+	}
+}
+
+// --- Chunk tests ---
+
+func TestDocumentChunks(t *testing.T) {
+	doc, err := NewPDF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer doc.Close()
+	for pno, texts := range []map[Point]string{{
+		NewPoint(72, 100): "The first paragraph introduces",
+		NewPoint(72, 114): "the subject of the document.",
+		NewPoint(72, 772): "The second paragraph describes the",
+		NewPoint(72, 786): "methods, and it is long enough",
+		NewPoint(72, 800): "that it continues",
+	}, {
+		NewPoint(72, 72):  "on the next page.",
+		NewPoint(72, 200): "A last paragraph.",
+	}} {
+		page, err := doc.NewPage(-1, 595, 842)
+		if err != nil {
+			t.Fatal(err)
+		}
+		insertTexts(t, page, texts)
+		if pno == 0 {
+			for p, title := range map[Point]string{NewPoint(72, 72): "Introduction", NewPoint(72, 740): "Methods"} {
+				if _, err := page.InsertText(p, title, WithFontSize(18)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		page.Close()
+	}
+
+	chunks, err := doc.Chunks(DefaultChunkOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Introduction\n\nThe first paragraph introduces the subject of the document.",
+		"Methods\n\nThe second paragraph describes the methods, and it is long enough that it continues on the next page.\n\nA last paragraph.",
+	}
+	var texts []string
+	for _, c := range chunks {
+		texts = append(texts, c.Text)
+	}
+	if fmt.Sprint(texts) != fmt.Sprint(want) {
+		t.Fatalf("chunks = %q, want %q", texts, want)
+	}
+	var pages []int
+	for _, span := range chunks[1].Spans {
+		pages = append(pages, span.Page)
+	}
+	if fmt.Sprint(pages) != "[0 0 1 1]" {
+		t.Errorf("span pages = %v, want [0 0 1 1]", pages)
+	}
+	if r := chunks[1].Spans[1].Rect; r.Y0 > 772 || r.Y1 < 800 {
+		t.Errorf("span of the continued paragraph = %v", r)
+	}
+
+	// A size budget splits paragraphs between lines, and long lines
+	// between words.
+	opt := DefaultChunkOptions()
+	opt.MaxSize = 5
+	opt.Size = func(s string) int { return len(strings.Fields(s)) }
+	chunks, err = doc.Chunks(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range chunks {
+		if n := len(strings.Fields(c.Text)); n > 5 {
+			t.Errorf("chunk %q has %d words", c.Text, n)
+		}
+		if len(c.Spans) == 0 {
+			t.Errorf("chunk %q has no spans", c.Text)
+		}
+	}
+	if chunks[0].Text != "Introduction\n\nThe first paragraph introduces" || chunks[len(chunks)-1].Text != "A last paragraph." {
+		t.Errorf("chunks = %q", chunks)
+	}
+
+	opt = DefaultChunkOptions()
+	opt.Pages = []int{1}
+	if chunks, _ := doc.Chunks(opt); len(chunks) != 1 || chunks[0].Text != "on the next page.\n\nA last paragraph." {
+		t.Errorf("chunks of page 1 = %q", chunks)
+	}
+	opt.Pages = []int{0}
+	if chunks, _ := doc.Chunks(opt); len(chunks) != 2 || !strings.HasSuffix(chunks[1].Text, "that it continues") {
+		t.Errorf("chunks of page 0 = %q", chunks)
+	}
+	// The zero options put each section of every page in one chunk.
+	if chunks, _ := doc.Chunks(ChunkOptions{}); len(chunks) != 2 || chunks[1].Text != want[1] {
+		t.Errorf("chunks with zero options = %q", chunks)
+	}
+
+	// Table of contents entries start at their heading, or at the top of
+	// their page.
+	var mds []mdPage
+	for pno := range 2 {
+		blocks, err := doc.pageBlocks(pno)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mds = append(mds, mdPage{blocks: blocks})
+	}
+	toc := []TOCItem{{Level: 1, Title: "Part", Page: 1}, {Level: 2, Title: "Methods", Page: 1}, {Level: 1, Title: "End", Page: 2}}
+	var paths []string
+	for _, c := range chunkText(chunkParas([]int{0, 1}, mds, toc), DefaultChunkOptions()) {
+		paths = append(paths, strings.Join(c.TOCPath, "/"))
+	}
+	if want := "[Part Part/Methods End]"; fmt.Sprint(paths) != want {
+		t.Errorf("TOC paths = %v, want %v", paths, want)
+	}
+
+	// Entries out of page order still start where they point.
+	toc = []TOCItem{{Level: 1, Title: "Part", Page: 1}, {Level: 1, Title: "End", Page: 2}, {Level: 2, Title: "Methods", Page: 1}}
+	paths = nil
+	for _, c := range chunkText(chunkParas([]int{0, 1}, mds, toc), DefaultChunkOptions()) {
+		paths = append(paths, strings.Join(c.TOCPath, "/"))
+	}
+	if want := "[Part End/Methods End]"; fmt.Sprint(paths) != want {
+		t.Errorf("TOC paths of an out of order TOC = %v, want %v", paths, want)
+	}
+
+	// Entries of pages left out apply from the next page split.
+	toc = []TOCItem{{Level: 1, Title: "Part", Page: 1}, {Level: 1, Title: "Skipped", Page: 4}}
+	paths = nil
+	for _, c := range chunkText(chunkParas([]int{0, 5}, mds, toc), DefaultChunkOptions()) {
+		paths = append(paths, strings.Join(c.TOCPath, "/"))
+	}
+	if want := "[Part Part Skipped]"; fmt.Sprint(paths) != want {
+		t.Errorf("TOC paths with a skipped page = %v, want %v", paths, want)
+	}
+
+	doc.Close()
+	if _, err := doc.Chunks(DefaultChunkOptions()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Chunks on closed document: %v", err)
+	}
+}
+
+// --- TextInsertOption tests ---
+
+func TestTextInsertOptions(t *testing.T) {
+	cfg := textInsertConfig{}
+	WithFontName("Courier")(&cfg)
+	if cfg.fontname != "Courier" {
+		t.Errorf("expected Courier, got %s", cfg.fontname)
+	}
+	WithFontSize(14)(&cfg)
+	if cfg.fontsize != 14 {
+		t.Errorf("expected 14, got %f", cfg.fontsize)
+	}
+	WithColor(ColorBlue)(&cfg)
+	if cfg.color != ColorBlue {
+		t.Error("color mismatch")
+	}
+	WithRotate(90)(&cfg)
+	if cfg.rotate != 90 {
+		t.Errorf("expected 90, got %d", cfg.rotate)
+	}
+}
+
+// --- PixmapOption tests ---
 
 func TestPixmapOptions(t *testing.T) {
 	cfg := pixmapConfig{}
@@ -2511,3 +4731,314 @@ func TestFontSubsettingSize(t *testing.T) {
 		t.Logf("%-20s %6d bytes (%5.1f KB)", tc.name, fi.Size(), float64(fi.Size())/1024)
 	}
 }
+
+// --- Concurrency tests ---
+
+// newTestPDFWithPages creates a PDF with n pages, each containing the text
+// "Page <i>".
+func newTestPDFWithPages(t *testing.T, n int) *Document {
+	t.Helper()
+	doc, err := NewPDF()
+	if err != nil {
+		t.Fatalf("NewPDF: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		p, err := doc.NewPage(-1, 595, 842)
+		if err != nil {
+			doc.Close()
+			t.Fatalf("NewPage: %v", err)
+		}
+		if _, err := p.InsertText(NewPoint(72, 72), fmt.Sprintf("Page %d", i)); err != nil {
+			p.Close()
+			doc.Close()
+			t.Fatalf("InsertText: %v", err)
+		}
+		p.Close()
+	}
+	return doc
+}
+
+func TestConcurrentPages(t *testing.T) {
+	const pages = 8
+	doc := newTestPDFWithPages(t, pages)
+	defer doc.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, pages*4)
+	for round := 0; round < 4; round++ {
+		for i := 0; i < pages; i++ {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				p, err := doc.LoadPage(n)
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer p.Close()
+
+				pix, err := p.GetPixmap(WithDPI(36))
+				if err != nil {
+					errs <- fmt.Errorf("page %d: GetPixmap: %w", n, err)
+					return
+				}
+				if pix.Width() == 0 {
+					errs <- fmt.Errorf("page %d: empty pixmap", n)
+				}
+				pix.Close()
+
+				want := fmt.Sprintf("Page %d", n)
+				text, err := p.GetText("text")
+				if err != nil {
+					errs <- fmt.Errorf("page %d: GetText: %w", n, err)
+					return
+				}
+				if !strings.Contains(text, want) {
+					errs <- fmt.Errorf("page %d: GetText = %q, want %q", n, text, want)
+				}
+
+				quads, err := p.SearchFor(want, false)
+				if err != nil {
+					errs <- fmt.Errorf("page %d: SearchFor: %w", n, err)
+					return
+				}
+				if len(quads) != 1 {
+					errs <- fmt.Errorf("page %d: SearchFor found %d hits, want 1", n, len(quads))
+				}
+
+				if _, err := p.GetTextWords(); err != nil {
+					errs <- fmt.Errorf("page %d: GetTextWords: %w", n, err)
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestConcurrentSamePage(t *testing.T) {
+	doc := newTestPDFWithText(t, "Shared page")
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tp, err := p.GetTextPage()
+			if err != nil {
+				t.Errorf("GetTextPage: %v", err)
+				return
+			}
+			defer tp.Close()
+			pix, err := p.GetPixmap(WithDPI(36))
+			if err != nil {
+				t.Errorf("GetPixmap: %v", err)
+				return
+			}
+			pix.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPixmapOutlivesDocument(t *testing.T) {
+	doc := newTestPDFWithText(t, "Outlive")
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		doc.Close()
+		t.Fatalf("LoadPage: %v", err)
+	}
+	pix, err := p.GetPixmap(WithDPI(36))
+	p.Close()
+	doc.Close()
+	if err != nil {
+		t.Fatalf("GetPixmap: %v", err)
+	}
+	defer pix.Close()
+	if _, err := pix.ToBytes(); err != nil {
+		t.Errorf("ToBytes after document Close: %v", err)
+	}
+}
+
+// --- Cancellation tests ---
+
+func TestCtxMethodsCancelled(t *testing.T) {
+	doc := newTestPDFWithText(t, "Cancel me")
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := p.GetPixmapCtx(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetPixmapCtx: got %v, want context.Canceled", err)
+	}
+	if _, err := p.GetTextCtx(ctx, "text"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetTextCtx: got %v, want context.Canceled", err)
+	}
+	if _, err := p.SearchForCtx(ctx, "Cancel", false); !errors.Is(err, context.Canceled) {
+		t.Errorf("SearchForCtx: got %v, want context.Canceled", err)
+	}
+	if _, err := doc.ConvertToPDFCtx(ctx, 0, -1, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("ConvertToPDFCtx: got %v, want context.Canceled", err)
+	}
+}
+
+func TestCtxMethodsDeadline(t *testing.T) {
+	doc := newTestPDFWithText(t, "Deadline")
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if _, err := p.GetPixmapCtx(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetPixmapCtx: got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestCtxMethodsComplete(t *testing.T) {
+	doc := newTestPDFWithText(t, "Live context")
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pix, err := p.GetPixmapCtx(ctx, WithDPI(36))
+	if err != nil {
+		t.Fatalf("GetPixmapCtx: %v", err)
+	}
+	pix.Close()
+	text, err := p.GetTextCtx(ctx, "text")
+	if err != nil {
+		t.Fatalf("GetTextCtx: %v", err)
+	}
+	if !strings.Contains(text, "Live context") {
+		t.Errorf("GetTextCtx = %q", text)
+	}
+	quads, err := p.SearchForCtx(ctx, "Live", false)
+	if err != nil {
+		t.Fatalf("SearchForCtx: %v", err)
+	}
+	if len(quads) != 1 {
+		t.Errorf("SearchForCtx found %d hits, want 1", len(quads))
+	}
+	data, err := doc.ConvertToPDFCtx(ctx, 0, -1, 0)
+	if err != nil {
+		t.Fatalf("ConvertToPDFCtx: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF")) {
+		t.Error("ConvertToPDFCtx did not return a PDF")
+	}
+}
+
+func TestWithProgress(t *testing.T) {
+	doc := newTestPDFWithText(t, "Progress")
+	defer doc.Close()
+	p, err := doc.LoadPage(0)
+	if err != nil {
+		t.Fatalf("LoadPage: %v", err)
+	}
+	defer p.Close()
+
+	var calls int
+	var last Progress
+	ctx := WithProgress(context.Background(), func(pr Progress) {
+		calls++
+		last = pr
+	})
+	pix, err := p.GetPixmapCtx(ctx)
+	if err != nil {
+		t.Fatalf("GetPixmapCtx: %v", err)
+	}
+	pix.Close()
+	if calls == 0 {
+		t.Fatal("progress callback was never called")
+	}
+	if last.Current <= 0 {
+		t.Errorf("final progress = %+v, want Current > 0", last)
+	}
+}
+
+// --- Memory tests ---
+
+func TestMemoryStats(t *testing.T) {
+	doc := newTestPDFWithText(t, "Memory")
+	defer doc.Close()
+
+	st := doc.MemoryStats()
+	if st.Allocated <= 0 || st.Peak < st.Allocated {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+	if st.Limit != 0 {
+		t.Errorf("Limit = %d, want 0", st.Limit)
+	}
+	if st.StoreMax != 256<<20 {
+		t.Errorf("StoreMax = %d, want default store size", st.StoreMax)
+	}
+	if st.StoreSize < 0 {
+		t.Error("StoreSize could not be read from fz_debug_store")
+	}
+	if !doc.ShrinkStore(0) {
+		t.Error("ShrinkStore(0) failed")
+	}
+	if st := doc.MemoryStats(); st.StoreSize != 0 {
+		t.Errorf("StoreSize after ShrinkStore(0) = %d", st.StoreSize)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	doc, err := NewPDF(OpenOptions{MemoryLimit: 64 << 20, StoreSize: 16 << 20})
+	if err != nil {
+		t.Fatalf("NewPDF: %v", err)
+	}
+	defer doc.Close()
+	p, err := doc.NewPage(-1, 595, 842)
+	if err != nil {
+		t.Fatalf("NewPage: %v", err)
+	}
+	defer p.Close()
+
+	if st := doc.MemoryStats(); st.Limit != 64<<20 || st.StoreMax != 16<<20 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+	// About 1.1 GB of samples.
+	_, err = p.GetPixmap(WithDPI(2000))
+	if !errors.Is(err, ErrMemoryLimit) {
+		t.Fatalf("expected ErrMemoryLimit, got %v", err)
+	}
+	if !errors.Is(err, ErrPixmap) {
+		t.Errorf("expected error to match ErrPixmap too, got %v", err)
+	}
+	if st := doc.MemoryStats(); st.Refused == 0 {
+		t.Error("Refused should count the failed allocation")
+	}
+
+	// Small renders still work within the limit.
+	pix, err := p.GetPixmap(WithDPI(72))
+	if err != nil {
+		t.Fatalf("GetPixmap within limit: %v", err)
+	}
+	pix.Close()
+}
@@ -25,6 +25,9 @@ import "unsafe"
 //	    `<p style="color:red; font-size:16px;">Hello <b>World</b></p>`,
 //	)
 func (p *Page) InsertHTMLBox(rect Rect, html string, opts ...HTMLBoxOptions) (HTMLBoxResult, error) {
+	if p.closed() {
+		return HTMLBoxResult{}, ErrClosed
+	}
 	if !p.doc.IsPDF() {
 		return HTMLBoxResult{}, ErrNotPDF
 	}
@@ -52,13 +55,14 @@ func (p *Page) InsertHTMLBox(rect Rect, html string, opts ...HTMLBoxOptions) (HT
 	}
 
 	var spareHeight, scaleUsed C.float
+	var overflow C.int
 	errcode := C.gomupdf_insert_htmlbox(p.ctx.ctx, p.doc.pdf, C.int(p.number),
 		C.float(rect.X0), C.float(rect.Y0), C.float(rect.X1), C.float(rect.Y1),
 		cHTML, cCSS, C.float(opt.ScaleLow), overlay,
-		&spareHeight, &scaleUsed)
+		&spareHeight, &scaleUsed, &overflow)
 
-	if errcode == 1 {
-		return HTMLBoxResult{}, ErrSave
+	if errcode != 0 {
+		return HTMLBoxResult{}, p.ctx.failed("Page.InsertHTMLBox", errcode, ErrSave)
 	}
 
 	result := HTMLBoxResult{
@@ -66,7 +70,7 @@ func (p *Page) InsertHTMLBox(rect Rect, html string, opts ...HTMLBoxOptions) (HT
 		Scale:       float64(scaleUsed),
 	}
 
-	if errcode == 2 {
+	if overflow != 0 {
 		// Content overflow — didn't fit, but not a hard error
 		return result, ErrOverflow
 	}
@@ -0,0 +1,207 @@
+//go:build cgo && !nomupdf
+
+package gomupdf
+
+/*
+#include "gomupdf.h"
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// GetImages lists the image XObjects the page uses, including those of
+// Form XObjects drawn on it. Each image is reported once; inline images
+// are not included. PDF only.
+func (p *Page) GetImages() ([]ImageInfo, error) {
+	p.doc.mu.Lock()
+	defer p.doc.mu.Unlock()
+	if p.closed() {
+		return nil, ErrClosed
+	}
+	if p.doc.pdf == nil {
+		return nil, ErrNotPDF
+	}
+	pdfPage := C.pdf_page_from_fz_page(p.ctx.ctx, p.page)
+	if pdfPage == nil {
+		return nil, ErrNotPDF
+	}
+	var count, errcode C.int
+	res := C.gomupdf_page_resources(p.ctx.ctx, pdfPage, C.GOMUPDF_RES_IMAGE, &count, &errcode)
+	if errcode != 0 {
+		return nil, p.ctx.failed("Page.GetImages", errcode, ErrXref)
+	}
+	defer C.gomupdf_free(p.ctx.ctx, unsafe.Pointer(res))
+
+	images := make([]ImageInfo, 0, int(count))
+	for _, r := range unsafe.Slice(res, int(count)) {
+		var info C.gomupdf_image_info
+		C.gomupdf_image_get_info(p.ctx.ctx, r.obj, &info, &errcode)
+		if errcode != 0 {
+			return nil, p.ctx.failed("Page.GetImages", errcode, ErrXref)
+		}
+		images = append(images, ImageInfo{
+			Xref:       int(r.xref),
+			SMask:      int(info.smask),
+			Width:      int(info.width),
+			Height:     int(info.height),
+			BPC:        int(info.bpc),
+			Colorspace: C.GoString(info.colorspace),
+			AltCS:      C.GoString(info.altcs),
+			Name:       C.GoString(r.name),
+			Filter:     C.GoString(info.filter),
+			Referencer: int(r.referencer),
+		})
+	}
+	return images, nil
+}
+
+// GetImageRects returns every place where the image XObject xref, as
+// reported in ImageInfo.Xref, is drawn on the page, in drawing order. The
+// content streams of the page and its annotations are interpreted and the
+// image is matched by its xref, so images inside Form XObjects and images
+// drawn several times are all found. PDF only.
+func (p *Page) GetImageRects(xref int) ([]ImageRect, error) {
+	p.doc.mu.Lock()
+	defer p.doc.mu.Unlock()
+	if p.closed() {
+		return nil, ErrClosed
+	}
+	if p.doc.pdf == nil {
+		return nil, ErrNotPDF
+	}
+	if xref <= 0 || xref >= int(C.gomupdf_xref_len(p.ctx.ctx, p.doc.pdf)) {
+		return nil, fmt.Errorf("%w: xref %d", ErrInvalidArg, xref)
+	}
+	var count, errcode C.int
+	ctms := C.gomupdf_image_placements(p.ctx.ctx, p.doc.pdf, p.page, C.int(xref), &count, &errcode)
+	if errcode != 0 {
+		return nil, p.ctx.failed("Page.GetImageRects", errcode, fmt.Errorf("%w: xref %d", ErrXref, xref))
+	}
+	defer C.gomupdf_free(p.ctx.ctx, unsafe.Pointer(ctms))
+
+	rects := make([]ImageRect, 0, int(count))
+	for _, m := range unsafe.Slice(ctms, int(count)) {
+		mat := NewMatrix(float64(m.a), float64(m.b), float64(m.c), float64(m.d), float64(m.e), float64(m.f))
+		rects = append(rects, ImageRect{Rect: NewRect(0, 0, 1, 1).Transform(mat), Matrix: mat})
+	}
+	return rects, nil
+}
+
+// ExtractImage returns the image XObject xref as an image file. JPEG, JPEG
+// 2000 and JBIG2 images are returned exactly as stored in the PDF, so they
+// are not re-encoded; all other images are decoded and returned as PNG.
+func (d *Document) ExtractImage(xref int, opts ...ExtractImageOptions) (*ExtractedImage, error) {
+	var opt ExtractImageOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.isClosed {
+		return nil, ErrClosed
+	}
+	if d.pdf == nil {
+		return nil, ErrNotPDF
+	}
+	if xref <= 0 || xref >= int(C.gomupdf_xref_len(d.ctx.ctx, d.pdf)) {
+		return nil, fmt.Errorf("%w: xref %d", ErrInvalidArg, xref)
+	}
+	merge := 0
+	if opt.MergeSMask {
+		merge = 1
+	}
+	var info C.gomupdf_extracted_image
+	var outlen, errcode C.int
+	data := C.gomupdf_extract_image(d.ctx.ctx, d.pdf, C.int(xref), C.int(merge), &info, &outlen, &errcode)
+	if errcode != 0 || data == nil {
+		return nil, d.ctx.failed("Document.ExtractImage", errcode, fmt.Errorf("%w: xref %d", ErrXref, xref))
+	}
+	defer d.ctx.freeBytes(data)
+	return &ExtractedImage{
+		Xref:       xref,
+		Ext:        C.GoString(info.ext),
+		Width:      int(info.width),
+		Height:     int(info.height),
+		BPC:        int(info.bpc),
+		N:          int(info.n),
+		Colorspace: C.GoString(&info.colorspace[0]),
+		SMask:      int(info.smask),
+		Image:      C.GoBytes(unsafe.Pointer(data), outlen),
+	}, nil
+}
+
+// ExtractAllImages calls fn once for every image XObject used by the
+// document's pages, in page order. pno is the first page using the image.
+// Images shared by several pages or drawn several times are visited once.
+// If fn returns an error, iteration stops and the error is returned.
+func (d *Document) ExtractAllImages(fn func(pno int, img *ExtractedImage) error, opts ...ExtractImageOptions) error {
+	if d.IsClosed() {
+		return ErrClosed
+	}
+	if !d.IsPDF() {
+		return ErrNotPDF
+	}
+	seen := make(map[int]bool)
+	for pno := 0; pno < d.PageCount(); pno++ {
+		images, err := d.GetPageImages(pno)
+		if err != nil {
+			return err
+		}
+		for _, info := range images {
+			if info.Xref <= 0 || seen[info.Xref] {
+				continue
+			}
+			seen[info.Xref] = true
+			img, err := d.ExtractImage(info.Xref, opts...)
+			if err != nil {
+				return err
+			}
+			if err := fn(pno, img); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReplaceImage rewrites the image XObject xref with the image in data
+// (any format InsertImage accepts). The object is changed in place, so
+// the new image appears wherever the old one was drawn, on every page,
+// scaled to the old image's placement. PDF only.
+func (p *Page) ReplaceImage(xref int, data []byte) error {
+	if len(data) == 0 {
+		return ErrInvalidArg
+	}
+	return p.replaceImage("Page.ReplaceImage", xref, data)
+}
+
+// DeleteImage replaces the image XObject xref with a transparent 1x1
+// image. Content streams that draw it remain valid. PDF only.
+func (p *Page) DeleteImage(xref int) error {
+	return p.replaceImage("Page.DeleteImage", xref, nil)
+}
+
+func (p *Page) replaceImage(op string, xref int, data []byte) error {
+	p.doc.mu.Lock()
+	defer p.doc.mu.Unlock()
+	if p.closed() {
+		return ErrClosed
+	}
+	if p.doc.pdf == nil {
+		return ErrNotPDF
+	}
+	if xref <= 0 || xref >= int(C.gomupdf_xref_len(p.ctx.ctx, p.doc.pdf)) {
+		return fmt.Errorf("%w: xref %d", ErrInvalidArg, xref)
+	}
+	var cData *C.uchar
+	if len(data) > 0 {
+		cData = (*C.uchar)(unsafe.Pointer(&data[0]))
+	}
+	errcode := C.gomupdf_replace_image(p.ctx.ctx, p.doc.pdf, C.int(xref), cData, C.int(len(data)))
+	if errcode != 0 {
+		return p.ctx.failed(op, errcode, fmt.Errorf("%w: xref %d", ErrXref, xref))
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package gomupdf
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Leak describes a Document, Page, Pixmap or TextPage that was garbage
+// collected without being closed. Its MuPDF resources have been released
+// by the time the leak is reported.
+type Leak struct {
+	Type  string // "Document", "Page", "Pixmap" or "TextPage"
+	Stack string // where the object was created; empty if not recorded
+}
+
+var leakHandler atomic.Pointer[func(Leak)]
+
+// SetLeakHandler installs fn to be called for every object that is
+// garbage collected without having been closed. fn runs on the
+// finalizer goroutine and must not block. Passing nil disables leak
+// reporting.
+//
+// Creation stack traces are recorded only while a handler is installed,
+// so install it before opening documents, typically in TestMain.
+func SetLeakHandler(fn func(Leak)) {
+	if fn == nil {
+		leakHandler.Store(nil)
+		return
+	}
+	leakHandler.Store(&fn)
+}
+
+// origin is the call stack that created an object, kept for leak reports.
+type origin []uintptr
+
+// captureOrigin records the caller's stack if a leak handler is installed.
+func captureOrigin() origin {
+	if leakHandler.Load() == nil {
+		return nil
+	}
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(2, pcs)
+	return origin(pcs[:n])
+}
+
+// reportLeak passes a leak of an object of type typ to the leak handler.
+func (o origin) reportLeak(typ string) {
+	fn := leakHandler.Load()
+	if fn == nil {
+		return
+	}
+	var sb strings.Builder
+	if len(o) > 0 {
+		frames := runtime.CallersFrames(o)
+		for {
+			f, more := frames.Next()
+			sb.WriteString(f.Function)
+			sb.WriteString("\n\t")
+			sb.WriteString(f.File)
+			sb.WriteByte(':')
+			sb.WriteString(strconv.Itoa(f.Line))
+			sb.WriteByte('\n')
+			if !more {
+				break
+			}
+		}
+	}
+	(*fn)(Leak{Type: typ, Stack: sb.String()})
+}
@@ -0,0 +1,140 @@
+package gomupdf
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// LogLevel tells MuPDF warnings from errors.
+type LogLevel int
+
+const (
+	LogWarning LogLevel = iota
+	LogError
+)
+
+func (l LogLevel) String() string {
+	if l == LogError {
+		return "error"
+	}
+	return "warning"
+}
+
+// LogMessage is a warning or error reported by MuPDF, such as
+// "repairing PDF document" or "unknown font".
+type LogMessage struct {
+	Level    LogLevel
+	Document string // document name, see OpenOptions.Name
+	Message  string
+}
+
+// OpenOptions configures how a document is opened.
+// Pass it to Open, OpenFromMemory, OpenReader, OpenReadSeeker or NewPDF.
+type OpenOptions struct {
+	// Name tags log messages from this document. Defaults to the file
+	// name, or to the magic string for documents opened from memory.
+	Name string
+
+	// LogFunc receives MuPDF's warnings and errors for this document.
+	// It takes precedence over Logger.
+	LogFunc func(LogMessage)
+
+	// Logger receives MuPDF's warnings and errors for this document.
+	// If neither LogFunc nor Logger is set, the package-level handler set
+	// with SetLogFunc or SetLogger is used, and otherwise slog.Default().
+	Logger *slog.Logger
+
+	// MemoryLimit caps the bytes MuPDF may allocate for the document,
+	// its pages and everything derived from them. 0 means unlimited.
+	// Operations that fail because of the cap return an error matching
+	// ErrMemoryLimit.
+	MemoryLimit int64
+
+	// StoreSize is the maximum size of the resource store that caches
+	// fonts, images and decoded streams. 0 selects MuPDF's default of
+	// 256 MB; a negative value lets the store grow unbounded.
+	StoreSize int64
+}
+
+type logHandler struct {
+	fn     func(LogMessage)
+	logger *slog.Logger
+}
+
+var defaultLogHandler atomic.Pointer[logHandler]
+
+// SetLogger routes MuPDF warnings and errors from all documents without a
+// per-document handler to l. Pass nil to restore slog.Default().
+func SetLogger(l *slog.Logger) {
+	defaultLogHandler.Store(&logHandler{logger: l})
+}
+
+// SetLogFunc routes MuPDF warnings and errors from all documents without a
+// per-document handler to fn. Pass nil to restore slog.Default().
+func SetLogFunc(fn func(LogMessage)) {
+	defaultLogHandler.Store(&logHandler{fn: fn})
+}
+
+// logSink receives the messages MuPDF reports on a context and its clones.
+// While collecting, messages are also recorded for Document.Warnings.
+type logSink struct {
+	mu       sync.Mutex
+	name     string
+	handler  logHandler
+	collect  bool
+	messages []string
+}
+
+// configure applies the first of opts, if any. name is used when
+// OpenOptions.Name is empty. It starts collecting messages.
+func (s *logSink) configure(name string, opts []OpenOptions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+	if len(opts) > 0 {
+		if opts[0].Name != "" {
+			s.name = opts[0].Name
+		}
+		s.handler = logHandler{fn: opts[0].LogFunc, logger: opts[0].Logger}
+	}
+	s.collect = true
+}
+
+// stopCollecting ends message collection and returns what was collected.
+func (s *logSink) stopCollecting() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collect = false
+	return s.messages
+}
+
+func (s *logSink) log(level LogLevel, msg string) {
+	s.mu.Lock()
+	if s.collect {
+		s.messages = append(s.messages, msg)
+	}
+	name, h := s.name, s.handler
+	s.mu.Unlock()
+
+	if h.fn == nil && h.logger == nil {
+		if d := defaultLogHandler.Load(); d != nil {
+			h = *d
+		}
+	}
+	m := LogMessage{Level: level, Document: name, Message: msg}
+	if h.fn != nil {
+		h.fn(m)
+		return
+	}
+	logger := h.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	slevel := slog.LevelWarn
+	if level == LogError {
+		slevel = slog.LevelError
+	}
+	logger.Log(context.Background(), slevel, msg, "component", "mupdf", "document", name)
+}
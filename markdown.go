@@ -0,0 +1,280 @@
+package gomupdf
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// mdPage is the content of a page to convert to Markdown.
+type mdPage struct {
+	blocks []STextBlock
+	links  []Link
+	tables []*Table
+	images []string // references of the image blocks, in block order
+}
+
+// headingLevels maps the font sizes of pages that are larger than the
+// size of most of the text to heading levels, the largest size to level
+// 1. Sizes are rounded to half points.
+func headingLevels(pages []mdPage) map[float64]int {
+	chars := make(map[float64]int)
+	for _, m := range pages {
+		for _, b := range m.blocks {
+			for _, l := range b.Lines {
+				for _, s := range l.Spans {
+					chars[roundSize(s.Size)] += len(s.Chars)
+				}
+			}
+		}
+	}
+	body, most := 0.0, 0
+	for size, n := range chars {
+		if n > most || n == most && size < body {
+			body, most = size, n
+		}
+	}
+	var sizes []float64
+	for size := range chars {
+		if size >= body+1 {
+			sizes = append(sizes, size)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(sizes)))
+	levels := make(map[float64]int)
+	for i, size := range sizes[:min(len(sizes), 6)] {
+		levels[size] = i + 1
+	}
+	return levels
+}
+
+func roundSize(size float64) float64 {
+	return math.Round(size*2) / 2
+}
+
+// textSize returns the rounded font size of most characters of lines.
+func textSize(lines []STextLine) float64 {
+	sizes := make(map[float64]int)
+	for _, l := range lines {
+		for _, s := range l.Spans {
+			sizes[roundSize(s.Size)] += len(s.Chars)
+		}
+	}
+	size, most := 0.0, 0
+	for s, n := range sizes {
+		if n > most || n == most && s > size {
+			size, most = s, n
+		}
+	}
+	return size
+}
+
+// markdown converts the page, putting each table before the first text
+// block that starts below its top.
+func (m *mdPage) markdown(levels map[float64]int) string {
+	var parts []string
+	tables, images := m.tables, 0
+	for _, b := range m.blocks {
+		for len(tables) > 0 && b.Rect.Y0 >= tables[0].Rect.Y0 {
+			parts = append(parts, strings.TrimSuffix(tables[0].ToMarkdown(), "\n"))
+			tables = tables[1:]
+		}
+		if b.Type == STextBlockImage {
+			if images < len(m.images) && m.images[images] != "" {
+				parts = append(parts, "![]("+m.images[images]+")")
+			}
+			images++
+			continue
+		}
+		if s := m.blockMarkdown(b, levels); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	for _, t := range tables {
+		parts = append(parts, strings.TrimSuffix(t.ToMarkdown(), "\n"))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.Join(parts, "\n\n") + "\n"
+}
+
+// blockMarkdown converts a text block, leaving out the lines inside
+// tables. A block in a heading font size becomes a heading; other blocks
+// become paragraphs and list items.
+func (m *mdPage) blockMarkdown(b STextBlock, levels map[float64]int) string {
+	var lines []STextLine
+	for _, l := range b.Lines {
+		if !insideAny(m.tables, rectCenter(l.Rect)) {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	if level := levels[textSize(lines)]; level > 0 {
+		texts := make([]string, len(lines))
+		for i, l := range lines {
+			texts[i] = strings.TrimSpace(m.lineMarkdown(l, 0, false))
+		}
+		return strings.Repeat("#", level) + " " + strings.Join(texts, " ")
+	}
+
+	// Each list item and paragraph is a part; list items are separated
+	// by a line break, everything else by a blank line.
+	type part struct {
+		text string
+		item bool
+	}
+	var parts []part
+	for _, l := range lines {
+		if skip, marker := listMarker(l.Text()); skip > 0 {
+			parts = append(parts, part{marker + strings.TrimSpace(m.lineMarkdown(l, skip, true)), true})
+			continue
+		}
+		text := strings.TrimSpace(m.lineMarkdown(l, 0, true))
+		if text == "" {
+			continue
+		}
+		// Lines after a list item continue it.
+		if n := len(parts); n > 0 {
+			parts[n-1].text = joinLines(parts[n-1].text, text)
+			continue
+		}
+		parts = append(parts, part{text: text})
+	}
+	var sb strings.Builder
+	for i, p := range parts {
+		if i > 0 {
+			if p.item && parts[i-1].item {
+				sb.WriteString("\n")
+			} else {
+				sb.WriteString("\n\n")
+			}
+		}
+		sb.WriteString(p.text)
+	}
+	return sb.String()
+}
+
+// joinLines appends the next line of a paragraph to text, joining words
+// hyphenated at the end of the line.
+func joinLines(text, next string) string {
+	r, _ := utf8.DecodeRuneInString(next)
+	if strings.HasSuffix(text, "-") && unicode.IsLower(r) {
+		if p, _ := utf8.DecodeLastRuneInString(text[:len(text)-1]); unicode.IsLetter(p) {
+			return text[:len(text)-1] + next
+		}
+	}
+	return text + " " + next
+}
+
+var (
+	bulletRunes    = "•◦▪▫‣⁃●○■□–-*·"
+	numberedPrefix = regexp.MustCompile(`^\s*(\d{1,3})[.)]\s+`)
+	letteredPrefix = regexp.MustCompile(`^\s*[a-zA-Z][.)]\s+`)
+)
+
+// listMarker recognizes a list item by its bullet or number. It returns
+// the number of runes of the line to replace and the Markdown marker to
+// replace them with, or 0 if the line is not a list item.
+func listMarker(line string) (int, string) {
+	trimmed := strings.TrimLeftFunc(line, unicode.IsSpace)
+	r, size := utf8.DecodeRuneInString(trimmed)
+	if strings.ContainsRune(bulletRunes, r) && len(trimmed) > size {
+		if rest := trimmed[size:]; strings.TrimLeftFunc(rest, unicode.IsSpace) != rest {
+			body := strings.TrimLeftFunc(rest, unicode.IsSpace)
+			return utf8.RuneCountInString(line) - utf8.RuneCountInString(body), "- "
+		}
+	}
+	if m := numberedPrefix.FindStringSubmatch(line); m != nil {
+		return utf8.RuneCountInString(m[0]), m[1] + ". "
+	}
+	if m := letteredPrefix.FindString(line); m != "" {
+		return utf8.RuneCountInString(m), "- " + strings.TrimSpace(m) + " "
+	}
+	return 0, ""
+}
+
+// mdStyle is the Markdown formatting of a run of characters.
+type mdStyle struct {
+	bold, italic, mono bool
+	uri                string
+}
+
+// wrap formats text, keeping its surrounding whitespace outside the
+// markup.
+func (s mdStyle) wrap(text string) string {
+	inner := strings.TrimSpace(text)
+	if inner == "" {
+		return text
+	}
+	lead := text[:strings.Index(text, inner)]
+	trail := text[len(lead)+len(inner):]
+	switch {
+	case s.mono:
+		inner = "`" + inner + "`"
+	case s.bold && s.italic:
+		inner = "***" + inner + "***"
+	case s.bold:
+		inner = "**" + inner + "**"
+	case s.italic:
+		inner = "_" + inner + "_"
+	}
+	if s.uri != "" {
+		inner = "[" + inner + "](" + s.uri + ")"
+	}
+	return lead + inner + trail
+}
+
+// lineMarkdown converts a line without its first skip characters. Text
+// under a link becomes a Markdown link; with emphasis, bold, italic and
+// monospaced spans are marked up as well. A gap between characters that
+// has no space character becomes a space.
+func (m *mdPage) lineMarkdown(l STextLine, skip int, emphasis bool) string {
+	var sb strings.Builder
+	var run []rune
+	var style mdStyle
+	var prev *STextChar
+	n := 0
+	for _, s := range l.Spans {
+		var st mdStyle
+		if emphasis {
+			st.bold = s.Flags&TextFontBold != 0
+			st.italic = s.Flags&TextFontItalic != 0
+			st.mono = s.Flags&TextFontMonospaced != 0
+		}
+		for i, ch := range s.Chars {
+			if n++; n <= skip {
+				continue
+			}
+			cs := st
+			cs.uri = m.linkAt(rectCenter(ch.Rect))
+			if prev != nil && ch.Rect.X0-prev.Rect.X1 > 0.15*s.Size && !unicode.IsSpace(prev.C) && !unicode.IsSpace(ch.C) {
+				run = append(run, ' ')
+			}
+			if len(run) > 0 && cs != style {
+				sb.WriteString(style.wrap(string(run)))
+				run = run[:0]
+			}
+			style = cs
+			run = append(run, ch.C)
+			prev = &s.Chars[i]
+		}
+	}
+	sb.WriteString(style.wrap(string(run)))
+	return sb.String()
+}
+
+// linkAt returns the URI of the link at p, if any.
+func (m *mdPage) linkAt(p Point) string {
+	for _, l := range m.links {
+		if l.URI != "" && l.Rect.Contains(p) {
+			return l.URI
+		}
+	}
+	return ""
+}
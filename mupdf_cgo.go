@@ -15,47 +15,194 @@ package gomupdf
 */
 import "C"
 import (
+	"fmt"
+	"runtime/cgo"
+	"sync/atomic"
 	"unsafe"
 )
 
-// context wraps the MuPDF fz_context.
-type context struct {
-	ctx *C.fz_context
+// fzContext wraps the MuPDF fz_context.
+//
+// An fz_context must only be used by one goroutine at a time. Every context
+// is created with real lock callbacks so that clones can be handed to other
+// goroutines while sharing the resource store, font and glyph caches.
+type fzContext struct {
+	ctx    *C.fz_context
+	shared *contextShared
 }
 
-// newContext creates a new MuPDF context.
-func newContext() (*context, error) {
-	ctx := C.gomupdf_new_context()
+// contextShared holds the state shared by a context and all of its clones:
+// the base context, the mutexes, the counting allocator and the sink for
+// MuPDF's log messages. It is released when the last context using it is
+// closed. The base context is kept alive until then because MuPDF's shared
+// caches (FreeType in particular) keep allocating through it.
+type contextShared struct {
+	base  *C.fz_context
+	locks *C.gomupdf_locks
+	alloc *C.gomupdf_alloc_state
+	store int64 // capacity of the resource store, 0 if unlimited
+	log   *logSink
+	h     cgo.Handle // handle to log, passed to the C log callbacks
+	refs  atomic.Int32
+}
+
+// newContext creates a new MuPDF context. The memory limit and store size
+// are taken from the first of opts, if any.
+func newContext(opts ...OpenOptions) (*fzContext, error) {
+	var limit, store int64 = 0, C.FZ_STORE_DEFAULT
+	if len(opts) > 0 {
+		if opts[0].MemoryLimit > 0 {
+			limit = opts[0].MemoryLimit
+		}
+		switch {
+		case opts[0].StoreSize > 0:
+			store = opts[0].StoreSize
+		case opts[0].StoreSize < 0:
+			store = C.FZ_STORE_UNLIMITED
+		}
+	}
+	locks := C.gomupdf_new_locks()
+	if locks == nil {
+		return nil, ErrInitFailed
+	}
+	alloc := C.gomupdf_new_alloc_state(C.size_t(limit))
+	if alloc == nil {
+		C.gomupdf_drop_locks(locks)
+		return nil, ErrInitFailed
+	}
+	ctx := C.gomupdf_new_context(locks, alloc, C.size_t(store))
 	if ctx == nil {
+		C.gomupdf_drop_alloc_state(alloc)
+		C.gomupdf_drop_locks(locks)
+		if limit > 0 {
+			return nil, ErrMemoryLimit
+		}
 		return nil, ErrInitFailed
 	}
 	C.fz_register_document_handlers(ctx)
-	return &context{ctx: ctx}, nil
+	s := &contextShared{base: ctx, locks: locks, alloc: alloc, store: store, log: &logSink{}}
+	s.h = cgo.NewHandle(s.log)
+	s.refs.Store(1)
+	C.gomupdf_set_log_callbacks(ctx, C.uintptr_t(s.h))
+	return &fzContext{ctx: ctx, shared: s}, nil
 }
 
-// close releases the context.
-func (c *context) close() {
+// close releases the context. The base context is only dropped once all
+// of its clones have been closed as well.
+func (c *fzContext) close() {
 	if c.ctx != nil {
-		C.gomupdf_drop_context(c.ctx)
+		if c.ctx != c.shared.base {
+			C.gomupdf_drop_context(c.ctx)
+		}
 		c.ctx = nil
+		if c.shared.refs.Add(-1) == 0 {
+			C.gomupdf_drop_context(c.shared.base)
+			C.gomupdf_drop_locks(c.shared.locks)
+			C.gomupdf_drop_alloc_state(c.shared.alloc)
+			c.shared.h.Delete()
+		}
 	}
 }
 
-// clone creates a thread-safe clone of the context.
-func (c *context) clone() *context {
-	return &context{ctx: C.gomupdf_clone_context(c.ctx)}
+// clone creates a context that shares c's store and locks, for use by
+// another goroutine. The caller must not use c concurrently with the call
+// and must close the clone independently of c.
+func (c *fzContext) clone() (*fzContext, error) {
+	ctx := C.gomupdf_clone_context(c.ctx)
+	if ctx == nil {
+		return nil, ErrInitFailed
+	}
+	c.shared.refs.Add(1)
+	return &fzContext{ctx: ctx, shared: c.shared}, nil
 }
 
 // freeString frees a C string allocated by MuPDF.
-func (c *context) freeString(s *C.char) {
+func (c *fzContext) freeString(s *C.char) {
 	if s != nil {
 		C.gomupdf_free(c.ctx, unsafe.Pointer(s))
 	}
 }
 
 // freeBytes frees a byte buffer allocated by MuPDF.
-func (c *context) freeBytes(p *C.uchar) {
+func (c *fzContext) freeBytes(p *C.uchar) {
 	if p != nil {
 		C.gomupdf_free(c.ctx, unsafe.Pointer(p))
 	}
 }
+
+// failed returns the error for a wrapper call that reported errcode. If
+// MuPDF raised an exception it is returned as a *MuPDFError wrapping
+// sentinel; otherwise sentinel is returned as is. Out-of-memory errors
+// raised because the memory limit refused an allocation of the failing
+// call also match ErrMemoryLimit. It must be called before c is used
+// again, while MuPDF still holds the caught message.
+func (c *fzContext) failed(op string, errcode C.int, sentinel error) error {
+	if errcode == 0 {
+		return sentinel
+	}
+	msg := C.GoString(C.gomupdf_caught_message(c.ctx))
+	if errcode&C.GOMUPDF_ERROR_LIMIT != 0 {
+		errcode &^= C.GOMUPDF_ERROR_LIMIT
+		sentinel = fmt.Errorf("%w: %w", ErrMemoryLimit, sentinel)
+	}
+	return &MuPDFError{
+		Op:      op,
+		Code:    int(errcode),
+		Message: msg,
+		Err:     sentinel,
+	}
+}
+
+// logSink returns the sink receiving MuPDF messages for c and its clones.
+func (c *fzContext) logSink() *logSink { return c.shared.log }
+
+//export gomupdfLogMessage
+func gomupdfLogMessage(handle C.uintptr_t, level C.int, message *C.char) {
+	defer func() { recover() }()
+	s, ok := cgo.Handle(handle).Value().(*logSink)
+	if !ok {
+		return
+	}
+	lvl := LogWarning
+	if level != 0 {
+		lvl = LogError
+	}
+	s.log(lvl, C.GoString(message))
+}
+
+// memoryStats reports the allocator and resource store usage shared by c
+// and its clones.
+func (c *fzContext) memoryStats() MemoryStats {
+	var used, peak, limit, refused, storeSize C.int64_t
+	C.gomupdf_alloc_stats(c.shared.alloc, &used, &peak, &limit, &refused)
+	st := MemoryStats{
+		Allocated: int64(used),
+		Peak:      int64(peak),
+		Limit:     int64(limit),
+		Refused:   int64(refused),
+		StoreSize: -1,
+		StoreMax:  c.shared.store,
+	}
+	if C.gomupdf_store_size(c.ctx, &storeSize) != 0 {
+		st.StoreSize = int64(storeSize)
+	}
+	return st
+}
+
+// Conversions from MuPDF geometry.
+
+func matrixFromC(m C.fz_matrix) Matrix {
+	return NewMatrix(float64(m.a), float64(m.b), float64(m.c), float64(m.d), float64(m.e), float64(m.f))
+}
+
+func rectFromC(r C.fz_rect) Rect {
+	return NewRect(float64(r.x0), float64(r.y0), float64(r.x1), float64(r.y1))
+}
+
+func pointFromC(p C.fz_point) Point {
+	return NewPoint(float64(p.x), float64(p.y))
+}
+
+func quadFromC(q C.fz_quad) Quad {
+	return NewQuad(pointFromC(q.ul), pointFromC(q.ur), pointFromC(q.ll), pointFromC(q.lr))
+}
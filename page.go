@@ -7,28 +7,73 @@ package gomupdf
 */
 import "C"
 import (
+	"context"
 	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
 	"unsafe"
 )
 
 // Page represents a document page.
+// A Page is invalidated when it or its Document is closed.
 type Page struct {
-	ctx    *context
+	ctx    *fzContext
 	page   *C.fz_page
 	doc    *Document
 	number int
+	origin origin
+
+	textMu    sync.Mutex                // guards textPages
+	textPages map[TextOptions]*TextPage // nil unless caching text pages
 }
 
 func (p *Page) Close() {
-	if p.page != nil {
-		C.gomupdf_drop_page(p.ctx.ctx, p.page)
+	p.CacheTextPages(false)
+	p.release()
+	runtime.SetFinalizer(p, nil)
+}
+
+func (p *Page) finalize() {
+	p.CacheTextPages(false)
+	if p.release() {
+		p.origin.reportLeak("Page")
+	}
+}
+
+// release drops the page unless the page or its document was already
+// closed, and reports whether it did.
+func (p *Page) release() bool {
+	p.doc.mu.Lock()
+	defer p.doc.mu.Unlock()
+	if p.closed() {
 		p.page = nil
+		return false
 	}
+	C.gomupdf_drop_page(p.ctx.ctx, p.page)
+	if p.doc.pages[p.page]--; p.doc.pages[p.page] == 0 {
+		delete(p.doc.pages, p.page)
+	}
+	p.page = nil
+	return true
+}
+
+// closed reports whether the page can no longer be used. Callers that
+// may run concurrently with Document.Close must hold the document lock.
+func (p *Page) closed() bool {
+	return p.page == nil || p.doc.isClosed
 }
 
 func (p *Page) Number() int { return p.number }
 
 func (p *Page) Rect() Rect {
+	p.doc.mu.Lock()
+	defer p.doc.mu.Unlock()
+	if p.closed() {
+		return Rect{}
+	}
 	r := C.gomupdf_page_bound(p.ctx.ctx, p.page)
 	return Rect{X0: float64(r.x0), Y0: float64(r.y0), X1: float64(r.x1), Y1: float64(r.y1)}
 }
@@ -37,7 +82,7 @@ func (p *Page) Width() float64  { return p.Rect().Width() }
 func (p *Page) Height() float64 { return p.Rect().Height() }
 
 func (p *Page) Rotation() int {
-	if !p.doc.IsPDF() {
+	if p.closed() || !p.doc.IsPDF() {
 		return 0
 	}
 	pdfPage := C.pdf_page_from_fz_page(p.ctx.ctx, p.page)
@@ -48,6 +93,9 @@ func (p *Page) Rotation() int {
 }
 
 func (p *Page) SetRotation(rotation int) error {
+	if p.closed() {
+		return ErrClosed
+	}
 	if !p.doc.IsPDF() {
 		return ErrNotPDF
 	}
@@ -59,91 +107,249 @@ func (p *Page) SetRotation(rotation int) error {
 	return nil
 }
 
-func (p *Page) GetText(output string, flags ...int) (string, error) {
-	if output == "" {
-		output = "text"
+// displayList records the page into a display list while holding the
+// document lock, and returns it with a cloned context on which it can be
+// replayed without blocking other goroutines. The caller must drop the
+// list and then close the context. If recording fails, the error wraps
+// fail and names op. ck may be nil.
+func (p *Page) displayList(op string, annots bool, ck *cookie, fail error) (*C.fz_display_list, *fzContext, error) {
+	p.doc.mu.Lock()
+	defer p.doc.mu.Unlock()
+	if p.closed() {
+		return nil, nil, ErrClosed
 	}
-	flag := TextFlagsDefault
-	if len(flags) > 0 {
-		flag = flags[0]
+	a := 0
+	if annots {
+		a = 1
 	}
 	var errcode C.int
-	tp := C.gomupdf_new_stext_page(p.ctx.ctx, p.page, C.int(flag), &errcode)
-	if errcode != 0 || tp == nil {
-		return "", ErrTextExtract
+	list := C.gomupdf_new_display_list(p.ctx.ctx, p.page, C.int(a), ck.ptr(), &errcode)
+	if errcode != 0 || list == nil {
+		return nil, nil, p.ctx.failed(op, errcode, fail)
 	}
-	defer C.gomupdf_drop_stext_page(p.ctx.ctx, tp)
-
-	cText := C.gomupdf_stext_page_as_text(p.ctx.ctx, tp, &errcode)
-	if errcode != 0 || cText == nil {
-		return "", ErrTextExtract
+	ctx, err := p.ctx.clone()
+	if err != nil {
+		C.gomupdf_drop_display_list(p.ctx.ctx, list)
+		return nil, nil, err
 	}
-	defer p.ctx.freeString(cText)
-	return C.GoString(cText), nil
+	return list, ctx, nil
 }
 
-func (p *Page) GetTextWords(flags ...int) ([]TextWord, error) {
-	flag := TextFlagsDefault
-	if len(flags) > 0 {
-		flag = flags[0]
+// newSTextPage extracts structured text from the page on a cloned context.
+// The caller must drop the text page and then close the context. ck may
+// be nil; failures wrap fail.
+func (p *Page) newSTextPage(op string, opt TextOptions, ck *cookie, fail error) (*C.fz_stext_page, *fzContext, error) {
+	list, ctx, err := p.displayList(op, true, ck, fail)
+	if err != nil {
+		return nil, nil, err
 	}
 	var errcode C.int
-	tp := C.gomupdf_new_stext_page(p.ctx.ctx, p.page, C.int(flag), &errcode)
+	tp := C.gomupdf_new_stext_page_from_display_list(ctx.ctx, list, C.int(opt.Flags), ck.ptr(), &errcode)
+	C.gomupdf_drop_display_list(ctx.ctx, list)
 	if errcode != 0 || tp == nil {
-		return nil, ErrTextExtract
+		err := ctx.failed(op, errcode, fail)
+		ctx.close()
+		return nil, nil, err
+	}
+	clip, sort := 0, 0
+	if opt.Clip != (Rect{}) {
+		clip = 1
+	}
+	if opt.Sort {
+		sort = 1
+	}
+	if clip != 0 || sort != 0 {
+		c := opt.Clip
+		C.gomupdf_stext_page_clip_sort(ctx.ctx, tp, C.int(clip),
+			C.float(c.X0), C.float(c.Y0), C.float(c.X1), C.float(c.Y1), C.int(sort), &errcode)
+		if errcode != 0 {
+			err := ctx.failed(op, errcode, fail)
+			C.gomupdf_drop_stext_page(ctx.ctx, tp)
+			ctx.close()
+			return nil, nil, err
+		}
 	}
-	defer C.gomupdf_drop_stext_page(p.ctx.ctx, tp)
+	return tp, ctx, nil
+}
+
+// textFlags returns the options for the optional flags argument of the
+// text methods: the first of flags, or TextFlagsDefault.
+func textFlags(flags []int) TextOptions {
+	opt := DefaultTextOptions()
+	if len(flags) > 0 {
+		opt.Flags = flags[0]
+	}
+	return opt
+}
+
+// withDefaults returns opt with a zero Flags replaced by TextFlagsDefault.
+func (opt TextOptions) withDefaults() TextOptions {
+	if opt.Flags == 0 {
+		opt.Flags = TextFlagsDefault
+	}
+	return opt
+}
+
+// Text output formats accepted by GetText.
+var textFormats = map[string]C.int{
+	"text":   -1,
+	"blocks": -1,
+	"words":  -1,
+	"html":   C.GOMUPDF_TEXT_HTML,
+	"xhtml":  C.GOMUPDF_TEXT_XHTML,
+	"xml":    C.GOMUPDF_TEXT_XML,
+	"json":   C.GOMUPDF_TEXT_JSON,
+}
 
+// GetText extracts the page's text in the given output format:
+//
+//   - "text": plain text (the default if output is empty)
+//   - "html", "xhtml": a <div> for the page, with positioned or
+//     semantic markup respectively
+//   - "xml": every character with its font and position
+//   - "json": blocks, lines and spans with their bounding boxes
+//   - "blocks": one line per block: x0 y0 x1 y1 "text" block_no type,
+//     where type is 0 for text and 1 for images
+//   - "words": one line per word: x0 y0 x1 y1 "word" block_no line_no word_no
+//
+// Text in "blocks" and "words" output is quoted as a Go string literal.
+// Other formats are rejected with ErrInvalidArg. flags is a combination
+// of the Text* extraction flags, TextFlagsDefault if omitted.
+func (p *Page) GetText(output string, flags ...int) (string, error) {
+	return p.GetTextCtx(context.Background(), output, flags...)
+}
+
+// GetTextCtx is like GetText but stops extracting when ctx is cancelled or
+// its deadline passes, in which case it returns ctx.Err().
+func (p *Page) GetTextCtx(ctx context.Context, output string, flags ...int) (string, error) {
+	return p.getText(ctx, output, textFlags(flags))
+}
+
+// GetTextWithOptions is like GetText but takes TextOptions, which can
+// also restrict the text to a clip rectangle and sort it in reading order.
+func (p *Page) GetTextWithOptions(output string, opt TextOptions) (string, error) {
+	return p.GetTextWithOptionsCtx(context.Background(), output, opt)
+}
+
+// GetTextWithOptionsCtx is like GetTextWithOptions but stops extracting
+// when ctx is cancelled or its deadline passes, in which case it returns
+// ctx.Err().
+func (p *Page) GetTextWithOptionsCtx(ctx context.Context, output string, opt TextOptions) (string, error) {
+	return p.getText(ctx, output, opt.withDefaults())
+}
+
+func (p *Page) getText(ctx context.Context, output string, opt TextOptions) (string, error) {
+	if output == "" {
+		output = "text"
+	}
+	if _, ok := textFormats[output]; !ok {
+		return "", fmt.Errorf("%w: unknown text output %q", ErrInvalidArg, output)
+	}
+	var text string
+	err := p.withTextPage(ctx, "Page.GetText", opt, ErrTextExtract, func(t *TextPage) (err error) {
+		text, err = t.text(output, opt.Delimiters)
+		return err
+	})
+	return text, err
+}
+
+// rectFields formats r as "x0 y0 x1 y1". The coordinates come from
+// float32 values, so they are printed with float32 precision.
+func rectFields(r Rect) string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 32) }
+	return f(r.X0) + " " + f(r.Y0) + " " + f(r.X1) + " " + f(r.Y1)
+}
+
+// GetTextWords returns the words of the page in extraction order. Words
+// are separated by whitespace. Rect is the union of the word's character
+// boxes; Quad follows the baseline, so it stays tight for rotated text.
+// BlockNo counts all blocks of the page, LineNo the lines within the block
+// and WordNo the words within the line, as in PyMuPDF's get_text("words").
+func (p *Page) GetTextWords(flags ...int) ([]TextWord, error) {
+	return p.getTextWords(textFlags(flags))
+}
+
+// GetTextWordsWithOptions is like GetTextWords but takes TextOptions.
+// Words are also separated by the runes in opt's Delimiters.
+func (p *Page) GetTextWordsWithOptions(opt TextOptions) ([]TextWord, error) {
+	return p.getTextWords(opt.withDefaults())
+}
+
+func (p *Page) getTextWords(opt TextOptions) ([]TextWord, error) {
 	var words []TextWord
-	for block := tp.first_block; block != nil; block = block.next {
+	err := p.withTextPage(context.Background(), "Page.GetTextWords", opt, ErrTextExtract, func(t *TextPage) error {
+		words = stextWords(t.tp, opt.Delimiters)
+		return nil
+	})
+	return words, err
+}
+
+// stextWords splits the lines of tp into words at whitespace and at the
+// runes in delims, which belong to no word.
+func stextWords(tp *C.fz_stext_page, delims string) []TextWord {
+	var words []TextWord
+	blockNo := 0
+	for block := tp.first_block; block != nil; block, blockNo = block.next, blockNo+1 {
 		if block._type != C.FZ_STEXT_BLOCK_TEXT {
 			continue
 		}
-		for line := C.gomupdf_stext_block_first_line(block); line != nil; line = line.next {
-			word := TextWord{BlockNo: len(words)}
-			wordText := ""
+		lineNo := 0
+		for line := C.gomupdf_stext_block_first_line(block); line != nil; line, lineNo = line.next, lineNo+1 {
+			var word TextWord
+			var text strings.Builder
+			var last Quad
+			wordNo := 0
+			flush := func() {
+				if text.Len() == 0 {
+					return
+				}
+				word.Text = text.String()
+				word.Quad.UR, word.Quad.LR = last.UR, last.LR
+				word.BlockNo, word.LineNo, word.WordNo = blockNo, lineNo, wordNo
+				words = append(words, word)
+				word = TextWord{}
+				text.Reset()
+				wordNo++
+			}
 			for ch := line.first_char; ch != nil; ch = ch.next {
 				c := rune(ch.c)
-				if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
-					if wordText != "" {
-						word.Text = wordText
-						word.Rect.Y0 = float64(line.bbox.y0)
-						word.Rect.X1 = float64(ch.origin.x)
-						word.Rect.Y1 = float64(line.bbox.y1)
-						words = append(words, word)
-						word = TextWord{BlockNo: len(words)}
-						wordText = ""
-					}
+				if unicode.IsSpace(c) || strings.ContainsRune(delims, c) {
+					flush()
 					continue
 				}
-				if wordText == "" {
-					word.Rect.X0 = float64(ch.origin.x)
+				q := quadFromC(ch.quad)
+				if text.Len() == 0 {
+					word.Quad.UL, word.Quad.LL = q.UL, q.LL
 				}
-				wordText += string(c)
-			}
-			if wordText != "" {
-				word.Text = wordText
-				word.Rect.Y0 = float64(line.bbox.y0)
-				word.Rect.Y1 = float64(line.bbox.y1)
-				words = append(words, word)
+				word.Rect = word.Rect.Union(q.Rect())
+				last = q
+				text.WriteRune(c)
 			}
+			flush()
 		}
 	}
-	return words, nil
+	return words
 }
 
 func (p *Page) GetTextBlocks(flags ...int) ([]TextBlock, error) {
-	flag := TextFlagsDefault
-	if len(flags) > 0 {
-		flag = flags[0]
-	}
-	var errcode C.int
-	tp := C.gomupdf_new_stext_page(p.ctx.ctx, p.page, C.int(flag), &errcode)
-	if errcode != 0 || tp == nil {
-		return nil, ErrTextExtract
-	}
-	defer C.gomupdf_drop_stext_page(p.ctx.ctx, tp)
+	return p.getTextBlocks(textFlags(flags))
+}
+
+// GetTextBlocksWithOptions is like GetTextBlocks but takes TextOptions.
+func (p *Page) GetTextBlocksWithOptions(opt TextOptions) ([]TextBlock, error) {
+	return p.getTextBlocks(opt.withDefaults())
+}
+
+func (p *Page) getTextBlocks(opt TextOptions) ([]TextBlock, error) {
+	var blocks []TextBlock
+	err := p.withTextPage(context.Background(), "Page.GetTextBlocks", opt, ErrTextExtract, func(t *TextPage) error {
+		blocks = stextBlocks(t.tp)
+		return nil
+	})
+	return blocks, err
+}
 
+func stextBlocks(tp *C.fz_stext_page) []TextBlock {
 	var blocks []TextBlock
 	blockNo := 0
 	for block := tp.first_block; block != nil; block = block.next {
@@ -170,10 +376,19 @@ func (p *Page) GetTextBlocks(flags ...int) ([]TextBlock, error) {
 		blocks = append(blocks, tb)
 		blockNo++
 	}
-	return blocks, nil
+	return blocks
 }
 
 func (p *Page) GetPixmap(opts ...PixmapOption) (*Pixmap, error) {
+	return p.GetPixmapCtx(context.Background(), opts...)
+}
+
+// GetPixmapCtx is like GetPixmap but stops rendering when ctx is cancelled
+// or its deadline passes, in which case it returns ctx.Err().
+func (p *Page) GetPixmapCtx(ctx context.Context, opts ...PixmapOption) (*Pixmap, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	cfg := pixmapConfig{matrix: Identity, colorspace: CsRGB, alpha: false, annots: true}
 	for _, opt := range opts {
 		opt(&cfg)
@@ -186,57 +401,78 @@ func (p *Page) GetPixmap(opts ...PixmapOption) (*Pixmap, error) {
 	if cfg.alpha {
 		alpha = 1
 	}
+	ck := newCookie(ctx)
+	defer ck.close()
+	// A clipped pixmap is rendered from the page contents only.
+	list, fc, err := p.displayList("Page.GetPixmap", cfg.clip == nil, ck, ErrPixmap)
+	if err != nil {
+		return nil, err
+	}
 	var errcode C.int
-	var pix *C.fz_pixmap
-	if cfg.clip != nil {
-		pix = C.gomupdf_page_to_pixmap_clipped(p.ctx.ctx, p.page,
-			C.float(cfg.matrix.A), C.float(cfg.matrix.B),
-			C.float(cfg.matrix.C), C.float(cfg.matrix.D),
-			C.float(cfg.matrix.E), C.float(cfg.matrix.F),
-			C.int(cfg.colorspace), C.int(alpha),
-			C.float(cfg.clip.X0), C.float(cfg.clip.Y0),
-			C.float(cfg.clip.X1), C.float(cfg.clip.Y1), &errcode)
-	} else {
-		pix = C.gomupdf_page_to_pixmap(p.ctx.ctx, p.page,
-			C.float(cfg.matrix.A), C.float(cfg.matrix.B),
-			C.float(cfg.matrix.C), C.float(cfg.matrix.D),
-			C.float(cfg.matrix.E), C.float(cfg.matrix.F),
-			C.int(cfg.colorspace), C.int(alpha), &errcode)
+	pix := C.gomupdf_display_list_to_pixmap(fc.ctx, list,
+		C.float(cfg.matrix.A), C.float(cfg.matrix.B),
+		C.float(cfg.matrix.C), C.float(cfg.matrix.D),
+		C.float(cfg.matrix.E), C.float(cfg.matrix.F),
+		C.int(cfg.colorspace), C.int(alpha), ck.ptr(), &errcode)
+	C.gomupdf_drop_display_list(fc.ctx, list)
+	if err := ctx.Err(); err != nil {
+		if pix != nil {
+			C.gomupdf_drop_pixmap(fc.ctx, pix)
+		}
+		fc.close()
+		return nil, err
 	}
 	if errcode != 0 || pix == nil {
-		return nil, ErrPixmap
+		err := fc.failed("Page.GetPixmap", errcode, ErrPixmap)
+		fc.close()
+		return nil, err
 	}
-	return &Pixmap{ctx: p.ctx, pix: pix}, nil
+	return newPixmap(fc, pix), nil
 }
 
+// SearchFor finds needle on the page, ignoring case, and returns a quad
+// for each line of every hit. If quads is false, each quad is replaced by
+// its bounding rectangle. Search groups the quads per hit.
 func (p *Page) SearchFor(needle string, quads bool) ([]Quad, error) {
-	cNeedle := C.CString(needle)
-	defer C.free(unsafe.Pointer(cNeedle))
-	maxQuads := 500
-	cQuads := make([]C.fz_quad, maxQuads)
-	var errcode C.int
-	count := int(C.gomupdf_search_page(p.ctx.ctx, p.page, cNeedle, &cQuads[0], C.int(maxQuads), &errcode))
-	if errcode != 0 {
-		return nil, ErrSearch
-	}
-	result := make([]Quad, count)
-	for i := 0; i < count; i++ {
-		q := cQuads[i]
-		result[i] = Quad{
-			UL: Point{float64(q.ul.x), float64(q.ul.y)},
-			UR: Point{float64(q.ur.x), float64(q.ur.y)},
-			LL: Point{float64(q.ll.x), float64(q.ll.y)},
-			LR: Point{float64(q.lr.x), float64(q.lr.y)},
+	return p.SearchForCtx(context.Background(), needle, quads)
+}
+
+// SearchForCtx is like SearchFor but stops searching when ctx is cancelled
+// or its deadline passes, in which case it returns ctx.Err().
+func (p *Page) SearchForCtx(ctx context.Context, needle string, quads bool) ([]Quad, error) {
+	var result []Quad
+	err := p.withTextPage(ctx, "Page.SearchFor", TextOptions{}, ErrSearch, func(t *TextPage) error {
+		cNeedle := C.CString(needle)
+		defer C.free(unsafe.Pointer(cNeedle))
+		var count, errcode C.int
+		cQuads := C.gomupdf_search_stext_page(t.ctx.ctx, t.tp, cNeedle, &count, &errcode)
+		defer C.gomupdf_free(t.ctx.ctx, unsafe.Pointer(cQuads))
+		if errcode != 0 {
+			return t.ctx.failed("Page.SearchFor", errcode, ErrSearch)
 		}
-	}
-	return result, nil
+		result = make([]Quad, 0, int(count))
+		for _, q := range unsafe.Slice(cQuads, int(count)) {
+			r := quadFromC(q)
+			if !quads {
+				r = r.Rect().Quad()
+			}
+			result = append(result, r)
+		}
+		return nil
+	})
+	return result, err
 }
 
 func (p *Page) GetLinks() ([]Link, error) {
+	p.doc.mu.Lock()
+	defer p.doc.mu.Unlock()
+	if p.closed() {
+		return nil, ErrClosed
+	}
 	var errcode C.int
 	fzLinks := C.gomupdf_load_links(p.ctx.ctx, p.page, &errcode)
 	if errcode != 0 {
-		return nil, fmt.Errorf("failed to load links")
+		return nil, p.ctx.failed("Page.GetLinks", errcode, fmt.Errorf("failed to load links"))
 	}
 	if fzLinks == nil {
 		return nil, nil
@@ -258,10 +494,12 @@ func (p *Page) GetLinks() ([]Link, error) {
 	return links, nil
 }
 
-func (p *Page) GetFonts() ([]FontInfo, error)   { return nil, nil }
-func (p *Page) GetImages() ([]ImageInfo, error) { return nil, nil }
-
 func (p *Page) GetLabel() string {
+	p.doc.mu.Lock()
+	defer p.doc.mu.Unlock()
+	if p.closed() {
+		return ""
+	}
 	var errcode C.int
 	label := C.gomupdf_page_label(p.ctx.ctx, p.page, &errcode)
 	if errcode != 0 || label == nil {
@@ -10,6 +10,9 @@ import "unsafe"
 
 // InsertImage inserts an image into the page at the given rectangle.
 func (p *Page) InsertImage(rect Rect, imageData []byte, opts ...InsertImageOptions) error {
+	if p.closed() {
+		return ErrClosed
+	}
 	if !p.doc.IsPDF() {
 		return ErrNotPDF
 	}
@@ -33,7 +36,7 @@ func (p *Page) InsertImage(rect Rect, imageData []byte, opts ...InsertImageOptio
 		(*C.uchar)(unsafe.Pointer(&imageData[0])), C.int(len(imageData)),
 		C.int(keepProp), C.int(overlay))
 	if errcode != 0 {
-		return ErrPixmap
+		return p.ctx.failed("Page.InsertImage", errcode, ErrPixmap)
 	}
 	return nil
 }
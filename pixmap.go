@@ -10,13 +10,26 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"runtime"
 	"unsafe"
 )
 
 // Pixmap represents a pixel map (raster image).
+// Every Pixmap owns its MuPDF context, so pixmaps may be used and closed
+// independently of the document and of each other. After Close, the
+// accessors return zero values and the other methods return ErrClosed or
+// do nothing.
 type Pixmap struct {
-	ctx *context
-	pix *C.fz_pixmap
+	ctx    *fzContext
+	pix    *C.fz_pixmap
+	origin origin
+}
+
+// newPixmap wraps pix, which takes ownership of ctx.
+func newPixmap(ctx *fzContext, pix *C.fz_pixmap) *Pixmap {
+	px := &Pixmap{ctx: ctx, pix: pix, origin: captureOrigin()}
+	runtime.SetFinalizer(px, (*Pixmap).finalize)
+	return px
 }
 
 func NewPixmap(colorspace int, width, height int, alpha bool) (*Pixmap, error) {
@@ -33,26 +46,53 @@ func NewPixmap(colorspace int, width, height int, alpha bool) (*Pixmap, error) {
 		ctx.close()
 		return nil, ErrPixmap
 	}
-	return &Pixmap{ctx: ctx, pix: pix}, nil
+	return newPixmap(ctx, pix), nil
 }
 
 func NewPixmapFromImage(doc *Document, xref int) (*Pixmap, error) {
-	if !doc.IsPDF() {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	if doc.isClosed {
+		return nil, ErrClosed
+	}
+	if doc.pdf == nil {
 		return nil, ErrNotPDF
 	}
+	ctx, err := doc.ctx.clone()
+	if err != nil {
+		return nil, err
+	}
 	var errcode C.int
-	pix := C.gomupdf_pixmap_from_image(doc.ctx.ctx, doc.doc, C.int(xref), &errcode)
+	pix := C.gomupdf_pixmap_from_image(ctx.ctx, doc.doc, C.int(xref), &errcode)
 	if errcode != 0 || pix == nil {
-		return nil, ErrPixmap
+		err := ctx.failed("NewPixmapFromImage", errcode, ErrPixmap)
+		ctx.close()
+		return nil, err
 	}
-	return &Pixmap{ctx: doc.ctx, pix: pix}, nil
+	return newPixmap(ctx, pix), nil
 }
 
 func (px *Pixmap) Close() {
-	if px.pix != nil {
-		C.gomupdf_drop_pixmap(px.ctx.ctx, px.pix)
-		px.pix = nil
+	px.release()
+	runtime.SetFinalizer(px, nil)
+}
+
+func (px *Pixmap) finalize() {
+	if px.release() {
+		px.origin.reportLeak("Pixmap")
+	}
+}
+
+// release drops the pixmap and its context, and reports whether the
+// pixmap was still open.
+func (px *Pixmap) release() bool {
+	if px.pix == nil {
+		return false
 	}
+	C.gomupdf_drop_pixmap(px.ctx.ctx, px.pix)
+	px.pix = nil
+	px.ctx.close()
+	return true
 }
 
 func (px *Pixmap) Width() int  { return int(C.gomupdf_pixmap_width(px.pix)) }
@@ -68,27 +108,36 @@ func (px *Pixmap) IRect() IRect {
 }
 
 func (px *Pixmap) Samples() []byte {
+	if px.pix == nil {
+		return nil
+	}
 	ptr := C.gomupdf_pixmap_samples(px.pix)
 	length := C.gomupdf_pixmap_samples_len(px.pix)
 	return C.GoBytes(unsafe.Pointer(ptr), length)
 }
 
 func (px *Pixmap) ToBytes() ([]byte, error) {
+	if px.pix == nil {
+		return nil, ErrClosed
+	}
 	var outlen, errcode C.int
 	data := C.gomupdf_pixmap_to_png(px.ctx.ctx, px.pix, &outlen, &errcode)
 	if errcode != 0 || data == nil {
-		return nil, ErrPixmap
+		return nil, px.ctx.failed("Pixmap.ToBytes", errcode, ErrPixmap)
 	}
 	defer px.ctx.freeBytes(data)
 	return C.GoBytes(unsafe.Pointer(data), outlen), nil
 }
 
 func (px *Pixmap) Save(filename string) error {
+	if px.pix == nil {
+		return ErrClosed
+	}
 	cFilename := C.CString(filename)
 	defer C.free(unsafe.Pointer(cFilename))
 	errcode := C.gomupdf_pixmap_save_png(px.ctx.ctx, px.pix, cFilename)
 	if errcode != 0 {
-		return fmt.Errorf("%w: %s", ErrPixmap, filename)
+		return px.ctx.failed("Pixmap.Save", errcode, fmt.Errorf("%w: %s", ErrPixmap, filename))
 	}
 	return nil
 }
@@ -96,17 +145,20 @@ func (px *Pixmap) Save(filename string) error {
 func (px *Pixmap) SavePNG(filename string) error { return px.Save(filename) }
 
 func (px *Pixmap) SavePNM(filename string) error {
+	if px.pix == nil {
+		return ErrClosed
+	}
 	cFilename := C.CString(filename)
 	defer C.free(unsafe.Pointer(cFilename))
 	errcode := C.gomupdf_pixmap_save_pnm(px.ctx.ctx, px.pix, cFilename)
 	if errcode != 0 {
-		return fmt.Errorf("%w: %s", ErrPixmap, filename)
+		return px.ctx.failed("Pixmap.SavePNM", errcode, fmt.Errorf("%w: %s", ErrPixmap, filename))
 	}
 	return nil
 }
 
 func (px *Pixmap) SetPixel(x, y int, c []byte) {
-	if x < 0 || x >= px.Width() || y < 0 || y >= px.Height() {
+	if px.pix == nil || x < 0 || x >= px.Width() || y < 0 || y >= px.Height() {
 		return
 	}
 	n := px.N()
@@ -119,7 +171,7 @@ func (px *Pixmap) SetPixel(x, y int, c []byte) {
 func (px *Pixmap) GetPixel(x, y int) []byte {
 	n := px.N()
 	c := make([]byte, n)
-	if x < 0 || x >= px.Width() || y < 0 || y >= px.Height() {
+	if px.pix == nil || x < 0 || x >= px.Width() || y < 0 || y >= px.Height() {
 		return c
 	}
 	C.gomupdf_pixmap_get_pixel(px.pix, C.int(x), C.int(y), (*C.uchar)(unsafe.Pointer(&c[0])), C.int(n))
@@ -127,26 +179,49 @@ func (px *Pixmap) GetPixel(x, y int) []byte {
 }
 
 func (px *Pixmap) Clear(value int) {
+	if px.pix == nil {
+		return
+	}
 	C.gomupdf_pixmap_clear(px.ctx.ctx, px.pix, C.int(value))
 }
 
-func (px *Pixmap) Invert() { C.gomupdf_pixmap_invert(px.ctx.ctx, px.pix) }
+func (px *Pixmap) Invert() {
+	if px.pix == nil {
+		return
+	}
+	C.gomupdf_pixmap_invert(px.ctx.ctx, px.pix)
+}
 
 func (px *Pixmap) Gamma(gamma float64) {
+	if px.pix == nil {
+		return
+	}
 	C.gomupdf_pixmap_gamma(px.ctx.ctx, px.pix, C.float(gamma))
 }
 
 func (px *Pixmap) Tint(black, white int) {
+	if px.pix == nil {
+		return
+	}
 	C.gomupdf_pixmap_tint(px.ctx.ctx, px.pix, C.int(black), C.int(white))
 }
 
 func (px *Pixmap) Convert(colorspace int) (*Pixmap, error) {
+	if px.pix == nil {
+		return nil, ErrClosed
+	}
+	ctx, err := px.ctx.clone()
+	if err != nil {
+		return nil, err
+	}
 	var errcode C.int
-	newPix := C.gomupdf_pixmap_convert(px.ctx.ctx, px.pix, C.int(colorspace), &errcode)
+	newPix := C.gomupdf_pixmap_convert(ctx.ctx, px.pix, C.int(colorspace), &errcode)
 	if errcode != 0 || newPix == nil {
-		return nil, ErrPixmap
+		err := ctx.failed("Pixmap.Convert", errcode, ErrPixmap)
+		ctx.close()
+		return nil, err
 	}
-	return &Pixmap{ctx: px.ctx, pix: newPix}, nil
+	return newPixmap(ctx, newPix), nil
 }
 
 func (px *Pixmap) ToImage() image.Image {
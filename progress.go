@@ -0,0 +1,26 @@
+package gomupdf
+
+import "context"
+
+// Progress reports how far a cancellable operation has come.
+// It mirrors the counters of MuPDF's fz_cookie.
+type Progress struct {
+	Current int // operations completed so far
+	Max     int // expected total, or -1 if unknown
+	Errors  int // errors encountered and skipped while processing
+}
+
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx that carries a progress callback.
+// The ...Ctx methods call fn periodically from a separate goroutine while
+// they run, and once more from the calling goroutine when they finish.
+func WithProgress(ctx context.Context, fn func(Progress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// progressFunc returns the callback installed with WithProgress, if any.
+func progressFunc(ctx context.Context) func(Progress) {
+	fn, _ := ctx.Value(progressKey{}).(func(Progress))
+	return fn
+}
@@ -0,0 +1,60 @@
+//go:build cgo && !nomupdf
+
+package gomupdf
+
+import (
+	"context"
+	"iter"
+)
+
+// Search finds needle on the page and returns one result per hit, with a
+// quad for every line the hit spans. Whitespace in needle matches any run
+// of whitespace, including line breaks. The pages of opts are ignored.
+func (p *Page) Search(needle string, opts ...SearchOptions) ([]SearchResult, error) {
+	var results []SearchResult
+	err := p.withTextPage(context.Background(), "Page.Search", DefaultTextOptions(), ErrTextExtract, func(t *TextPage) (err error) {
+		results, err = t.Search(needle, opts...)
+		return err
+	})
+	return results, err
+}
+
+// Search finds needle on the pages of opt, yielding the hits
+// page by page as Page.Search reports them. Pages are loaded one at a
+// time, so results arrive before the whole document is searched. If a
+// page cannot be searched, the error is yielded and the search ends.
+func (d *Document) Search(needle string, opt SearchOptions) iter.Seq2[SearchResult, error] {
+	return func(yield func(SearchResult, error) bool) {
+		if d.IsClosed() {
+			yield(SearchResult{}, ErrClosed)
+			return
+		}
+		pages := opt.Pages
+		if pages == nil {
+			for pno := range d.PageCount() {
+				pages = append(pages, pno)
+			}
+		}
+		for _, pno := range pages {
+			results, err := d.searchPage(pno, needle, opt)
+			if err != nil {
+				yield(SearchResult{Page: pno}, err)
+				return
+			}
+			for _, res := range results {
+				if !yield(res, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (d *Document) searchPage(pno int, needle string, opt SearchOptions) ([]SearchResult, error) {
+	page, err := d.LoadPage(pno)
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+	return page.Search(needle, opt)
+}
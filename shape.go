@@ -6,10 +6,19 @@ package gomupdf
 #include "gomupdf.h"
 */
 import "C"
-import "unsafe"
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unsafe"
+)
 
 // InsertText inserts text at the given position on the page. PDF only.
 func (p *Page) InsertText(pos Point, text string, opts ...TextInsertOption) (int, error) {
+	if p.closed() {
+		return 0, ErrClosed
+	}
 	if !p.doc.IsPDF() {
 		return 0, ErrNotPDF
 	}
@@ -27,7 +36,262 @@ func (p *Page) InsertText(pos Point, text string, opts ...TextInsertOption) (int
 		C.float(pos.X), C.float(pos.Y), cText, cFont, C.float(cfg.fontsize),
 		C.float(cfg.color.R), C.float(cfg.color.G), C.float(cfg.color.B))
 	if errcode != 0 {
-		return 0, ErrSave
+		return 0, p.ctx.failed("Page.InsertText", errcode, ErrSave)
 	}
 	return 1, nil
 }
+
+// Shape collects vector drawings for a PDF page. Draw methods add path
+// segments in page coordinates (top-left origin), Finish strokes and
+// fills the drawings made since the previous Finish, and Commit writes
+// everything to the page as a new content stream.
+type Shape struct {
+	page     *Page
+	draw     strings.Builder // path operators not yet finished
+	contents strings.Builder // finished drawings
+	gstates  map[string][2]float64
+	last     Point
+}
+
+// NewShape returns an empty Shape for the page.
+func (p *Page) NewShape() *Shape {
+	return &Shape{page: p, gstates: make(map[string][2]float64)}
+}
+
+// moveTo starts a new subpath at pt unless the path already ends there.
+func (s *Shape) moveTo(pt Point) {
+	if s.draw.Len() == 0 || pt != s.last {
+		fmt.Fprintf(&s.draw, "%s %s m\n", pdfNum(pt.X), pdfNum(pt.Y))
+	}
+	s.last = pt
+}
+
+func (s *Shape) lineTo(pt Point) {
+	fmt.Fprintf(&s.draw, "%s %s l\n", pdfNum(pt.X), pdfNum(pt.Y))
+	s.last = pt
+}
+
+func (s *Shape) curveTo(c1, c2, pt Point) {
+	fmt.Fprintf(&s.draw, "%s %s %s %s %s %s c\n",
+		pdfNum(c1.X), pdfNum(c1.Y), pdfNum(c2.X), pdfNum(c2.Y), pdfNum(pt.X), pdfNum(pt.Y))
+	s.last = pt
+}
+
+// DrawLine draws a line from p1 to p2 and returns p2.
+func (s *Shape) DrawLine(p1, p2 Point) Point {
+	s.moveTo(p1)
+	s.lineTo(p2)
+	return p2
+}
+
+// DrawPolyline draws lines connecting points in order and returns the
+// last point.
+func (s *Shape) DrawPolyline(points []Point) Point {
+	for i, pt := range points {
+		if i == 0 {
+			s.moveTo(pt)
+		} else {
+			s.lineTo(pt)
+		}
+	}
+	return s.last
+}
+
+// DrawRect draws a rectangle and returns its top-left corner.
+func (s *Shape) DrawRect(r Rect) Point {
+	fmt.Fprintf(&s.draw, "%s %s %s %s re\n",
+		pdfNum(r.X0), pdfNum(r.Y0), pdfNum(r.Width()), pdfNum(r.Height()))
+	s.last = Point{X: r.X0, Y: r.Y0}
+	return s.last
+}
+
+// DrawBezier draws a cubic Bézier curve from p1 to p4 with control points
+// p2 and p3, and returns p4.
+func (s *Shape) DrawBezier(p1, p2, p3, p4 Point) Point {
+	s.moveTo(p1)
+	s.curveTo(p2, p3, p4)
+	return p4
+}
+
+// DrawOval draws the ellipse inscribed in r and returns the middle of its
+// left edge, where the ellipse starts and ends.
+func (s *Shape) DrawOval(r Rect) Point {
+	const k = 0.5522847498 // 4/3 * (sqrt(2) - 1)
+	cx, cy := (r.X0+r.X1)/2, (r.Y0+r.Y1)/2
+	rx, ry := r.Width()/2, r.Height()/2
+	start := Point{X: r.X0, Y: cy}
+	s.moveTo(start)
+	s.curveTo(Point{X: r.X0, Y: cy - k*ry}, Point{X: cx - k*rx, Y: r.Y0}, Point{X: cx, Y: r.Y0})
+	s.curveTo(Point{X: cx + k*rx, Y: r.Y0}, Point{X: r.X1, Y: cy - k*ry}, Point{X: r.X1, Y: cy})
+	s.curveTo(Point{X: r.X1, Y: cy + k*ry}, Point{X: cx + k*rx, Y: r.Y1}, Point{X: cx, Y: r.Y1})
+	s.curveTo(Point{X: cx - k*rx, Y: r.Y1}, Point{X: r.X0, Y: cy + k*ry}, start)
+	s.draw.WriteString("h\n")
+	return start
+}
+
+// DrawCircle draws a circle and returns the leftmost point of it.
+func (s *Shape) DrawCircle(center Point, radius float64) Point {
+	return s.DrawOval(Rect{
+		X0: center.X - radius, Y0: center.Y - radius,
+		X1: center.X + radius, Y1: center.Y + radius,
+	})
+}
+
+// DrawSector draws an arc of the circle around center that starts at
+// point and spans beta degrees; positive angles sweep clockwise as seen
+// on the page. With fullSector, lines from the center to both ends of
+// the arc close it into a pie slice. It returns the end of the arc.
+func (s *Shape) DrawSector(center, point Point, beta float64, fullSector bool) Point {
+	radius := math.Hypot(point.X-center.X, point.Y-center.Y)
+	angle := math.Atan2(point.Y-center.Y, point.X-center.X)
+	if fullSector {
+		s.moveTo(center)
+		s.lineTo(point)
+	} else {
+		s.moveTo(point)
+	}
+	// Approximate the arc with one Bézier curve per quarter circle at most.
+	sweep := beta * math.Pi / 180
+	n := int(math.Ceil(math.Abs(sweep) / (math.Pi / 2)))
+	if n == 0 {
+		n = 1
+	}
+	step := sweep / float64(n)
+	k := 4.0 / 3.0 * math.Tan(step/4) * radius
+	on := func(a float64) Point {
+		return Point{X: center.X + radius*math.Cos(a), Y: center.Y + radius*math.Sin(a)}
+	}
+	for i := 0; i < n; i++ {
+		a0, a1 := angle+float64(i)*step, angle+float64(i+1)*step
+		p0, p3 := on(a0), on(a1)
+		s.curveTo(
+			Point{X: p0.X - k*math.Sin(a0), Y: p0.Y + k*math.Cos(a0)},
+			Point{X: p3.X + k*math.Sin(a1), Y: p3.Y - k*math.Cos(a1)},
+			p3)
+	}
+	end := s.last
+	if fullSector {
+		s.lineTo(center)
+		s.draw.WriteString("h\n")
+	}
+	return end
+}
+
+// Finish strokes and fills the drawings made since the previous Finish
+// as described by opts, or with DefaultFinishOptions if opts is omitted.
+func (s *Shape) Finish(opts ...FinishOptions) {
+	if s.draw.Len() == 0 {
+		return
+	}
+	opt := DefaultFinishOptions()
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	c := &s.contents
+	c.WriteString("q\n")
+	ca, fa := opacity(opt.StrokeOpacity), opacity(opt.FillOpacity)
+	if ca < 1 || fa < 1 {
+		name := fmt.Sprintf("GmGS%d_%d", int(math.Round(ca*1000)), int(math.Round(fa*1000)))
+		s.gstates[name] = [2]float64{ca, fa}
+		fmt.Fprintf(c, "/%s gs\n", name)
+	}
+	fmt.Fprintf(c, "%s w %d J %d j\n", pdfNum(opt.Width), opt.LineCap, opt.LineJoin)
+	if len(opt.Dashes) > 0 {
+		c.WriteString("[")
+		for i, d := range opt.Dashes {
+			if i > 0 {
+				c.WriteString(" ")
+			}
+			c.WriteString(pdfNum(d))
+		}
+		fmt.Fprintf(c, "] %s d\n", pdfNum(opt.DashPhase))
+	}
+	if opt.Color != nil {
+		fmt.Fprintf(c, "%s %s %s RG\n", pdfNum(opt.Color.R), pdfNum(opt.Color.G), pdfNum(opt.Color.B))
+	}
+	if opt.Fill != nil {
+		fmt.Fprintf(c, "%s %s %s rg\n", pdfNum(opt.Fill.R), pdfNum(opt.Fill.G), pdfNum(opt.Fill.B))
+	}
+	c.WriteString(s.draw.String())
+	if opt.ClosePath {
+		c.WriteString("h\n")
+	}
+	op := "n"
+	switch {
+	case opt.Color != nil && opt.Fill != nil:
+		op = "B"
+	case opt.Fill != nil:
+		op = "f"
+	case opt.Color != nil:
+		op = "S"
+	}
+	if opt.EvenOdd && opt.Fill != nil {
+		op += "*"
+	}
+	c.WriteString(op + "\nQ\n")
+	s.draw.Reset()
+}
+
+// Commit writes the finished drawings to the page, on top of the existing
+// contents if overlay is true and underneath them otherwise. Drawings not
+// yet finished are an error. The Shape is empty afterwards and can be
+// reused.
+func (s *Shape) Commit(overlay bool) error {
+	p := s.page
+	if s.draw.Len() > 0 {
+		return fmt.Errorf("%w: Shape.Finish must be called before Commit", ErrInvalidArg)
+	}
+	p.doc.mu.Lock()
+	defer p.doc.mu.Unlock()
+	if p.closed() {
+		return ErrClosed
+	}
+	if p.doc.pdf == nil {
+		return ErrNotPDF
+	}
+	if s.contents.Len() == 0 {
+		return nil
+	}
+	for name, a := range s.gstates {
+		cName := C.CString(name)
+		errcode := C.gomupdf_page_add_extgstate(p.ctx.ctx, p.doc.pdf, C.int(p.number),
+			cName, C.float(a[0]), C.float(a[1]))
+		C.free(unsafe.Pointer(cName))
+		if errcode != 0 {
+			return p.ctx.failed("Shape.Commit", errcode, ErrSave)
+		}
+	}
+	content := s.contents.String()
+	cContent := C.CString(content)
+	defer C.free(unsafe.Pointer(cContent))
+	ov := 0
+	if overlay {
+		ov = 1
+	}
+	errcode := C.gomupdf_add_page_contents(p.ctx.ctx, p.doc.pdf, C.int(p.number),
+		cContent, C.int(len(content)), C.int(ov))
+	if errcode != 0 {
+		return p.ctx.failed("Shape.Commit", errcode, ErrSave)
+	}
+	s.contents.Reset()
+	clear(s.gstates)
+	return nil
+}
+
+// opacity maps a FinishOptions opacity to the range (0, 1].
+func opacity(v float64) float64 {
+	if v <= 0 || v >= 1 {
+		return 1
+	}
+	return v
+}
+
+// pdfNum formats v for a content stream, which does not allow exponents.
+func pdfNum(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 4, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" || s == "" {
+		return "0"
+	}
+	return s
+}
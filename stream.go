@@ -0,0 +1,104 @@
+//go:build cgo && !nomupdf
+
+package gomupdf
+
+/*
+#include "gomupdf.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime/cgo"
+	"sync"
+	"unsafe"
+)
+
+// OpenReader opens a document whose bytes are read on demand from r,
+// without buffering the whole file in memory. size is the total length of
+// the data and magic is a MIME type or file extension hint, as for
+// OpenFromMemory. Every format supported by Open can be read this way.
+//
+// r must remain usable until the document is closed. MuPDF may read from
+// it during any later call on the document or its pages.
+func OpenReader(r io.ReaderAt, size int64, magic string, opts ...OpenOptions) (*Document, error) {
+	if r == nil || size <= 0 {
+		return nil, fmt.Errorf("%w: empty data", ErrOpenFailed)
+	}
+	ctx, err := newContext(opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx.logSink().configure(magic, opts)
+	cMagic := C.CString(magic)
+	defer C.free(unsafe.Pointer(cMagic))
+
+	h := cgo.NewHandle(r)
+	var errcode C.int
+	doc := C.gomupdf_open_document_from_reader(ctx.ctx, cMagic,
+		C.uintptr_t(h), C.int64_t(size), &errcode)
+	if errcode != 0 || doc == nil {
+		err := ctx.failed("OpenReader", errcode, ErrOpenFailed)
+		ctx.close()
+		h.Delete()
+		return nil, err
+	}
+	d := &Document{ctx: ctx, doc: doc, name: magic, reader: h}
+	d.pdf = C.gomupdf_pdf_document(ctx.ctx, doc)
+	d.finishOpen()
+	return d, nil
+}
+
+// OpenReadSeeker is like OpenReader but reads from an io.ReadSeeker. The
+// size is determined by seeking to the end. If rs does not also implement
+// io.ReaderAt, reads are serialized through Seek and Read, so rs must not
+// be used elsewhere while the document is open.
+func OpenReadSeeker(rs io.ReadSeeker, magic string, opts ...OpenOptions) (*Document, error) {
+	if rs == nil {
+		return nil, fmt.Errorf("%w: empty data", ErrOpenFailed)
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOpenFailed, err)
+	}
+	if ra, ok := rs.(io.ReaderAt); ok {
+		return OpenReader(ra, size, magic, opts...)
+	}
+	return OpenReader(&readSeekerAt{rs: rs}, size, magic, opts...)
+}
+
+// readSeekerAt adapts an io.ReadSeeker to io.ReaderAt.
+type readSeekerAt struct {
+	mu sync.Mutex
+	rs io.ReadSeeker
+}
+
+func (r *readSeekerAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.rs, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+//export gomupdfReadAt
+func gomupdfReadAt(handle C.uintptr_t, buf *C.uchar, n C.int, offset C.int64_t) (ret C.int) {
+	defer func() {
+		if recover() != nil {
+			ret = -1
+		}
+	}()
+	r := cgo.Handle(handle).Value().(io.ReaderAt)
+	p := unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(n))
+	k, err := r.ReadAt(p, int64(offset))
+	if k == 0 && err != nil && err != io.EOF {
+		return -1
+	}
+	return C.int(k)
+}
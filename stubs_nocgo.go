@@ -2,6 +2,8 @@
 
 package gomupdf
 
+import "io"
+
 // This file provides stub types and functions when CGO is not available.
 // The full implementation requires MuPDF C library via CGO.
 
@@ -30,17 +32,27 @@ type Annot struct{}
 type Widget struct{}
 
 // Open opens a document (stub - requires CGO with MuPDF).
-func Open(filename string) (*Document, error) {
+func Open(filename string, opts ...OpenOptions) (*Document, error) {
 	return nil, ErrInitFailed
 }
 
 // OpenFromMemory opens a document from memory (stub - requires CGO).
-func OpenFromMemory(data []byte, magic string) (*Document, error) {
+func OpenFromMemory(data []byte, magic string, opts ...OpenOptions) (*Document, error) {
+	return nil, ErrInitFailed
+}
+
+// OpenReader opens a document from an io.ReaderAt (stub - requires CGO).
+func OpenReader(r io.ReaderAt, size int64, magic string, opts ...OpenOptions) (*Document, error) {
+	return nil, ErrInitFailed
+}
+
+// OpenReadSeeker opens a document from an io.ReadSeeker (stub - requires CGO).
+func OpenReadSeeker(rs io.ReadSeeker, magic string, opts ...OpenOptions) (*Document, error) {
 	return nil, ErrInitFailed
 }
 
 // NewPDF creates a new empty PDF (stub - requires CGO).
-func NewPDF() (*Document, error) {
+func NewPDF(opts ...OpenOptions) (*Document, error) {
 	return nil, ErrInitFailed
 }
 
@@ -0,0 +1,575 @@
+package gomupdf
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ToRows returns the text of the table's cells row by row. Positions
+// covered by a merged cell are empty strings.
+func (t *Table) ToRows() [][]string {
+	rows := make([][]string, len(t.Cells))
+	for i, row := range t.Cells {
+		rows[i] = make([]string, len(row))
+		for j, c := range row {
+			rows[i][j] = c.Text
+		}
+	}
+	return rows
+}
+
+// ToCSV returns the rows of the table as CSV.
+func (t *Table) ToCSV() string {
+	var sb strings.Builder
+	w := csv.NewWriter(&sb)
+	w.WriteAll(t.ToRows()) // writes to a strings.Builder cannot fail
+	return sb.String()
+}
+
+// ToMarkdown returns the table as a GitHub-flavored Markdown table. If
+// the table has no header row, the columns are named Col1, Col2 and so
+// on.
+func (t *Table) ToMarkdown() string {
+	rows := t.ToRows()
+	if len(rows) == 0 {
+		return ""
+	}
+	header := t.Header
+	if header == nil {
+		header = make([]string, len(rows[0]))
+		for j := range header {
+			header[j] = fmt.Sprintf("Col%d", j+1)
+		}
+	} else {
+		rows = rows[1:]
+	}
+	var sb strings.Builder
+	writeRow := func(cells []string) {
+		sb.WriteString("|")
+		for _, c := range cells {
+			c = strings.ReplaceAll(c, "|", `\|`)
+			c = strings.ReplaceAll(c, "\n", "<br>")
+			sb.WriteString(c + "|")
+		}
+		sb.WriteString("\n")
+	}
+	writeRow(header)
+	sb.WriteString("|" + strings.Repeat("---|", len(header)) + "\n")
+	for _, row := range rows {
+		writeRow(row)
+	}
+	return sb.String()
+}
+
+// findTables detects the tables formed by the ruling lines in drawings
+// and, unless opt says otherwise, by the alignment of the words that are
+// not inside one of those.
+func findTables(drawings []Drawing, words []TextWord, opt TableOptions) []*Table {
+	if opt.Clip != (Rect{}) {
+		var in []TextWord
+		for _, w := range words {
+			if opt.Clip.Contains(rectCenter(w.Rect)) {
+				in = append(in, w)
+			}
+		}
+		words = in
+	}
+	var tables []*Table
+	if opt.Strategy != TableStrategyText {
+		h, v := rulingLines(drawings, opt)
+		tables = gridTables(h, v, words, opt.SnapTolerance)
+	}
+	if opt.Strategy != TableStrategyLines {
+		var rest []TextWord
+		for _, w := range words {
+			if !insideAny(tables, rectCenter(w.Rect)) {
+				rest = append(rest, w)
+			}
+		}
+		tables = append(tables, textTables(rest, opt)...)
+	}
+	for _, t := range tables {
+		t.Header = detectHeader(t)
+	}
+	sort.SliceStable(tables, func(i, j int) bool {
+		a, b := tables[i].Rect, tables[j].Rect
+		if a.Y0 != b.Y0 {
+			return a.Y0 < b.Y0
+		}
+		return a.X0 < b.X0
+	})
+	return tables
+}
+
+// segment is a horizontal or vertical ruling line. For horizontal lines
+// pos is y and [from, to] the x range; for vertical lines the reverse.
+type segment struct {
+	pos, from, to float64
+}
+
+// rulingLines collects the horizontal and vertical lines drawn on the
+// page: straight line segments, rectangle edges, and rectangles thin
+// enough to be lines themselves. Nearby collinear lines are merged.
+func rulingLines(drawings []Drawing, opt TableOptions) (h, v []segment) {
+	tol := opt.SnapTolerance
+	addH := func(y, x0, x1 float64) {
+		h = append(h, segment{y, math.Min(x0, x1), math.Max(x0, x1)})
+	}
+	addV := func(x, y0, y1 float64) {
+		v = append(v, segment{x, math.Min(y0, y1), math.Max(y0, y1)})
+	}
+	for _, d := range drawings {
+		for _, it := range d.Items {
+			switch it.Kind {
+			case PathLine:
+				a, b := it.Points[0], it.Points[1]
+				switch {
+				case math.Abs(a.Y-b.Y) <= tol && math.Abs(a.X-b.X) > tol:
+					addH((a.Y+b.Y)/2, a.X, b.X)
+				case math.Abs(a.X-b.X) <= tol && math.Abs(a.Y-b.Y) > tol:
+					addV((a.X+b.X)/2, a.Y, b.Y)
+				}
+			case PathRect:
+				r := it.Rect.Normalize()
+				switch {
+				case r.Height() <= tol && r.Width() > tol:
+					addH((r.Y0+r.Y1)/2, r.X0, r.X1)
+				case r.Width() <= tol && r.Height() > tol:
+					addV((r.X0+r.X1)/2, r.Y0, r.Y1)
+				case r.Width() > tol && r.Height() > tol:
+					addH(r.Y0, r.X0, r.X1)
+					addH(r.Y1, r.X0, r.X1)
+					addV(r.X0, r.Y0, r.Y1)
+					addV(r.X1, r.Y0, r.Y1)
+				}
+			}
+		}
+	}
+	if opt.Clip != (Rect{}) {
+		c := opt.Clip
+		h = clipSegments(h, c.Y0, c.Y1, c.X0, c.X1)
+		v = clipSegments(v, c.X0, c.X1, c.Y0, c.Y1)
+	}
+	return mergeSegments(h, tol), mergeSegments(v, tol)
+}
+
+// clipSegments keeps the parts of segs with pos in [p0, p1] and range
+// inside [r0, r1].
+func clipSegments(segs []segment, p0, p1, r0, r1 float64) []segment {
+	var out []segment
+	for _, s := range segs {
+		s.from, s.to = math.Max(s.from, r0), math.Min(s.to, r1)
+		if s.pos >= p0 && s.pos <= p1 && s.from < s.to {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// mergeSegments snaps segments less than tol apart onto one position and
+// joins those that overlap or nearly touch.
+func mergeSegments(segs []segment, tol float64) []segment {
+	sort.Slice(segs, func(i, j int) bool { return segs[i].pos < segs[j].pos })
+	var out []segment
+	for i := 0; i < len(segs); {
+		j, sum := i, 0.0
+		for ; j < len(segs) && segs[j].pos-segs[i].pos <= tol; j++ {
+			sum += segs[j].pos
+		}
+		group := segs[i:j]
+		pos := sum / float64(len(group))
+		sort.Slice(group, func(a, b int) bool { return group[a].from < group[b].from })
+		cur := segment{pos, group[0].from, group[0].to}
+		for _, s := range group[1:] {
+			if s.from <= cur.to+tol {
+				cur.to = math.Max(cur.to, s.to)
+				continue
+			}
+			out = append(out, cur)
+			cur = segment{pos, s.from, s.to}
+		}
+		out = append(out, cur)
+		i = j
+	}
+	return out
+}
+
+// gridTables builds a table from each connected set of ruling lines that
+// has at least two horizontal and two vertical lines.
+func gridTables(h, v []segment, words []TextWord, tol float64) []*Table {
+	parent := make([]int, len(h)+len(v))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i, hs := range h {
+		for j, vs := range v {
+			if vs.pos >= hs.from-tol && vs.pos <= hs.to+tol && hs.pos >= vs.from-tol && hs.pos <= vs.to+tol {
+				parent[find(i)] = find(len(h) + j)
+			}
+		}
+	}
+	groups := make(map[int][2][]segment)
+	var roots []int
+	for i := range parent {
+		r := find(i)
+		g, ok := groups[r]
+		if !ok {
+			roots = append(roots, r)
+		}
+		if i < len(h) {
+			g[0] = append(g[0], h[i])
+		} else {
+			g[1] = append(g[1], v[i-len(h)])
+		}
+		groups[r] = g
+	}
+	var tables []*Table
+	for _, r := range roots {
+		g := groups[r]
+		if len(g[0]) < 2 || len(g[1]) < 2 {
+			continue
+		}
+		if t := gridTable(g[0], g[1], words, tol); t != nil {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// gridTable lays a grid over the connected lines h and v. Grid cells
+// that no line separates are merged into one table cell.
+func gridTable(h, v []segment, words []TextWord, tol float64) *Table {
+	xs := []float64{math.Inf(1), math.Inf(-1)}
+	for _, s := range h {
+		xs[0], xs[1] = math.Min(xs[0], s.from), math.Max(xs[1], s.to)
+	}
+	ys := []float64{math.Inf(1), math.Inf(-1)}
+	for _, s := range v {
+		ys[0], ys[1] = math.Min(ys[0], s.from), math.Max(ys[1], s.to)
+		xs = append(xs, s.pos)
+	}
+	for _, s := range h {
+		ys = append(ys, s.pos)
+	}
+	xs, ys = snapValues(xs, tol), snapValues(ys, tol)
+	rows, cols := len(ys)-1, len(xs)-1
+	if rows < 1 || cols < 1 {
+		return nil
+	}
+	covered := func(segs []segment, pos, mid float64) bool {
+		for _, s := range segs {
+			if math.Abs(s.pos-pos) <= tol && mid >= s.from-tol && mid <= s.to+tol {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Union the grid cells, numbered row by row, that have no line
+	// between them.
+	parent := make([]int, rows*cols)
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(a, b int) {
+		ra, rb := find(a), find(b)
+		if ra < rb {
+			ra, rb = rb, ra
+		}
+		parent[ra] = rb // the root is the top-left grid cell
+	}
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			if j+1 < cols && !covered(v, xs[j+1], (ys[i]+ys[i+1])/2) {
+				union(i*cols+j, i*cols+j+1)
+			}
+			if i+1 < rows && !covered(h, ys[i+1], (xs[j]+xs[j+1])/2) {
+				union(i*cols+j, (i+1)*cols+j)
+			}
+		}
+	}
+
+	t := &Table{Rect: NewRect(xs[0], ys[0], xs[cols], ys[rows]), Cells: make([][]TableCell, rows)}
+	cells := 0
+	for i := range t.Cells {
+		t.Cells[i] = make([]TableCell, cols)
+	}
+	for k := range parent {
+		root := find(k)
+		i, j := k/cols, k%cols
+		r := NewRect(xs[j], ys[i], xs[j+1], ys[i+1])
+		c := &t.Cells[root/cols][root%cols]
+		if root == k {
+			c.Rect = r
+			cells++
+		} else {
+			c.Rect = c.Rect.Union(r)
+		}
+	}
+	if cells < 2 {
+		return nil
+	}
+	cellWords := make(map[*TableCell][]TextWord)
+	for _, w := range words {
+		p := rectCenter(w.Rect)
+		i, j := sort.SearchFloat64s(ys, p.Y)-1, sort.SearchFloat64s(xs, p.X)-1
+		if i < 0 || i >= rows || j < 0 || j >= cols {
+			continue
+		}
+		root := find(i*cols + j)
+		c := &t.Cells[root/cols][root%cols]
+		cellWords[c] = append(cellWords[c], w)
+	}
+	for c, ws := range cellWords {
+		c.Text = wordsText(ws)
+	}
+	return t
+}
+
+// snapValues sorts vals and replaces runs of values less than tol apart
+// by their mean.
+func snapValues(vals []float64, tol float64) []float64 {
+	sort.Float64s(vals)
+	var out []float64
+	for i := 0; i < len(vals); {
+		j, sum := i, 0.0
+		for ; j < len(vals) && vals[j]-vals[i] <= tol; j++ {
+			sum += vals[j]
+		}
+		out = append(out, sum/float64(j-i))
+		i = j
+	}
+	return out
+}
+
+// textRow is a line of words with its segments: runs of words separated
+// by less than the minimum column gap.
+type textRow struct {
+	rect Rect
+	segs [][]TextWord
+}
+
+// textTables finds runs of rows whose words line up in columns, as in
+// tables drawn without ruling lines.
+func textTables(words []TextWord, opt TableOptions) []*Table {
+	var rows []textRow
+	for _, line := range wordLines(words) {
+		row := textRow{}
+		for i, w := range line {
+			row.rect = row.rect.Union(w.Rect)
+			if i == 0 || w.Rect.X0-line[i-1].Rect.X1 >= opt.MinColumnGap {
+				row.segs = append(row.segs, nil)
+			}
+			row.segs[len(row.segs)-1] = append(row.segs[len(row.segs)-1], w)
+		}
+		rows = append(rows, row)
+	}
+
+	var tables []*Table
+	for i := 0; i < len(rows); {
+		if len(rows[i].segs) < 2 {
+			i++
+			continue
+		}
+		// Extend the run over tabular rows, and over single rows such as
+		// section titles between them, while the rows stay close.
+		end, tabular := i+1, 1
+		for j := i + 1; j < len(rows); j++ {
+			prev := rows[j-1].rect
+			if rows[j].rect.Y0-prev.Y1 > 1.5*prev.Height() {
+				break
+			}
+			if len(rows[j].segs) >= 2 {
+				end, tabular = j+1, tabular+1
+			} else if j+1 >= len(rows) || len(rows[j+1].segs) < 2 {
+				break
+			}
+		}
+		if tabular >= opt.MinRows {
+			if t := textTable(rows[i:end]); t != nil {
+				tables = append(tables, t)
+			}
+		}
+		i = end
+	}
+	return tables
+}
+
+// textTable makes a table of rows. The columns are the x ranges of the
+// segments in the rows with the most segments; every word goes to the
+// column its center falls in.
+func textTable(rows []textRow) *Table {
+	most := 0
+	for _, r := range rows {
+		most = max(most, len(r.segs))
+	}
+	var spans [][2]float64
+	for _, r := range rows {
+		if len(r.segs) != most {
+			continue
+		}
+		for _, seg := range r.segs {
+			spans = append(spans, [2]float64{seg[0].Rect.X0, seg[len(seg)-1].Rect.X1})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	var colSpans [][2]float64
+	for _, s := range spans {
+		if n := len(colSpans); n > 0 && s[0] <= colSpans[n-1][1] {
+			colSpans[n-1][1] = math.Max(colSpans[n-1][1], s[1])
+			continue
+		}
+		colSpans = append(colSpans, s)
+	}
+	if len(colSpans) < 2 {
+		return nil
+	}
+
+	var area Rect
+	for _, r := range rows {
+		area = area.Union(r.rect)
+	}
+	xs := []float64{area.X0}
+	for k := 1; k < len(colSpans); k++ {
+		xs = append(xs, (colSpans[k-1][1]+colSpans[k][0])/2)
+	}
+	xs = append(xs, area.X1)
+	ys := []float64{area.Y0}
+	for k := 1; k < len(rows); k++ {
+		ys = append(ys, (rows[k-1].rect.Y1+rows[k].rect.Y0)/2)
+	}
+	ys = append(ys, area.Y1)
+
+	t := &Table{Rect: area, Cells: make([][]TableCell, len(rows))}
+	words := make([]int, len(colSpans))
+	filled := make([]int, len(colSpans))
+	for i, r := range rows {
+		cellWords := make([][]TextWord, len(colSpans))
+		for _, seg := range r.segs {
+			for _, w := range seg {
+				j := sort.SearchFloat64s(xs[1:len(xs)-1], rectCenter(w.Rect).X)
+				cellWords[j] = append(cellWords[j], w)
+			}
+		}
+		t.Cells[i] = make([]TableCell, len(colSpans))
+		for j, ws := range cellWords {
+			t.Cells[i][j] = TableCell{Rect: NewRect(xs[j], ys[i], xs[j+1], ys[i+1]), Text: wordsText(ws)}
+			if len(ws) > 0 {
+				words[j] += len(ws)
+				filled[j]++
+			}
+		}
+	}
+	// Columns of running text, as in a two-column layout, are not a
+	// table: real tables have a column of short entries.
+	for j := range words {
+		if filled[j] > 0 && words[j] <= 3*filled[j] {
+			return t
+		}
+	}
+	return nil
+}
+
+// wordLines groups words into lines by their vertical centers and sorts
+// each line from left to right.
+func wordLines(words []TextWord) [][]TextWord {
+	ws := append([]TextWord(nil), words...)
+	sort.SliceStable(ws, func(i, j int) bool { return rectCenter(ws[i].Rect).Y < rectCenter(ws[j].Rect).Y })
+	var lines [][]TextWord
+	var top, bottom float64
+	for _, w := range ws {
+		c := rectCenter(w.Rect).Y
+		if n := len(lines); n > 0 && c >= top && c <= bottom {
+			lines[n-1] = append(lines[n-1], w)
+			continue
+		}
+		lines = append(lines, []TextWord{w})
+		top, bottom = w.Rect.Y0, w.Rect.Y1
+	}
+	for _, l := range lines {
+		sort.SliceStable(l, func(i, j int) bool { return l[i].Rect.X0 < l[j].Rect.X0 })
+	}
+	return lines
+}
+
+// wordsText joins words into lines of text separated by "\n".
+func wordsText(words []TextWord) string {
+	var lines []string
+	for _, l := range wordLines(words) {
+		texts := make([]string, len(l))
+		for i, w := range l {
+			texts[i] = w.Text
+		}
+		lines = append(lines, strings.Join(texts, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// detectHeader returns the first row of t as column names if it looks
+// like a header: it has no numbers, while a later row of the same column
+// does.
+func detectHeader(t *Table) []string {
+	if len(t.Cells) < 2 {
+		return nil
+	}
+	names := make([]string, len(t.Cells[0]))
+	for j, c := range t.Cells[0] {
+		if isNumber(c.Text) {
+			return nil
+		}
+		names[j] = c.Text
+	}
+	for _, row := range t.Cells[1:] {
+		for j, c := range row {
+			if names[j] != "" && isNumber(c.Text) {
+				return names
+			}
+		}
+	}
+	return nil
+}
+
+// isNumber reports whether s is a number as written in financial
+// tables, such as "1,234.50", "(12)", "-3%" or "$ 7".
+func isNumber(s string) bool {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case ',', ' ', '$', '€', '£', '¥', '%', '(', ')':
+			return -1
+		}
+		return r
+	}, s)
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+func rectCenter(r Rect) Point {
+	return Point{(r.X0 + r.X1) / 2, (r.Y0 + r.Y1) / 2}
+}
+
+func insideAny(tables []*Table, p Point) bool {
+	for _, t := range tables {
+		if t.Rect.Contains(p) {
+			return true
+		}
+	}
+	return false
+}
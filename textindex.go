@@ -0,0 +1,162 @@
+package gomupdf
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// textIndex holds the text of a structured text page as one rune slice,
+// with the character each rune comes from, for searching. Lines are
+// separated by '\n', which comes from no character.
+type textIndex struct {
+	text  []rune
+	quads []Quad // quad of each rune's character
+	line  []int  // line of each rune, -1 for separators
+	lines [][2]int
+}
+
+func newTextIndex(blocks []STextBlock) *textIndex {
+	x := &textIndex{}
+	for _, b := range blocks {
+		for _, l := range b.Lines {
+			if len(x.text) > 0 {
+				x.add('\n', Quad{}, -1)
+			}
+			start := len(x.text)
+			for _, ch := range l.Chars {
+				x.add(ch.C, ch.Quad, len(x.lines))
+			}
+			x.lines = append(x.lines, [2]int{start, len(x.text)})
+		}
+	}
+	return x
+}
+
+func (x *textIndex) add(r rune, q Quad, line int) {
+	x.text = append(x.text, r)
+	x.quads = append(x.quads, q)
+	x.line = append(x.line, line)
+}
+
+// find returns the start and end of every hit of needle, without
+// overlaps. Whitespace in needle matches any run of whitespace, including
+// line breaks.
+func (x *textIndex) find(needle string, opt SearchOptions) [][2]int {
+	pat := []rune(strings.Join(strings.Fields(needle), " "))
+	if len(pat) == 0 {
+		return nil
+	}
+	var hits [][2]int
+	for i := 0; i < len(x.text); i++ {
+		end := x.matchAt(i, pat, opt.CaseSensitive)
+		if end < 0 || opt.WholeWords && !x.wordBounded(i, end) {
+			continue
+		}
+		hits = append(hits, [2]int{i, end})
+		i = end - 1
+	}
+	return hits
+}
+
+// matchAt returns the end of the match of pat at text[i:], or -1.
+func (x *textIndex) matchAt(i int, pat []rune, caseSensitive bool) int {
+	for _, c := range pat {
+		if i >= len(x.text) {
+			return -1
+		}
+		if c == ' ' {
+			if !unicode.IsSpace(x.text[i]) {
+				return -1
+			}
+			for i < len(x.text) && unicode.IsSpace(x.text[i]) {
+				i++
+			}
+			continue
+		}
+		if r := x.text[i]; r != c && (caseSensitive || !foldEqual(r, c)) {
+			return -1
+		}
+		i++
+	}
+	return i
+}
+
+// findRegexp returns the start and end of every non-empty match of re.
+func (x *textIndex) findRegexp(re *regexp.Regexp) [][2]int {
+	var sb strings.Builder
+	at := make([]int, len(x.text)) // byte offset of each rune
+	for i, r := range x.text {
+		at[i] = sb.Len()
+		sb.WriteRune(r)
+	}
+	runeIndex := func(off int) int { return sort.SearchInts(at, off) }
+	var hits [][2]int
+	for _, m := range re.FindAllStringIndex(sb.String(), -1) {
+		if m[0] < m[1] {
+			hits = append(hits, [2]int{runeIndex(m[0]), runeIndex(m[1])})
+		}
+	}
+	return hits
+}
+
+func (x *textIndex) wordBounded(start, end int) bool {
+	return (start == 0 || !isWordRune(x.text[start-1])) &&
+		(end == len(x.text) || !isWordRune(x.text[end]))
+}
+
+// result describes the hit text[start:end]: a quad for each line it
+// touches, and the text of those lines as context. A dehyphenated line
+// gets a quad for each of its parts.
+func (x *textIndex) result(start, end int) SearchResult {
+	var res SearchResult
+	first, last := -1, -1
+	for i := start; i < end; i++ {
+		l := x.line[i]
+		if l < 0 || unicode.IsSpace(x.text[i]) {
+			continue
+		}
+		q := x.quads[i]
+		if l != last || !continues(res.Quads[len(res.Quads)-1], q) {
+			res.Quads = append(res.Quads, q)
+			if first < 0 {
+				first = l
+			}
+			last = l
+			continue
+		}
+		cur := &res.Quads[len(res.Quads)-1]
+		cur.UR, cur.LR = q.UR, q.LR
+	}
+	if first >= 0 {
+		ctx := x.text[x.lines[first][0]:x.lines[last][1]]
+		res.Context = strings.ReplaceAll(string(ctx), "\n", " ")
+	}
+	return res
+}
+
+// continues reports whether the character quad q follows the text of
+// quad prev on the same baseline, rather than on a later line.
+func continues(prev, q Quad) bool {
+	height := math.Hypot(q.LL.X-q.UL.X, q.LL.Y-q.UL.Y)
+	return math.Hypot(q.LL.X-prev.LR.X, q.LL.Y-prev.LR.Y) <= height
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// foldEqual reports whether a and b are equal under Unicode case folding.
+func foldEqual(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	for f := unicode.SimpleFold(a); f != a; f = unicode.SimpleFold(f) {
+		if f == b {
+			return true
+		}
+	}
+	return false
+}
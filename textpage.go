@@ -6,42 +6,255 @@ package gomupdf
 #include "gomupdf.h"
 */
 import "C"
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strings"
+	"unsafe"
+)
 
 // TextPage represents extracted text and images from a page.
+// It owns a private MuPDF context and does not touch the document after
+// creation, so it may be used independently of other goroutines.
 type TextPage struct {
-	ctx *context
-	tp  *C.fz_stext_page
+	ctx    *fzContext
+	tp     *C.fz_stext_page
+	page   int         // number of the page the text comes from
+	opt    TextOptions // options the text was extracted with
+	origin origin
+}
+
+// newTextPage wraps tp, which takes ownership of ctx.
+func newTextPage(ctx *fzContext, tp *C.fz_stext_page, page int, opt TextOptions) *TextPage {
+	t := &TextPage{ctx: ctx, tp: tp, page: page, opt: opt, origin: captureOrigin()}
+	runtime.SetFinalizer(t, (*TextPage).finalize)
+	return t
 }
 
 func (t *TextPage) Close() {
-	if t.tp != nil {
-		C.gomupdf_drop_stext_page(t.ctx.ctx, t.tp)
-		t.tp = nil
+	t.release()
+	runtime.SetFinalizer(t, nil)
+}
+
+func (t *TextPage) finalize() {
+	if t.release() {
+		t.origin.reportLeak("TextPage")
+	}
+}
+
+// release drops the text page and its context, and reports whether the
+// text page was still open.
+func (t *TextPage) release() bool {
+	if t.tp == nil {
+		return false
 	}
+	C.gomupdf_drop_stext_page(t.ctx.ctx, t.tp)
+	t.tp = nil
+	t.ctx.close()
+	return true
 }
 
 func (t *TextPage) ExtractText() (string, error) {
+	if t.tp == nil {
+		return "", ErrClosed
+	}
 	var errcode C.int
 	cText := C.gomupdf_stext_page_as_text(t.ctx.ctx, t.tp, &errcode)
 	if errcode != 0 || cText == nil {
-		return "", ErrTextExtract
+		return "", t.ctx.failed("TextPage.ExtractText", errcode, ErrTextExtract)
 	}
 	defer t.ctx.freeString(cText)
 	return C.GoString(cText), nil
 }
 
+// Text returns the text of the page in any output format accepted by
+// Page.GetText. Words in "words" output are split at the delimiters of
+// the options the text page was extracted with.
+func (t *TextPage) Text(output string) (string, error) {
+	if output == "" {
+		output = "text"
+	}
+	if _, ok := textFormats[output]; !ok {
+		return "", fmt.Errorf("%w: unknown text output %q", ErrInvalidArg, output)
+	}
+	return t.text(output, t.opt.Delimiters)
+}
+
+// text returns the text in output, a known format, splitting words at
+// delims.
+func (t *TextPage) text(output, delims string) (string, error) {
+	if t.tp == nil {
+		return "", ErrClosed
+	}
+	switch output {
+	case "blocks":
+		var sb strings.Builder
+		for _, b := range stextBlocks(t.tp) {
+			typ := 0
+			if b.Type == "image" {
+				typ = 1
+			}
+			fmt.Fprintf(&sb, "%s %q %d %d\n", rectFields(b.Rect), b.Text, b.BlockNo, typ)
+		}
+		return sb.String(), nil
+	case "words":
+		var sb strings.Builder
+		for _, w := range stextWords(t.tp, delims) {
+			fmt.Fprintf(&sb, "%s %q %d %d %d\n", rectFields(w.Rect), w.Text, w.BlockNo, w.LineNo, w.WordNo)
+		}
+		return sb.String(), nil
+	}
+	var errcode C.int
+	var cText *C.char
+	if format := textFormats[output]; format < 0 {
+		cText = C.gomupdf_stext_page_as_text(t.ctx.ctx, t.tp, &errcode)
+	} else {
+		cText = C.gomupdf_stext_page_print(t.ctx.ctx, t.tp, format, C.int(t.page), &errcode)
+	}
+	if errcode != 0 || cText == nil {
+		return "", t.ctx.failed("TextPage.Text", errcode, ErrTextExtract)
+	}
+	defer t.ctx.freeString(cText)
+	return C.GoString(cText), nil
+}
+
+// Words returns the words of the page as Page.GetTextWords does, split at
+// the delimiters of the options the text page was extracted with.
+func (t *TextPage) Words() []TextWord {
+	if t.tp == nil {
+		return nil
+	}
+	return stextWords(t.tp, t.opt.Delimiters)
+}
+
+// TextBlocks returns the blocks of the page as Page.GetTextBlocks does.
+// It is not named Blocks because Blocks already returns the structured
+// blocks, with their lines and characters.
+func (t *TextPage) TextBlocks() []TextBlock {
+	if t.tp == nil {
+		return nil
+	}
+	return stextBlocks(t.tp)
+}
+
+// blockImages returns the images of the image blocks as PNG files, in
+// block order.
+func (t *TextPage) blockImages() ([][]byte, error) {
+	var images [][]byte
+	for block := t.tp.first_block; block != nil; block = block.next {
+		if block._type != C.FZ_STEXT_BLOCK_IMAGE {
+			continue
+		}
+		var n, errcode C.int
+		data := C.gomupdf_stext_block_png(t.ctx.ctx, block, &n, &errcode)
+		if errcode != 0 {
+			return nil, t.ctx.failed("TextPage.blockImages", errcode, ErrTextExtract)
+		}
+		images = append(images, C.GoBytes(unsafe.Pointer(data), n))
+		t.ctx.freeBytes(data)
+	}
+	return images, nil
+}
+
+// Search finds needle in the text as Page.Search does.
+func (t *TextPage) Search(needle string, opts ...SearchOptions) ([]SearchResult, error) {
+	if t.tp == nil {
+		return nil, ErrClosed
+	}
+	opt := DefaultSearchOptions()
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	x := newTextIndex(t.Blocks())
+	var results []SearchResult
+	for _, h := range x.find(needle, opt) {
+		res := x.result(h[0], h[1])
+		res.Page = t.page
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// SearchRegexp returns the matches of re in the text of the page, with a
+// quad for every line a match spans, ready for Page.AddHighlightAnnot.
+// Lines are joined with "\n", so patterns can span line breaks, for
+// example with \s+. If the text page was extracted with TextDeHyphenate,
+// words hyphenated at the end of a line are matched as whole words.
+func (t *TextPage) SearchRegexp(re *regexp.Regexp) ([]SearchResult, error) {
+	if t.tp == nil {
+		return nil, ErrClosed
+	}
+	if re == nil {
+		return nil, ErrInvalidArg
+	}
+	x := newTextIndex(t.Blocks())
+	var results []SearchResult
+	for _, m := range x.findRegexp(re) {
+		res := x.result(m[0], m[1])
+		res.Page = t.page
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// Selection selects the text between a and b in reading order, the way
+// dragging the mouse from a to b does in a viewer. mode is SelectChars,
+// SelectWords or SelectLines; the latter two extend the selection to
+// whole words or lines.
+func (t *TextPage) Selection(a, b Point, mode int) (Selection, error) {
+	if t.tp == nil {
+		return Selection{}, ErrClosed
+	}
+	if mode < SelectChars || mode > SelectLines {
+		return Selection{}, fmt.Errorf("%w: selection mode %d", ErrInvalidArg, mode)
+	}
+	var quads *C.fz_quad
+	var count, errcode C.int
+	cText := C.gomupdf_stext_selection(t.ctx.ctx, t.tp, C.float(a.X), C.float(a.Y), C.float(b.X), C.float(b.Y),
+		C.int(mode), &quads, &count, &errcode)
+	defer C.gomupdf_free(t.ctx.ctx, unsafe.Pointer(quads))
+	if errcode != 0 || cText == nil {
+		return Selection{}, t.ctx.failed("TextPage.Selection", errcode, ErrTextExtract)
+	}
+	defer t.ctx.freeString(cText)
+	sel := Selection{Text: C.GoString(cText)}
+	for _, q := range unsafe.Slice(quads, int(count)) {
+		sel.Quads = append(sel.Quads, quadFromC(q))
+	}
+	return sel, nil
+}
+
+// CopyRect returns the text of the characters that overlap r, with the
+// lines separated by line breaks.
+func (t *TextPage) CopyRect(r Rect) (string, error) {
+	if t.tp == nil {
+		return "", ErrClosed
+	}
+	var errcode C.int
+	cText := C.gomupdf_stext_copy_rect(t.ctx.ctx, t.tp, C.float(r.X0), C.float(r.Y0), C.float(r.X1), C.float(r.Y1), &errcode)
+	if errcode != 0 || cText == nil {
+		return "", t.ctx.failed("TextPage.CopyRect", errcode, ErrTextExtract)
+	}
+	defer t.ctx.freeString(cText)
+	return C.GoString(cText), nil
+}
+
+// Blocks returns the blocks of the text page. Text blocks list their
+// lines, and each line its characters both individually and grouped into
+// spans.
 func (t *TextPage) Blocks() []STextBlock {
+	if t.tp == nil {
+		return nil
+	}
+	fonts := make(map[*C.fz_font]stextFont)
 	var blocks []STextBlock
 	for block := t.tp.first_block; block != nil; block = block.next {
-		b := STextBlock{
-			Rect: Rect{
-				X0: float64(block.bbox.x0), Y0: float64(block.bbox.y0),
-				X1: float64(block.bbox.x1), Y1: float64(block.bbox.y1),
-			},
-		}
+		b := STextBlock{Rect: rectFromC(block.bbox)}
 		if block._type == C.FZ_STEXT_BLOCK_TEXT {
 			b.Type = STextBlockText
-			b.Lines = t.extractLines(block)
+			b.Lines = t.extractLines(block, fonts)
 		} else {
 			b.Type = STextBlockImage
 		}
@@ -50,41 +263,210 @@ func (t *TextPage) Blocks() []STextBlock {
 	return blocks
 }
 
-func (t *TextPage) extractLines(block *C.fz_stext_block) []STextLine {
+// stextFont holds the properties of a font used on a text page.
+type stextFont struct {
+	name                string
+	flags               int // TextFont* flags of the font itself
+	ascender, descender float64
+}
+
+// font returns the properties of f, looking them up once per text page.
+func (t *TextPage) font(f *C.fz_font, fonts map[*C.fz_font]stextFont) stextFont {
+	if sf, ok := fonts[f]; ok {
+		return sf
+	}
+	var info C.gomupdf_stext_font
+	C.gomupdf_stext_font_info(t.ctx.ctx, f, &info)
+	sf := stextFont{
+		name:      C.GoString(info.name),
+		ascender:  float64(info.ascender),
+		descender: float64(info.descender),
+	}
+	if isSubsetFontName(sf.name) {
+		sf.name = sf.name[7:]
+	}
+	for _, fl := range []struct {
+		set  C.int
+		flag int
+	}{
+		{info.italic, TextFontItalic},
+		{info.serif, TextFontSerifed},
+		{info.monospaced, TextFontMonospaced},
+		{info.bold, TextFontBold},
+	} {
+		if fl.set != 0 {
+			sf.flags |= fl.flag
+		}
+	}
+	fonts[f] = sf
+	return sf
+}
+
+func (t *TextPage) extractLines(block *C.fz_stext_block, fonts map[*C.fz_font]stextFont) []STextLine {
 	var lines []STextLine
 	for line := C.gomupdf_stext_block_first_line(block); line != nil; line = line.next {
 		l := STextLine{
-			Rect: Rect{
-				X0: float64(line.bbox.x0), Y0: float64(line.bbox.y0),
-				X1: float64(line.bbox.x1), Y1: float64(line.bbox.y1),
-			},
-			Dir: Point{X: float64(line.dir.x), Y: float64(line.dir.y)},
+			Rect:  rectFromC(line.bbox),
+			Dir:   pointFromC(line.dir),
+			WMode: int(line.wmode),
 		}
+		// Like PyMuPDF, a character of horizontal text is a superscript if
+		// it sits noticeably above the baseline of the line's first one.
+		horizontal := line.wmode == 0 && line.dir.x == 1 && line.dir.y == 0
+		var span *STextSpan
+		var spanFont *C.fz_font
 		for ch := line.first_char; ch != nil; ch = ch.next {
-			l.Chars = append(l.Chars, STextChar{
+			f := t.font(ch.font, fonts)
+			flags := f.flags
+			if horizontal && ch.origin.y < line.first_char.origin.y-ch.size*0.1 {
+				flags |= TextFontSuperscript
+			}
+			c := STextChar{
 				C:      rune(ch.c),
-				Origin: Point{X: float64(ch.origin.x), Y: float64(ch.origin.y)},
-				Rect: Rect{
-					X0: float64(ch.quad.ul.x), Y0: float64(ch.quad.ul.y),
-					X1: float64(ch.quad.lr.x), Y1: float64(ch.quad.lr.y),
-				},
-			})
+				Origin: pointFromC(ch.origin),
+				Quad:   quadFromC(ch.quad),
+				Size:   float64(ch.size),
+				Font:   f.name,
+				Color:  colorFromRGB(int(ch.color)),
+				Bidi:   int(ch.bidi),
+			}
+			c.Rect = c.Quad.Rect()
+			l.Chars = append(l.Chars, c)
+			if span == nil || ch.font != spanFont || c.Size != span.Size || flags != span.Flags ||
+				c.Color != span.Color || c.Bidi != span.BidiLevel {
+				l.Spans = append(l.Spans, STextSpan{
+					Font:      f.name,
+					Size:      c.Size,
+					Flags:     flags,
+					Color:     c.Color,
+					Ascender:  f.ascender,
+					Descender: f.descender,
+					BidiLevel: c.Bidi,
+					Origin:    c.Origin,
+					Rect:      c.Rect,
+				})
+				span = &l.Spans[len(l.Spans)-1]
+				spanFont = ch.font
+			}
+			span.Rect = span.Rect.Union(c.Rect)
+			span.Chars = append(span.Chars, c)
 		}
 		lines = append(lines, l)
 	}
 	return lines
 }
 
+// colorFromRGB converts a 0xRRGGBB value to a Color.
+func colorFromRGB(rgb int) Color {
+	return Color{
+		R: float64(rgb>>16&0xff) / 255,
+		G: float64(rgb>>8&0xff) / 255,
+		B: float64(rgb&0xff) / 255,
+	}
+}
+
 // GetTextPage creates a TextPage from a Page for detailed text analysis.
+// The text page is always new and owned by the caller, even if the page
+// caches text pages. flags is a combination of the Text* extraction
+// flags, TextFlagsDefault if omitted.
 func (p *Page) GetTextPage(flags ...int) (*TextPage, error) {
-	flag := TextFlagsDefault
-	if len(flags) > 0 {
-		flag = flags[0]
+	return p.extractTextPage(context.Background(), "Page.GetTextPage", textFlags(flags), ErrTextExtract)
+}
+
+// GetTextPageWithOptions is like GetTextPage but takes TextOptions.
+func (p *Page) GetTextPageWithOptions(opt TextOptions) (*TextPage, error) {
+	return p.extractTextPage(context.Background(), "Page.GetTextPage", opt.withDefaults(), ErrTextExtract)
+}
+
+// extractTextPage extracts a new text page, stopping when ctx is done, in
+// which case it returns ctx.Err().
+func (p *Page) extractTextPage(ctx context.Context, op string, opt TextOptions, fail error) (*TextPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	var errcode C.int
-	tp := C.gomupdf_new_stext_page(p.ctx.ctx, p.page, C.int(flag), &errcode)
-	if errcode != 0 || tp == nil {
-		return nil, ErrTextExtract
+	ck := newCookie(ctx)
+	tp, fc, err := p.newSTextPage(op, opt, ck, fail)
+	ck.close()
+	if err := ctx.Err(); err != nil {
+		if tp != nil {
+			C.gomupdf_drop_stext_page(fc.ctx, tp)
+			fc.close()
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newTextPage(fc, tp, p.number, opt), nil
+}
+
+// CacheTextPages turns memoizing of text pages on or off. While it is on,
+// GetText, GetTextWords, GetTextBlocks, SearchFor and Search extract the
+// page once for each combination of flags, clip and sort, and reuse the
+// result. The cache does not notice edits of the page; call
+// InvalidateTextPages after changing it. Turning caching off, or closing
+// the page, frees the cached text pages.
+func (p *Page) CacheTextPages(on bool) {
+	p.textMu.Lock()
+	defer p.textMu.Unlock()
+	if on {
+		if p.textPages == nil {
+			p.textPages = make(map[TextOptions]*TextPage)
+		}
+		return
+	}
+	for _, t := range p.textPages {
+		t.Close()
+	}
+	p.textPages = nil
+}
+
+// InvalidateTextPages frees the cached text pages, so that the next text
+// method call extracts the page again. Caching stays on.
+func (p *Page) InvalidateTextPages() {
+	p.textMu.Lock()
+	defer p.textMu.Unlock()
+	for opt, t := range p.textPages {
+		t.Close()
+		delete(p.textPages, opt)
+	}
+}
+
+// withTextPage calls fn with a text page of p for opt: the cached one if
+// p caches text pages, or else a new one that is closed when fn returns.
+// Use of a cached text page is serialized, as it has a single context.
+func (p *Page) withTextPage(ctx context.Context, op string, opt TextOptions, fail error, fn func(*TextPage) error) error {
+	// Delimiters only matter when splitting words, so they are not part
+	// of the cache key; callers pass them on themselves.
+	opt.Delimiters = ""
+	p.textMu.Lock()
+	if p.textPages == nil {
+		p.textMu.Unlock()
+		t, err := p.extractTextPage(ctx, op, opt, fail)
+		if err != nil {
+			return err
+		}
+		defer t.Close()
+		return fn(t)
+	}
+	defer p.textMu.Unlock()
+	t := p.textPages[opt]
+	if t == nil {
+		var err error
+		if t, err = p.extractTextPage(ctx, op, opt, fail); err != nil {
+			return err
+		}
+		p.textPages[opt] = t
+	} else {
+		p.doc.mu.Lock()
+		closed := p.closed()
+		p.doc.mu.Unlock()
+		if closed {
+			return ErrClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 	}
-	return &TextPage{ctx: p.ctx, tp: tp}, nil
+	return fn(t)
 }
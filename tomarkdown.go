@@ -0,0 +1,106 @@
+//go:build cgo && !nomupdf
+
+package gomupdf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ToMarkdown converts the page to Markdown for text processing. Text in
+// font sizes larger than most of the text becomes headings, the largest
+// size "#"; bold, italic and monospaced text is marked up, lines starting
+// with a bullet or number become list items, links become [text](uri)
+// and tables found by FindTables become pipe tables. Images are included
+// if opts name a directory to save them to.
+func (p *Page) ToMarkdown(opts ...MarkdownOptions) (string, error) {
+	opt := DefaultMarkdownOptions()
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	m, err := p.markdownPage(opt)
+	if err != nil {
+		return "", err
+	}
+	return m.markdown(headingLevels([]mdPage{m})), nil
+}
+
+// ToMarkdown converts the pages pno to Markdown like Page.ToMarkdown,
+// with headings chosen from the font sizes of all of them. A nil pages
+// converts the whole document.
+func (d *Document) ToMarkdown(pages []int, opts ...MarkdownOptions) (string, error) {
+	opt := DefaultMarkdownOptions()
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if pages == nil {
+		for pno := 0; pno < d.PageCount(); pno++ {
+			pages = append(pages, pno)
+		}
+	}
+	mds := make([]mdPage, len(pages))
+	for i, pno := range pages {
+		page, err := d.LoadPage(pno)
+		if err != nil {
+			return "", err
+		}
+		mds[i], err = page.markdownPage(opt)
+		page.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	levels := headingLevels(mds)
+	var sb strings.Builder
+	for i := range mds {
+		if s := mds[i].markdown(levels); s != "" {
+			if sb.Len() > 0 {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(s)
+		}
+	}
+	return sb.String(), nil
+}
+
+// markdownPage collects the text, links, tables and images of the page.
+func (p *Page) markdownPage(opt MarkdownOptions) (mdPage, error) {
+	var m mdPage
+	flags := TextFlagsDefault
+	if opt.ImageDir != "" {
+		flags |= TextPreserveImages
+	}
+	tp, err := p.GetTextPageWithOptions(TextOptions{Flags: flags})
+	if err != nil {
+		return m, err
+	}
+	defer tp.Close()
+	m.blocks = tp.Blocks()
+	if opt.ImageDir != "" {
+		images, err := tp.blockImages()
+		if err != nil {
+			return m, err
+		}
+		if len(images) > 0 {
+			if err := os.MkdirAll(opt.ImageDir, 0o755); err != nil {
+				return m, err
+			}
+		}
+		for i, img := range images {
+			path := filepath.Join(opt.ImageDir, fmt.Sprintf("page%d-image%d.png", p.number, i))
+			if err := os.WriteFile(path, img, 0o644); err != nil {
+				return m, err
+			}
+			m.images = append(m.images, filepath.ToSlash(path))
+		}
+	}
+	if m.links, err = p.GetLinks(); err != nil {
+		return m, err
+	}
+	if m.tables, err = p.wordTables(tp.Words(), opt.Tables); err != nil {
+		return m, err
+	}
+	return m, nil
+}
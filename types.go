@@ -1,5 +1,17 @@
 package gomupdf
 
+import "strings"
+
+// MemoryStats reports the memory MuPDF uses for a document.
+type MemoryStats struct {
+	Allocated int64 // bytes currently allocated
+	Peak      int64 // highest Allocated value seen
+	Limit     int64 // OpenOptions.MemoryLimit, 0 if unlimited
+	Refused   int64 // allocations refused because of Limit
+	StoreSize int64 // bytes held by the resource store, -1 if unknown
+	StoreMax  int64 // capacity of the resource store, 0 if unlimited
+}
+
 // TOCItem represents a table of contents entry.
 type TOCItem struct {
 	Level int
@@ -30,30 +42,178 @@ type Link struct {
 
 // FontInfo contains information about a font referenced by a page.
 type FontInfo struct {
-	Xref     int
-	Ext      string
-	Type     string
-	BaseName string
-	Name     string
-	Encoding string
+	Xref       int    // xref of the font dictionary; 0 for a direct object
+	Ext        string // "ttf", "cff", "otf", "pfa", or "n/a" if not embedded
+	Type       string // font subtype, e.g. "TrueType", "Type0", "Type3"
+	BaseName   string // PostScript name, including any subset prefix
+	Name       string // resource name the content stream uses, e.g. "F1"
+	Encoding   string
+	Embedded   bool // the font program is embedded in the PDF
+	Subset     bool // BaseName carries a subset tag such as "ABCDEF+"
+	Referencer int  // xref of the page or Form XObject using the font
 }
 
 // ImageInfo contains information about an image referenced by a page.
 type ImageInfo struct {
 	Xref       int
-	SMask      int
+	SMask      int // xref of the soft mask, or 0
 	Width      int
 	Height     int
 	BPC        int
-	Colorspace string
-	AltCS      string
-	Name       string
-	Filter     string
+	Colorspace string // e.g. "DeviceRGB", "ICCBased", "Indexed"
+	AltCS      string // alternate or base colorspace, if any
+	Name       string // resource name the content stream uses, e.g. "Im1"
+	Filter     string // first decode filter, e.g. "DCTDecode"
+	Referencer int    // xref of the page or Form XObject using the image
+}
+
+// ImageRect is a place where an image is drawn on a page.
+type ImageRect struct {
+	Rect   Rect   // bounding box in page coordinates
+	Matrix Matrix // maps the unit square onto the image's position
+}
+
+// PathItemKind identifies the kind of a PathItem.
+type PathItemKind int
+
+const (
+	PathMove  PathItemKind = iota // Points[0] starts a new subpath
+	PathLine                      // line from Points[0] to Points[1]
+	PathCurve                     // cubic Bézier: start, two control points, end
+	PathRect                      // axis-aligned rectangle in Rect
+	PathQuad                      // rotated or skewed rectangle in Quad
+)
+
+// PathItem is one segment of a Drawing.
+type PathItem struct {
+	Kind   PathItemKind
+	Points []Point // set for PathMove, PathLine and PathCurve
+	Rect   Rect    // set for PathRect
+	Quad   Quad    // set for PathQuad
+}
+
+// Drawing is a vector path painted on a page. Coordinates are in page
+// space with the origin at the top-left corner, like Rect.
+type Drawing struct {
+	Items         []PathItem
+	Rect          Rect      // area covered, including the line width
+	Color         *Color    // stroke color; nil if the path is not stroked
+	Fill          *Color    // fill color; nil if the path is not filled
+	Width         float64   // line width; 0 if the path is not stroked
+	Dashes        []float64 // dash pattern; nil for solid lines
+	DashPhase     float64
+	LineCap       int     // LineCapButt, LineCapRound or LineCapSquare
+	LineJoin      int     // LineJoinMiter, LineJoinRound or LineJoinBevel
+	StrokeOpacity float64 // 0 if the path is not stroked
+	FillOpacity   float64 // 0 if the path is not filled
+	EvenOdd       bool    // filled with the even-odd rule
+	ClosePath     bool    // the last subpath is explicitly closed
+}
+
+// Device receives the drawing operations of a page in drawing order, as
+// replayed by Page.Run. Paths, text and images are given in their own
+// coordinate space and ctm maps them to device space, which is page space
+// transformed by the matrix passed to Page.Run. Scissor and area
+// rectangles are in device space. Every Clip method and BeginMask is
+// matched by a later PopClip.
+//
+// Embed BaseDevice to implement only the methods of interest.
+type Device interface {
+	FillPath(path []PathItem, evenOdd bool, ctm Matrix, color DeviceColor)
+	StrokePath(path []PathItem, stroke *StrokeState, ctm Matrix, color DeviceColor)
+	ClipPath(path []PathItem, evenOdd bool, ctm Matrix, scissor Rect)
+	ClipStrokePath(path []PathItem, stroke *StrokeState, ctm Matrix, scissor Rect)
+
+	FillText(text []TextSpan, ctm Matrix, color DeviceColor)
+	StrokeText(text []TextSpan, stroke *StrokeState, ctm Matrix, color DeviceColor)
+	ClipText(text []TextSpan, ctm Matrix, scissor Rect)
+	ClipStrokeText(text []TextSpan, stroke *StrokeState, ctm Matrix, scissor Rect)
+	IgnoreText(text []TextSpan, ctm Matrix) // invisible text, e.g. an OCR layer
+
+	FillShade(bbox Rect, ctm Matrix, alpha float64)
+	FillImage(img DeviceImage, ctm Matrix, alpha float64)
+	FillImageMask(img DeviceImage, ctm Matrix, color DeviceColor)
+	ClipImageMask(img DeviceImage, ctm Matrix, scissor Rect)
+
+	PopClip()
+	BeginMask(area Rect, luminosity bool, backdrop DeviceColor)
+	EndMask()
+	BeginGroup(area Rect, isolated, knockout bool, blendMode string, alpha float64)
+	EndGroup()
+}
+
+// BaseDevice implements Device with methods that do nothing.
+type BaseDevice struct{}
+
+func (BaseDevice) FillPath([]PathItem, bool, Matrix, DeviceColor)           {}
+func (BaseDevice) StrokePath([]PathItem, *StrokeState, Matrix, DeviceColor) {}
+func (BaseDevice) ClipPath([]PathItem, bool, Matrix, Rect)                  {}
+func (BaseDevice) ClipStrokePath([]PathItem, *StrokeState, Matrix, Rect)    {}
+func (BaseDevice) FillText([]TextSpan, Matrix, DeviceColor)                 {}
+func (BaseDevice) StrokeText([]TextSpan, *StrokeState, Matrix, DeviceColor) {}
+func (BaseDevice) ClipText([]TextSpan, Matrix, Rect)                        {}
+func (BaseDevice) ClipStrokeText([]TextSpan, *StrokeState, Matrix, Rect)    {}
+func (BaseDevice) IgnoreText([]TextSpan, Matrix)                            {}
+func (BaseDevice) FillShade(Rect, Matrix, float64)                          {}
+func (BaseDevice) FillImage(DeviceImage, Matrix, float64)                   {}
+func (BaseDevice) FillImageMask(DeviceImage, Matrix, DeviceColor)           {}
+func (BaseDevice) ClipImageMask(DeviceImage, Matrix, Rect)                  {}
+func (BaseDevice) PopClip()                                                 {}
+func (BaseDevice) BeginMask(Rect, bool, DeviceColor)                        {}
+func (BaseDevice) EndMask()                                                 {}
+func (BaseDevice) BeginGroup(Rect, bool, bool, string, float64)             {}
+func (BaseDevice) EndGroup()                                                {}
+
+// DeviceColor is the color of a Device operation.
+type DeviceColor struct {
+	Colorspace string    // e.g. "DeviceRGB"; empty if no color is set
+	Components []float64 // one value per colorant of Colorspace
+	RGB        Color     // the color converted to RGB
+	Alpha      float64
+}
+
+// StrokeState describes how a path or text is stroked, in the
+// coordinate space of the path.
+type StrokeState struct {
+	Width      float64
+	LineCap    int // LineCapButt, LineCapRound or LineCapSquare
+	LineJoin   int // LineJoinMiter, LineJoinRound or LineJoinBevel
+	MiterLimit float64
+	Dashes     []float64
+	DashPhase  float64
+}
+
+// TextSpan is a run of glyphs drawn with one font.
+type TextSpan struct {
+	Font      string // font name, without any subset tag
+	Trm       Matrix // font size, skew and direction; E and F are unused
+	WMode     int    // 0 for horizontal, 1 for vertical writing
+	BidiLevel int    // even for left-to-right, odd for right-to-left text
+	Glyphs    []Glyph
+}
+
+// Glyph is one glyph of a TextSpan.
+type Glyph struct {
+	Origin Point // pen position in text space
+	GID    int   // glyph index in the font; -1 if Rune continues the previous glyph
+	Rune   rune  // Unicode character; -1 if the glyph continues the previous character
+}
+
+// DeviceImage describes an image passed to a Device. The ctm of the call
+// maps the unit square onto the image.
+type DeviceImage struct {
+	Width, Height int
+	BPC           int
+	N             int    // color components, including alpha
+	Colorspace    string // empty for image masks
+	XRes, YRes    int    // resolution in dots per inch
+	ImageMask     bool   // a stencil painted with the call's color
 }
 
 // TextWord represents a word with its bounding box.
 type TextWord struct {
 	Rect    Rect
+	Quad    Quad // follows the text direction
 	Text    string
 	BlockNo int
 	LineNo  int
@@ -136,6 +296,191 @@ type InsertImageOptions struct {
 	Overlay        bool
 }
 
+// FinishOptions configures how Shape.Finish strokes and fills the
+// drawings made since the previous Finish. Start from
+// DefaultFinishOptions to get a solid black outline.
+type FinishOptions struct {
+	Color         *Color    // outline color; nil draws no outline
+	Fill          *Color    // fill color; nil leaves the drawings unfilled
+	Width         float64   // line width
+	Dashes        []float64 // dash pattern such as {3, 2}; nil draws solid lines
+	DashPhase     float64
+	LineCap       int     // LineCapButt, LineCapRound or LineCapSquare
+	LineJoin      int     // LineJoinMiter, LineJoinRound or LineJoinBevel
+	StrokeOpacity float64 // 0 < opacity < 1 for translucent outlines; other values are opaque
+	FillOpacity   float64 // 0 < opacity < 1 for translucent fills; other values are opaque
+	EvenOdd       bool    // use the even-odd rule instead of nonzero winding to fill
+	ClosePath     bool    // connect the end of the last subpath back to its start
+}
+
+// DefaultFinishOptions returns options for a solid black outline of
+// width 1 with no fill.
+func DefaultFinishOptions() FinishOptions {
+	return FinishOptions{Color: &Color{0, 0, 0}, Width: 1}
+}
+
+// TextOptions controls text extraction.
+type TextOptions struct {
+	// Flags is a combination of the Text* extraction flags. Zero means
+	// TextFlagsDefault.
+	Flags int
+	// Clip restricts extraction to the characters lying mostly inside
+	// it. The zero Rect extracts the whole page.
+	Clip Rect
+	// Sort puts blocks in reading order, top to bottom then left to
+	// right, instead of the order the page draws them in.
+	Sort bool
+	// Delimiters lists runes that end a word, in addition to
+	// whitespace, when extracting words. They belong to no word.
+	Delimiters string
+}
+
+// DefaultTextOptions returns the options used when none are given.
+func DefaultTextOptions() TextOptions {
+	return TextOptions{Flags: TextFlagsDefault}
+}
+
+// Selection is text selected on a TextPage.
+type Selection struct {
+	Text  string
+	Quads []Quad // highlight area, one quad per line
+}
+
+// TableOptions configures Page.FindTables. Start from
+// DefaultTableOptions.
+type TableOptions struct {
+	Strategy int  // TableStrategyAuto, TableStrategyLines or TableStrategyText
+	Clip     Rect // area to search; the zero Rect searches the whole page
+	// SnapTolerance is the distance below which ruling lines are
+	// considered to be at the same position or to touch.
+	SnapTolerance float64
+	// MinColumnGap is the smallest horizontal gap between words that
+	// separates columns of a table without ruling lines.
+	MinColumnGap float64
+	// MinRows is the smallest number of aligned rows that make a table
+	// without ruling lines.
+	MinRows int
+}
+
+// DefaultTableOptions returns the options used when none are given.
+func DefaultTableOptions() TableOptions {
+	return TableOptions{SnapTolerance: 3, MinColumnGap: 10, MinRows: 3}
+}
+
+// Table is a table found on a page.
+type Table struct {
+	Rect Rect
+	// Cells holds the rows of the table, including the header row. A
+	// cell spanning several rows or columns is stored at its top-left
+	// position; the positions it covers hold cells with an empty Rect.
+	Cells [][]TableCell
+	// Header holds the column names if the first row is a header,
+	// recognized by having no numbers where the rows below have some.
+	Header []string
+}
+
+// TableCell is a cell of a Table. Lines of text in a cell are separated
+// by "\n".
+type TableCell struct {
+	Rect Rect
+	Text string
+}
+
+// MarkdownOptions configures Page.ToMarkdown and Document.ToMarkdown.
+// Start from DefaultMarkdownOptions.
+type MarkdownOptions struct {
+	// ImageDir, if not empty, is the directory where images are saved
+	// as PNG files for the Markdown to reference. Otherwise images are
+	// left out.
+	ImageDir string
+	// Tables configures the detection of the tables that are converted
+	// to pipe tables.
+	Tables TableOptions
+}
+
+// DefaultMarkdownOptions returns the options used when none are given.
+func DefaultMarkdownOptions() MarkdownOptions {
+	return MarkdownOptions{Tables: DefaultTableOptions()}
+}
+
+// ChunkOptions configures Document.Chunks. Start from
+// DefaultChunkOptions; the zero value puts each section of every page in
+// one chunk.
+type ChunkOptions struct {
+	// MaxSize is the largest size of a chunk as measured by Size. Zero
+	// or less puts each section, from heading to heading, in one chunk.
+	MaxSize int
+	// Size measures text, for example in tokens of a language model. Nil
+	// counts runes.
+	Size func(string) int
+	// Pages lists the pages to split. Nil means every page.
+	Pages []int
+}
+
+// DefaultChunkOptions returns chunks of at most 1000 runes from every
+// page.
+func DefaultChunkOptions() ChunkOptions {
+	return ChunkOptions{MaxSize: 1000}
+}
+
+// Chunk is a piece of a document's text made of whole paragraphs where
+// they fit, for indexing in retrieval systems.
+type Chunk struct {
+	Text    string
+	Spans   []ChunkSpan // where the text is, one per paragraph and page
+	TOCPath []string    // titles of the enclosing table of contents entries, outermost first
+}
+
+// ChunkSpan is the area of a page that text of a chunk comes from.
+type ChunkSpan struct {
+	Page int
+	Rect Rect
+}
+
+// SearchOptions configures Page.Search and Document.Search. The zero
+// value searches every page, ignoring case.
+type SearchOptions struct {
+	CaseSensitive bool
+	// WholeWords only reports hits that neither start nor end inside a
+	// word.
+	WholeWords bool
+	// Pages lists the pages Document.Search visits, in order. Nil means
+	// every page.
+	Pages []int
+}
+
+// DefaultSearchOptions returns case-insensitive search of every page.
+func DefaultSearchOptions() SearchOptions {
+	return SearchOptions{}
+}
+
+// SearchResult is a hit of a text search.
+type SearchResult struct {
+	Page    int
+	Quads   []Quad // one per line the hit spans
+	Context string // text of those lines
+}
+
+// ExtractImageOptions configures image extraction.
+type ExtractImageOptions struct {
+	// MergeSMask applies the image's soft mask as an alpha channel. The
+	// result is then always a PNG.
+	MergeSMask bool
+}
+
+// ExtractedImage is an image taken out of a PDF as a file.
+type ExtractedImage struct {
+	Xref       int
+	Ext        string // "jpeg", "jpx" or "jb2" for streams returned as stored, otherwise "png"
+	Width      int
+	Height     int
+	BPC        int
+	N          int    // color components, plus alpha if merged
+	Colorspace string // colorspace of Image, e.g. "DeviceRGB"
+	SMask      int    // xref of the soft mask, or 0
+	Image      []byte
+}
+
 // STextBlockType indicates the type of a structured text block.
 type STextBlockType int
 
@@ -151,10 +496,22 @@ type STextBlock struct {
 	Lines []STextLine
 }
 
-// STextLine represents a line of text.
+// Text returns the text of the block's lines, separated by "\n".
+func (b STextBlock) Text() string {
+	lines := make([]string, len(b.Lines))
+	for i, l := range b.Lines {
+		lines[i] = l.Text()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// STextLine represents a line of text. Chars holds all characters of the
+// line; Spans holds the same characters grouped into spans.
 type STextLine struct {
 	Rect  Rect
 	Dir   Point
+	WMode int // 0 for horizontal, 1 for vertical writing
+	Spans []STextSpan
 	Chars []STextChar
 }
 
@@ -167,13 +524,40 @@ func (l STextLine) Text() string {
 	return s
 }
 
+// STextSpan is a run of consecutive characters of a line that share
+// font, size, flags, color and bidi level.
+type STextSpan struct {
+	Font      string  // font name without subset tag
+	Size      float64 // font size
+	Flags     int     // combination of TextFont* flags
+	Color     Color   // sRGB fill color
+	Ascender  float64 // font ascender, as a fraction of Size
+	Descender float64 // font descender, as a fraction of Size; negative
+	BidiLevel int     // even for left-to-right, odd for right-to-left text
+	Origin    Point   // origin of the first character
+	Rect      Rect    // union of the character rectangles
+	Chars     []STextChar
+}
+
+// Text returns the text content of the span.
+func (s STextSpan) Text() string {
+	var sb strings.Builder
+	for _, ch := range s.Chars {
+		sb.WriteRune(ch.C)
+	}
+	return sb.String()
+}
+
 // STextChar represents a single character.
 type STextChar struct {
 	C      rune
 	Origin Point
-	Rect   Rect
+	Rect   Rect // bounding box of Quad
+	Quad   Quad // exact area of the glyph, rotated with the text
 	Size   float64
 	Font   string
+	Color  Color // sRGB fill color
+	Bidi   int   // bidi level: even for left-to-right, odd for right-to-left
 }
 
 // PixmapOption configures pixmap creation.
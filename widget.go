@@ -10,12 +10,17 @@ import "unsafe"
 
 // Widget represents a PDF form field widget.
 type Widget struct {
-	ctx    *context
+	ctx    *fzContext
 	widget *C.pdf_annot
 	page   *Page
 }
 
-func (w *Widget) FieldType() int { return int(C.gomupdf_widget_type(w.ctx.ctx, w.widget)) }
+func (w *Widget) FieldType() int {
+	if w.page.closed() {
+		return WidgetTypeUnknown
+	}
+	return int(C.gomupdf_widget_type(w.ctx.ctx, w.widget))
+}
 
 func (w *Widget) FieldTypeString() string {
 	names := map[int]string{
@@ -31,6 +36,9 @@ func (w *Widget) FieldTypeString() string {
 }
 
 func (w *Widget) FieldName() string {
+	if w.page.closed() {
+		return ""
+	}
 	s := C.gomupdf_widget_name(w.ctx.ctx, w.widget)
 	if s == nil {
 		return ""
@@ -39,6 +47,9 @@ func (w *Widget) FieldName() string {
 }
 
 func (w *Widget) FieldValue() string {
+	if w.page.closed() {
+		return ""
+	}
 	s := C.gomupdf_widget_value(w.ctx.ctx, w.widget)
 	if s == nil {
 		return ""
@@ -47,24 +58,35 @@ func (w *Widget) FieldValue() string {
 }
 
 func (w *Widget) SetFieldValue(value string) error {
+	if w.page.closed() {
+		return ErrClosed
+	}
 	cValue := C.CString(value)
 	defer C.free(unsafe.Pointer(cValue))
 	errcode := C.gomupdf_set_widget_value(w.ctx.ctx, w.page.doc.pdf, w.widget, cValue)
 	if errcode != 0 {
-		return ErrInvalidArg
+		return w.ctx.failed("Widget.SetFieldValue", errcode, ErrInvalidArg)
 	}
 	return nil
 }
 
 func (w *Widget) Rect() Rect {
+	if w.page.closed() {
+		return Rect{}
+	}
 	r := C.gomupdf_annot_rect(w.ctx.ctx, w.widget)
 	return Rect{X0: float64(r.x0), Y0: float64(r.y0), X1: float64(r.x1), Y1: float64(r.y1)}
 }
 
-func (w *Widget) Xref() int { return int(C.gomupdf_annot_xref(w.ctx.ctx, w.widget)) }
+func (w *Widget) Xref() int {
+	if w.page.closed() {
+		return 0
+	}
+	return int(C.gomupdf_annot_xref(w.ctx.ctx, w.widget))
+}
 
 func (p *Page) GetWidgets() []*Widget {
-	if !p.doc.IsPDF() {
+	if p.closed() || !p.doc.IsPDF() {
 		return nil
 	}
 	pdfPage := C.pdf_page_from_fz_page(p.ctx.ctx, p.page)